@@ -0,0 +1,16 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// protectFile restricts access to path to its owner
+func protectFile(path string) error {
+	if err := os.Chmod(path, 0600); err != nil {
+		return fmt.Errorf("could not set permissions: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/hectane/go-acl"
+	"golang.org/x/sys/windows"
+)
+
+// protectFile restricts access to path to SYSTEM and Administrators
+func protectFile(path string) error {
+	system, err := windows.CreateWellKnownSid(windows.WinLocalSystemSid)
+	if err != nil {
+		return fmt.Errorf("could not create SYSTEM SID: %w", err)
+	}
+	admins, err := windows.CreateWellKnownSid(windows.WinBuiltinAdministratorsSid)
+	if err != nil {
+		return fmt.Errorf("could not create Administrators SID: %w", err)
+	}
+
+	if err = acl.Apply(path, true, false, acl.GrantSid(windows.GENERIC_ALL, system), acl.GrantSid(windows.GENERIC_ALL, admins)); err != nil {
+		return fmt.Errorf("could not set permissions: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultApprovalWindow is the default time a second person has to approve an enable request
+const DefaultApprovalWindow = 2 * time.Minute
+
+var errNamedApproval = errors.New("enabling requires two different named users; the shared password, unlock codes, and remote unlock can't request or approve it")
+
+// Approval is an enable request approved by one user, waiting for a second user to approve it
+type Approval struct {
+	User    string    `json:"user"`
+	Expires time.Time `json:"expires"`
+
+	change *statusChange
+}
+
+// Remaining returns the time remaining for a second user to approve
+func (a *Approval) Remaining() time.Duration {
+	if r := until(a.Expires); r > 0 {
+		return r
+	}
+	return 0
+}
+
+// String returns a human readable description of the approval
+func (a *Approval) String() string {
+	return fmt.Sprintf("Enable approved by %s, waiting for a second person for %s", a.User, formatRemaining(a.Remaining()))
+}
+
+// sameAdapters returns true if a and b name the same adapters, ignoring order and case
+func sameAdapters(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	norm := func(names []string) []string {
+		n := make([]string, len(names))
+		for i, name := range names {
+			n[i] = strings.ToLower(name)
+		}
+		sort.Strings(n)
+		return n
+	}
+	na, nb := norm(a), norm(b)
+	for i := range na {
+		if na[i] != nb[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// sameExam returns true if a and b are the same exam, or both nil. Exams that haven't been scheduled yet have no ID,
+// so they're compared by name, since an end given as a duration differs between requests
+func sameExam(a, b *Exam) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.ID == b.ID && strings.EqualFold(a.Name, b.Name)
+}
+
+// sameChange returns true if a and b request the same change
+func sameChange(a, b *statusChange) bool {
+	return a.Enabled == b.Enabled && a.Force == b.Force && a.Duration == b.Duration && sameAdapters(a.Adapters, b.Adapters) &&
+		sameExam(a.exam, b.exam)
+}
+
+// approve checks c, made by acct, against the two-person rule. If the rule doesn't apply, or c matches an approval by
+// a different user that hasn't expired, true is returned and the approval's user is added to c.Approvers. Otherwise,
+// c replaces any existing approval and the new approval is returned. Only named users can request or approve an
+// enable, so errNamedApproval is returned for the shared password and single-use credentials
+func (s *Server) approve(acct *account, c *statusChange) (*Approval, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.Config.TwoPersonEnable || !c.Enabled {
+		return nil, true, nil
+	}
+
+	if !acct.named {
+		s.audit(&AuditRecord{Event: auditApproval, Action: string(actionEnable), Outcome: auditDenied, User: acct.Name, Adapters: c.Adapters, Error: errNamedApproval.Error()})
+		s.Logger.Warn().Str("user", acct.Name).Msg("enable approval by an unnamed account")
+		return nil, false, errNamedApproval
+	}
+
+	if a := s.approval; a != nil && a.Remaining() > 0 && !strings.EqualFold(a.User, acct.Name) && sameChange(a.change, c) {
+		s.approval = nil
+		c.Approvers = append(c.Approvers, a.User)
+		return nil, true, nil
+	}
+
+	s.approval = &Approval{User: acct.Name, Expires: serviceClock.Now().Add(s.Config.approvalWindow()), change: c}
+	s.audit(&AuditRecord{Event: auditApproval, Action: string(actionEnable), Outcome: auditPending, User: acct.Name, Adapters: c.Adapters})
+	s.Logger.Info().Str("user", acct.Name).Time("expires", s.approval.Expires).Msg("enable waiting for second approver")
+	return s.approval, false, nil
+}
+
+// pendingApproval returns the approval waiting for a second user, or nil if there isn't one. s.mu must be held
+func (s *Server) pendingApproval() *Approval {
+	if s.approval == nil || s.approval.Remaining() == 0 {
+		return nil
+	}
+	return s.approval
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	attestKeyPath       = filepath.Join(installPath, "attest.key")
+	attestPublicKeyPath = filepath.Join(installPath, "attest.pub")
+)
+
+var errInvalidAttestation = errors.New("invalid attestation")
+
+// timeFormats are the formats accepted by parseTime
+var timeFormats = []string{time.RFC3339, "2006-01-02T15:04", "2006-01-02 15:04", "2006-01-02"}
+
+// parseTime parses s as an RFC 3339 time or a local date and time, e.g. "2026-03-14 09:00"
+func parseTime(s string) (time.Time, error) {
+	for _, format := range timeFormats {
+		if t, err := time.ParseInLocation(format, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q: use a format like 2006-01-02 15:04 or %s", s, time.RFC3339)
+}
+
+// newAttestKey generates an Ed25519 attestation key at path and writes its public key to pubPath, unless a key
+// already exists at path. It returns true if a key was generated
+func newAttestKey(path, pubPath string) (bool, error) {
+	if _, err := os.Stat(path); err == nil {
+		return false, nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return false, fmt.Errorf("could not check attestation key: %w", err)
+	}
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return false, fmt.Errorf("could not generate attestation key: %w", err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return false, fmt.Errorf("could not encode attestation key: %w", err)
+	}
+	if err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return false, fmt.Errorf("could not write attestation key: %w", err)
+	}
+	if err = protectFile(path); err != nil {
+		return false, fmt.Errorf("could not protect attestation key: %w", err)
+	}
+
+	buf, err := encodeAttestPublicKey(pub)
+	if err != nil {
+		return false, err
+	}
+	if err = os.WriteFile(pubPath, buf, 0644); err != nil {
+		return false, fmt.Errorf("could not write attestation public key: %w", err)
+	}
+
+	return true, nil
+}
+
+// loadAttestKey reads the attestation key at path
+func loadAttestKey(path string) (ed25519.PrivateKey, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read attestation key: %w", err)
+	}
+
+	block, _ := pem.Decode(buf)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, errors.New("could not decode attestation key: not a PEM private key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse attestation key: %w", err)
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("could not parse attestation key: not an Ed25519 key")
+	}
+
+	return priv, nil
+}
+
+// encodeAttestPublicKey returns pub as a PEM public key
+func encodeAttestPublicKey(pub ed25519.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode attestation public key: %w", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// readAttestPublicKey reads the PEM attestation public key at path
+func readAttestPublicKey(path string) (ed25519.PublicKey, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read public key: %w", err)
+	}
+
+	block, _ := pem.Decode(buf)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, errors.New("could not decode public key: not a PEM public key")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse public key: %w", err)
+	}
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("could not parse public key: not an Ed25519 key")
+	}
+
+	return pub, nil
+}
+
+// keyFingerprint returns the SHA-256 fingerprint of pub
+func keyFingerprint(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// AttestPeriod is a period of time the network was locked or unlocked
+type AttestPeriod struct {
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Locked bool      `json:"locked"`
+	// User is the user whose change started the period, if it started during the window
+	User   string `json:"user,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Duration returns the length of the period
+func (p *AttestPeriod) Duration() time.Duration {
+	return p.End.Sub(p.Start)
+}
+
+// Attestation is a statement of the network state of a machine during a window of time, made from its audit log
+type Attestation struct {
+	Machine   string    `json:"machine"`
+	From      time.Time `json:"from"`
+	To        time.Time `json:"to"`
+	Generated time.Time `json:"generated"`
+	Version   string    `json:"version"`
+	// AuditRecords and AuditHead are the number of records in the audit log and the hash of the last record when the
+	// statement was made
+	AuditRecords uint64 `json:"audit_records"`
+	AuditHead    string `json:"audit_head"`
+	// Periods are the times the network was locked and unlocked during the window
+	Periods []*AttestPeriod `json:"periods"`
+	// UnlockedSeconds is the total time the network was unlocked during the window
+	UnlockedSeconds int64 `json:"unlocked_seconds"`
+	// Events are the network changes, enforcement actions, exams, and service starts and stops during the window
+	Events []*AuditRecord `json:"events"`
+}
+
+// attestEvent returns true if rec is included in an attestation's events
+func attestEvent(rec *AuditRecord) bool {
+	switch rec.Event {
+	case auditChange, auditReconcile, auditService, auditExam:
+		return true
+	}
+	return false
+}
+
+// lockState is the locked state of the network replayed from the audit log, like State.Locked and State.Allowed
+type lockState struct {
+	locked bool
+	// allowed are the lowercased names of the adapters individually enabled while locked
+	allowed map[string]bool
+}
+
+// apply updates st with the change recorded by rec, returning false if rec doesn't record a change
+func (st *lockState) apply(rec *AuditRecord) bool {
+	if rec.Event != auditChange || rec.Change == nil {
+		return false
+	}
+	c := rec.Change
+	if len(c.Adapters) == 0 {
+		st.locked, st.allowed = !c.Enabled, nil
+		return true
+	}
+	if !st.locked {
+		return true
+	}
+	if st.allowed == nil {
+		st.allowed = make(map[string]bool)
+	}
+	for _, name := range c.Adapters {
+		if c.Enabled {
+			st.allowed[strings.ToLower(name)] = true
+		} else {
+			delete(st.allowed, strings.ToLower(name))
+		}
+	}
+	return true
+}
+
+// Locked returns true if every selected adapter is disabled. The network counts as unlocked while any adapter is
+// individually enabled
+func (st *lockState) Locked() bool {
+	return st.locked && len(st.allowed) == 0
+}
+
+// lockTimeline returns the periods the network was locked and unlocked from from to to, replaying the changes in
+// records, which must be in order
+func lockTimeline(records []*AuditRecord, from, to time.Time) []*AttestPeriod {
+	periods := make([]*AttestPeriod, 0)
+	current := &AttestPeriod{Start: from}
+	st := new(lockState)
+	for _, rec := range records {
+		if rec.Time.After(to) {
+			break
+		}
+		if !st.apply(rec) {
+			continue
+		}
+		locked := st.Locked()
+		if rec.Time.Before(from) {
+			current.Locked = locked
+			continue
+		}
+		if locked == current.Locked {
+			continue
+		}
+		current.End = rec.Time
+		periods = append(periods, current)
+		current = &AttestPeriod{Start: rec.Time, Locked: locked, User: rec.User, Reason: rec.Change.Reason}
+	}
+	current.End = to
+	periods = append(periods, current)
+
+	// drop the empty period left when a change happens exactly at the start of the window
+	if len(periods) > 1 && periods[0].Duration() == 0 {
+		periods = periods[1:]
+	}
+
+	return periods
+}
+
+// unlockedTime returns the total time the network was unlocked during periods
+func unlockedTime(periods []*AttestPeriod) time.Duration {
+	var unlocked time.Duration
+	for _, p := range periods {
+		if !p.Locked {
+			unlocked += p.Duration()
+		}
+	}
+	return unlocked
+}
+
+// newAttestation returns an Attestation for the window from to to, made from the audit log at path chained with key
+func newAttestation(path string, key []byte, from, to time.Time) (*Attestation, error) {
+	if !to.After(from) {
+		return nil, fmt.Errorf("%w: the end of the window must be after the start", errInvalidAttestation)
+	}
+
+	a := &Attestation{Machine: machineID(), From: from, To: to, Generated: time.Now(), Version: version, Events: make([]*AuditRecord, 0)}
+
+	var records []*AuditRecord
+	summary, err := readAudit(path, keyedChain(key), func(rec *AuditRecord) error {
+		if rec.Time.After(to) {
+			return nil
+		}
+		records = append(records, rec)
+		if !rec.Time.Before(from) && attestEvent(rec) {
+			a.Events = append(a.Events, rec)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not read audit log: %w", err)
+	}
+
+	a.Periods = lockTimeline(records, from, to)
+	a.UnlockedSeconds = int64(unlockedTime(a.Periods) / time.Second)
+	a.AuditRecords, a.AuditHead = summary.Records, summary.Head
+
+	return a, nil
+}
+
+// SignedAttestation is an Attestation and its Ed25519 signature. The signature is over the statement's compact JSON
+// encoding, so the file can be reformatted without invalidating it
+type SignedAttestation struct {
+	Statement json.RawMessage `json:"statement"`
+	// Key is the fingerprint of the public key that signed the statement
+	Key       string `json:"key"`
+	Signature string `json:"signature"`
+}
+
+// signAttestation signs a with key
+func signAttestation(a *Attestation, key ed25519.PrivateKey) (*SignedAttestation, error) {
+	statement, err := json.Marshal(a)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode statement: %w", err)
+	}
+
+	return &SignedAttestation{
+		Statement: statement,
+		Key:       keyFingerprint(key.Public().(ed25519.PublicKey)),
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(key, statement)),
+	}, nil
+}
+
+// VerifyAttestation checks the signed attestation in buf was signed by pub, returning its statement
+func VerifyAttestation(buf []byte, pub ed25519.PublicKey) (*Attestation, error) {
+	signed := new(SignedAttestation)
+	if err := json.Unmarshal(buf, signed); err != nil {
+		return nil, fmt.Errorf("%w: could not decode: %v", errInvalidAttestation, err)
+	}
+
+	if fp := keyFingerprint(pub); signed.Key != fp {
+		return nil, fmt.Errorf("%w: signed by key %s, not %s", errInvalidAttestation, signed.Key, fp)
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(signed.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not decode signature: %v", errInvalidAttestation, err)
+	}
+
+	statement := new(bytes.Buffer)
+	if err = json.Compact(statement, signed.Statement); err != nil {
+		return nil, fmt.Errorf("%w: could not decode statement: %v", errInvalidAttestation, err)
+	}
+	if !ed25519.Verify(pub, statement.Bytes(), sig) {
+		return nil, fmt.Errorf("%w: signature doesn't match statement", errInvalidAttestation)
+	}
+
+	a := new(Attestation)
+	if err = json.Unmarshal(signed.Statement, a); err != nil {
+		return nil, fmt.Errorf("%w: could not decode statement: %v", errInvalidAttestation, err)
+	}
+
+	return a, nil
+}
@@ -0,0 +1,782 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+var (
+	auditPath    = filepath.Join(installPath, "audit.log")
+	auditKeyPath = filepath.Join(installPath, "audit.key")
+)
+
+// auditHeadPath returns the path of the head file for the audit log at path
+func auditHeadPath(path string) string {
+	return path + ".head"
+}
+
+// maxAuditLine is the maximum length of an audit record
+const maxAuditLine = 1 << 20
+
+// auditKeyLen is the length of the key audit records are chained with
+const auditKeyLen = 32
+
+// auditIndexInterval is the number of records between marks in an audit log's index
+const auditIndexInterval = 256
+
+var errAuditTampered = errors.New("audit log has been modified")
+
+// errStopAudit is returned by a function called with each record to stop reading the audit log
+var errStopAudit = errors.New("stop reading audit log")
+
+// audit events
+const (
+	// auditAuth is an authentication attempt
+	auditAuth = "auth"
+	// auditChange is a change to the network status
+	auditChange = "change"
+	// auditApproval is an enable request waiting for a second approver
+	auditApproval = "approval"
+	// auditReconcile is a selected adapter disabled because it was enabled while the network was locked
+	auditReconcile = "reconcile"
+	// auditConfig is a change to users, passwords, unlock codes, or lockouts
+	auditConfig = "config"
+	// auditService is the service starting or stopping
+	auditService = "service"
+	// auditExam is an exam being scheduled, started, ended, or canceled
+	auditExam = "exam"
+)
+
+// audit outcomes
+const (
+	auditSuccess   = "success"
+	auditFailure   = "failure"
+	auditPartial   = "partial"
+	auditPending   = "pending"
+	auditDenied    = "denied"
+	auditLockedOut = "locked-out"
+	auditBusy      = "busy"
+)
+
+// audit methods, in addition to the credential methods returned by credentials.method
+const auditMethodSession = "session"
+
+// auditActions returns actions as a comma separated list
+func auditActions(actions []action) string {
+	names := make([]string, len(actions))
+	for i, a := range actions {
+		names[i] = string(a)
+	}
+	return strings.Join(names, ",")
+}
+
+// AuditRecord is a record in the audit log. Each record is written as a line of JSON, and is chained to the previous
+// record by the HMAC-SHA256 of its line, keyed with the audit key
+type AuditRecord struct {
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+	// Prev is the hex HMAC-SHA256 of the previous record's line, or of an empty line for the first record
+	Prev    string `json:"prev"`
+	Event   string `json:"event"`
+	Action  string `json:"action,omitempty"`
+	Outcome string `json:"outcome"`
+	User    string `json:"user,omitempty"`
+	// Method is how an auth attempt was authenticated, e.g. "password", "totp", or "session"
+	Method   string   `json:"method,omitempty"`
+	Peer     *Peer    `json:"peer,omitempty"`
+	Adapters []string `json:"adapters,omitempty"`
+	Change   *Change  `json:"change,omitempty"`
+	// Target is the user, unlock code batch, or lockout changed by a config event, or the name of an exam
+	Target string `json:"target,omitempty"`
+	// Exam is the ID of the exam in progress when the record was made
+	Exam  string `json:"exam,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// auditHead is the sequence number and hash of the last record in the audit log. It's stored separately from the log
+// so removing records from the end of the log can be detected
+type auditHead struct {
+	Seq  uint64 `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+// readAuditKey reads the base64 encoded audit key at path
+func readAuditKey(path string) ([]byte, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read audit key: %w", err)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(buf)))
+	if err != nil || len(key) != auditKeyLen {
+		return nil, fmt.Errorf("could not decode audit key: not a base64 encoded %d byte key", auditKeyLen)
+	}
+	return key, nil
+}
+
+// createAuditKey returns the audit key at path, generating it if it doesn't exist. Without the key, the chain can't be
+// recomputed after records are edited, so it's only readable by SYSTEM and Administrators
+func createAuditKey(path string) ([]byte, error) {
+	key, err := readAuditKey(path)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return key, err
+	}
+
+	key = make([]byte, auditKeyLen)
+	if _, err = rand.Read(key); err != nil {
+		return nil, fmt.Errorf("could not generate audit key: %w", err)
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("could not create directory: %w", err)
+	}
+	if err = os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600); err != nil {
+		return nil, fmt.Errorf("could not write audit key: %w", err)
+	}
+	if err = protectFile(path); err != nil {
+		return nil, fmt.Errorf("could not protect audit key: %w", err)
+	}
+
+	return key, nil
+}
+
+// auditChain returns the hash that links the record after line to it. It's called with nil for the first record
+type auditChain func(line []byte) string
+
+// keyedChain returns the chain keyed with key
+func keyedChain(key []byte) auditChain {
+	return func(line []byte) string {
+		mac := hmac.New(sha256.New, key)
+		mac.Write(line)
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+}
+
+// auditLog is an append-only, hash-chained audit log
+type auditLog struct {
+	path  string
+	chain auditChain
+
+	mu   sync.Mutex
+	f    *os.File
+	head auditHead
+	// size is the length of the log, and index marks every auditIndexInterval records, so reads can start near a record
+	size  int64
+	index []auditMark
+	// err is why the log can't be appended to, if it didn't match its head when it was opened
+	err error
+}
+
+// auditMark is the position of a record in the audit log, so it can be read from there
+type auditMark struct {
+	seq    uint64
+	offset int64
+	// prev is the hash the record is chained to
+	prev string
+}
+
+// auditIndexed returns true if the record numbered seq is marked in an audit log's index
+func auditIndexed(seq uint64) bool {
+	return seq > 1 && seq%auditIndexInterval == 1
+}
+
+// scanAuditLines splits records like bufio.ScanLines, but fails on a last line without a newline, since it may have
+// been cut short. The newline is counted in the advance, so offsets can be kept
+func scanAuditLines(data []byte, atEOF bool) (int, []byte, error) {
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return 0, nil, fmt.Errorf("%w: last record is incomplete", errAuditTampered)
+	}
+	return 0, nil, nil
+}
+
+// scanRecords reads the records in r, which starts at mark, checking that each is chained to the record before it.
+// fn (if not nil) is called with each record and its mark. The mark after the last record read is returned
+func scanRecords(r io.Reader, mark auditMark, chain auditChain, fn func(rec *AuditRecord, at auditMark) error) (auditMark, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxAuditLine)
+	scanner.Split(scanAuditLines)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		rec := new(AuditRecord)
+		if err := json.Unmarshal(line, rec); err != nil {
+			return mark, fmt.Errorf("%w: record %d: could not decode: %v", errAuditTampered, mark.seq, err)
+		}
+		if rec.Seq != mark.seq {
+			return mark, fmt.Errorf("%w: record %d: out of sequence (seq %d)", errAuditTampered, mark.seq, rec.Seq)
+		}
+		if rec.Prev != mark.prev {
+			return mark, fmt.Errorf("%w: record %d: previous record was changed", errAuditTampered, mark.seq)
+		}
+
+		at := mark
+		mark = auditMark{seq: mark.seq + 1, offset: mark.offset + int64(len(line)) + 1, prev: chain(line)}
+		if fn != nil {
+			if err := fn(rec, at); err != nil {
+				return mark, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return mark, fmt.Errorf("could not read audit log: %w", err)
+	}
+	return mark, nil
+}
+
+// openAudit opens the audit log at path for appending, creating it if it doesn't exist. Records are chained with key.
+// The log is checked against its head file, and if it doesn't match, the log is opened but appending to it fails
+// with the reason, so records aren't chained to a log that has been modified
+func openAudit(path string, key []byte) (*auditLog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("could not create directory: %w", err)
+	}
+
+	chain := keyedChain(key)
+	summary, err := VerifyAudit(path, key)
+	if errors.Is(err, fs.ErrNotExist) {
+		summary, err = &auditSummary{Head: chain(nil)}, nil
+		if _, headErr := os.Stat(auditHeadPath(path)); headErr == nil {
+			err = fmt.Errorf("%w: log is missing", errAuditTampered)
+		}
+	}
+
+	var tampered error
+	if errors.Is(err, errAuditTampered) {
+		tampered, err = err, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("could not open file: %w", err)
+	}
+
+	l := &auditLog{path: path, chain: chain, f: f, err: tampered}
+	if tampered == nil {
+		l.head = auditHead{Seq: summary.Records, Hash: summary.Head}
+		l.size, l.index = summary.end.offset, summary.index
+	}
+
+	if err = protectFile(path); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("could not protect file: %w", err)
+	}
+
+	return l, nil
+}
+
+// Err returns why the log can't be appended to, or nil if it can
+func (l *auditLog) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
+
+// writeHead atomically replaces the head file with the current head. l.mu must be held
+func (l *auditLog) writeHead() error {
+	buf, err := json.Marshal(l.head)
+	if err != nil {
+		return fmt.Errorf("could not encode audit head: %w", err)
+	}
+
+	path := auditHeadPath(l.path)
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, buf, 0600); err != nil {
+		return fmt.Errorf("could not write audit head: %w", err)
+	}
+	if err = protectFile(tmp); err != nil {
+		return fmt.Errorf("could not protect audit head: %w", err)
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("could not replace audit head: %w", err)
+	}
+
+	return nil
+}
+
+// Append chains rec to the last record and appends it to the log. rec's Seq, Prev, and Time (if zero) are set
+func (l *auditLog) Append(rec *AuditRecord) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return errors.New("audit log is closed")
+	}
+	if l.err != nil {
+		return fmt.Errorf("audit log isn't being appended to: %w", l.err)
+	}
+
+	rec.Seq = l.head.Seq + 1
+	rec.Prev = l.head.Hash
+	if rec.Time.IsZero() {
+		rec.Time = serviceClock.Now()
+	}
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("could not encode audit record: %w", err)
+	}
+	if _, err = l.f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("could not write audit record: %w", err)
+	}
+	if err = l.f.Sync(); err != nil {
+		return fmt.Errorf("could not sync audit log: %w", err)
+	}
+
+	if auditIndexed(rec.Seq) {
+		l.index = append(l.index, auditMark{seq: rec.Seq, offset: l.size, prev: l.head.Hash})
+	}
+	l.size += int64(len(line)) + 1
+
+	l.head = auditHead{Seq: rec.Seq, Hash: l.chain(line)}
+	return l.writeHead()
+}
+
+// Close closes the log. It's safe to call more than once
+func (l *auditLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
+
+// auditSummary is the result of verifying an audit log
+type auditSummary struct {
+	Records uint64
+	First   time.Time
+	Last    time.Time
+	// Head is the hash of the last record
+	Head string
+	// end is the mark after the last record, and index marks every auditIndexInterval records
+	end   auditMark
+	index []auditMark
+}
+
+// VerifyAudit checks that every record in the audit log at path is chained to the previous record in order with key,
+// and that the last record matches the head file, returning an error wrapping errAuditTampered at the first problem
+// found
+func VerifyAudit(path string, key []byte) (*auditSummary, error) {
+	return readAudit(path, keyedChain(key), nil)
+}
+
+// readAudit verifies the audit log at path like VerifyAudit with chain, calling fn (if not nil) with each record in
+// order. If fn returns an error, reading stops and the error is returned
+func readAudit(path string, chain auditChain, fn func(rec *AuditRecord) error) (*auditSummary, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open audit log: %w", err)
+	}
+	defer f.Close()
+
+	var head *auditHead
+	buf, err := os.ReadFile(auditHeadPath(path))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("could not read audit head: %w", err)
+	} else if err == nil {
+		head = new(auditHead)
+		if err = json.Unmarshal(buf, head); err != nil {
+			return nil, fmt.Errorf("%w: could not decode audit head: %v", errAuditTampered, err)
+		}
+	}
+
+	summary := new(auditSummary)
+	if summary.end, err = scanRecords(f, auditMark{seq: 1, prev: chain(nil)}, chain, func(rec *AuditRecord, at auditMark) error {
+		if at.seq == 1 {
+			summary.First = rec.Time
+		}
+		if auditIndexed(at.seq) {
+			summary.index = append(summary.index, at)
+		}
+		summary.Records, summary.Last = at.seq, rec.Time
+		if fn != nil {
+			return fn(rec)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	prev := summary.end.prev
+	switch {
+	case head == nil && summary.Records > 0:
+		return nil, fmt.Errorf("%w: head file is missing", errAuditTampered)
+	case head == nil:
+		summary.Head = prev
+		return summary, nil
+	case head.Seq > summary.Records:
+		return nil, fmt.Errorf("%w: truncated: head is record %d, log ends at record %d", errAuditTampered, head.Seq, summary.Records)
+	case head.Seq < summary.Records:
+		return nil, fmt.Errorf("%w: head is record %d, log has %d records", errAuditTampered, head.Seq, summary.Records)
+	case head.Hash != prev:
+		return nil, fmt.Errorf("%w: record %d: last record was changed", errAuditTampered, summary.Records)
+	}
+
+	summary.Head = prev
+	return summary, nil
+}
+
+// audit appends rec to the audit log, logging any error. Audit failures don't stop the service from enforcing the
+// network state
+func (s *Server) audit(rec *AuditRecord) {
+	if s.auditLog == nil {
+		return
+	}
+	if rec.Exam == "" {
+		rec.Exam = s.activeExamID()
+	}
+	if err := s.auditLog.Append(rec); err != nil {
+		s.Logger.Error().Err(err).Str("event", rec.Event).Msg("could not write audit record")
+	}
+}
+
+// audit query limits
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// auditFilter selects audit records. Empty fields match any record
+type auditFilter struct {
+	From time.Time
+	To   time.Time
+	// User, Action, and Event are case-insensitive globs. Action matches any of an auth attempt's actions
+	User    string
+	Action  string
+	Event   string
+	Outcome string
+	// Exam is the ID of an exam
+	Exam string
+	// After skips records up to and including the given sequence number, for paging
+	After uint64
+	Limit int
+}
+
+// Match returns true if rec is selected by f
+func (f *auditFilter) Match(rec *AuditRecord) bool {
+	if rec.Seq <= f.After {
+		return false
+	}
+	if !f.From.IsZero() && rec.Time.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && rec.Time.After(f.To) {
+		return false
+	}
+	if f.User != "" && !peerGlob(f.User, rec.User) {
+		return false
+	}
+	if f.Event != "" && !glob(f.Event, rec.Event) {
+		return false
+	}
+	if f.Outcome != "" && !strings.EqualFold(f.Outcome, rec.Outcome) {
+		return false
+	}
+	if f.Exam != "" && !strings.EqualFold(f.Exam, rec.Exam) {
+		return false
+	}
+	if f.Action != "" {
+		found := false
+		for _, a := range strings.Split(rec.Action, ",") {
+			if glob(f.Action, a) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Query returns f encoded as query parameters
+func (f *auditFilter) Query() url.Values {
+	q := make(url.Values)
+	if !f.From.IsZero() {
+		q.Set("from", f.From.Format(time.RFC3339Nano))
+	}
+	if !f.To.IsZero() {
+		q.Set("to", f.To.Format(time.RFC3339Nano))
+	}
+	for k, v := range map[string]string{"user": f.User, "action": f.Action, "event": f.Event, "outcome": f.Outcome, "exam": f.Exam} {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	if f.After > 0 {
+		q.Set("after", strconv.FormatUint(f.After, 10))
+	}
+	if f.Limit > 0 {
+		q.Set("limit", strconv.Itoa(f.Limit))
+	}
+	return q
+}
+
+// parseAuditFilter returns the filter encoded in q
+func parseAuditFilter(q url.Values) (*auditFilter, error) {
+	f := &auditFilter{User: q.Get("user"), Action: q.Get("action"), Event: q.Get("event"), Outcome: q.Get("outcome"), Exam: q.Get("exam"), Limit: defaultAuditLimit}
+
+	var err error
+	if v := q.Get("from"); v != "" {
+		if f.From, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			return nil, fmt.Errorf("invalid from: %w", err)
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		if f.To, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			return nil, fmt.Errorf("invalid to: %w", err)
+		}
+	}
+	if v := q.Get("after"); v != "" {
+		if f.After, err = strconv.ParseUint(v, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid after: %w", err)
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if f.Limit, err = strconv.Atoi(v); err != nil || f.Limit < 1 || f.Limit > maxAuditLimit {
+			return nil, fmt.Errorf("invalid limit: must be between 1 and %d", maxAuditLimit)
+		}
+	}
+	for _, pattern := range []string{f.User, f.Action, f.Event} {
+		if _, err = path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+
+	return f, nil
+}
+
+// Read calls fn with each record after the record numbered after, checking that each is chained to the record before
+// it and that the log ends at the head when reading started. Reading starts at the nearest mark in the index, so
+// records before it aren't checked again. The log is read through its own file, so appends don't wait for reading. If
+// fn returns errStopAudit, reading stops and nil is returned
+func (l *auditLog) Read(after uint64, fn func(rec *AuditRecord) error) error {
+	l.mu.Lock()
+	if l.err != nil {
+		l.mu.Unlock()
+		return fmt.Errorf("audit log can't be read: %w", l.err)
+	}
+	head, size := l.head, l.size
+	start := auditMark{seq: 1, prev: l.chain(nil)}
+	if i := sort.Search(len(l.index), func(i int) bool { return l.index[i].seq > after+1 }); i > 0 {
+		start = l.index[i-1]
+	}
+	l.mu.Unlock()
+
+	f, err := os.Open(l.path)
+	if err != nil {
+		return fmt.Errorf("could not open audit log: %w", err)
+	}
+	defer f.Close()
+
+	end, err := scanRecords(io.NewSectionReader(f, start.offset, size-start.offset), start, l.chain, func(rec *AuditRecord, _ auditMark) error {
+		if rec.Seq <= after {
+			return nil
+		}
+		return fn(rec)
+	})
+	if errors.Is(err, errStopAudit) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if end.seq-1 != head.Seq || end.prev != head.Hash {
+		return fmt.Errorf("%w: log doesn't end at record %d", errAuditTampered, head.Seq)
+	}
+
+	return nil
+}
+
+type auditResponse struct {
+	Error   string         `json:"error,omitempty"`
+	Records []*AuditRecord `json:"records,omitempty"`
+	// Next is the sequence number to request records after for the next page, if there are more records
+	Next uint64 `json:"next,omitempty"`
+}
+
+// writeAuditResponse writes resp with the given status code
+func (s *Server) writeAuditResponse(w http.ResponseWriter, code int, resp *auditResponse) {
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		s.Logger.Error().Err(fmt.Errorf("could not encode response: %w", err)).Send()
+	}
+}
+
+// Audit is an HTTP handler that returns a page of audit records selected by the filter in the query. It requires the
+// admin role
+func (s *Server) Audit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		s.Logger.Warn().Err(fmt.Errorf("invalid method: %s", r.Method)).Send()
+		return
+	}
+
+	// the proof covers the query, since there's no body
+	if s.authorize(w, r, []byte(r.URL.RawQuery), credentials{Username: r.Header.Get(userHeader)}, actionManage) == nil {
+		return
+	}
+
+	f, err := parseAuditFilter(r.URL.Query())
+	if err != nil {
+		s.Logger.Warn().Err(err).Send()
+		s.writeAuditResponse(w, http.StatusBadRequest, &auditResponse{Error: err.Error()})
+		return
+	}
+
+	resp := &auditResponse{Records: make([]*AuditRecord, 0, f.Limit)}
+	if err = s.auditLog.Read(f.After, func(rec *AuditRecord) error {
+		if !f.Match(rec) {
+			return nil
+		}
+		if len(resp.Records) == f.Limit {
+			resp.Next = resp.Records[len(resp.Records)-1].Seq
+			return errStopAudit
+		}
+		resp.Records = append(resp.Records, rec)
+		return nil
+	}); err != nil {
+		s.Logger.Error().Err(err).Msg("could not read audit log")
+		s.writeAuditResponse(w, http.StatusInternalServerError, &auditResponse{Error: err.Error()})
+		return
+	}
+
+	s.writeAuditResponse(w, http.StatusOK, resp)
+}
+
+// Audit requests a page of audit records selected by f
+func (c *Client) Audit(cred credentials, f *auditFilter) (*auditResponse, error) {
+	resp, err := c.get("/audit", cred, f.Query())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusBadRequest, http.StatusForbidden, http.StatusInternalServerError:
+		r := new(auditResponse)
+		if err := json.NewDecoder(resp.Body).Decode(r); err != nil {
+			return nil, fmt.Errorf("could not decode response: %w", err)
+		}
+		if resp.StatusCode == http.StatusForbidden {
+			return nil, fmt.Errorf("%w: %s", errForbidden, r.Error)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, errors.New(r.Error)
+		}
+		return r, nil
+	case http.StatusUnauthorized:
+		return nil, errUnauthorized
+	case http.StatusTooManyRequests:
+		return nil, clientLockoutError(resp)
+	case http.StatusServiceUnavailable:
+		return nil, errBusy
+	default:
+		return nil, fmt.Errorf("unexpected status: %d %s", resp.StatusCode, resp.Status)
+	}
+}
+
+// audit list formats
+const (
+	auditFormatTable = "table"
+	auditFormatJSONL = "jsonl"
+	auditFormatCSV   = "csv"
+)
+
+// Details returns a short human readable description of the record's details
+func (rec *AuditRecord) Details() string {
+	details := make([]string, 0, 4)
+	if rec.Change != nil {
+		details = append(details, rec.Change.String())
+	} else if len(rec.Adapters) > 0 {
+		details = append(details, "adapters: "+strings.Join(rec.Adapters, ", "))
+	}
+	if rec.Method != "" {
+		details = append(details, "method: "+rec.Method)
+	}
+	if rec.Target != "" {
+		details = append(details, "target: "+rec.Target)
+	}
+	if rec.Exam != "" {
+		details = append(details, "exam: "+rec.Exam)
+	}
+	if rec.Peer != nil {
+		details = append(details, "from: "+rec.Peer.String())
+	}
+	if rec.Error != "" {
+		details = append(details, "error: "+rec.Error)
+	}
+	return strings.Join(details, "; ")
+}
+
+// writeAuditRecords writes records to w in the given format
+func writeAuditRecords(w io.Writer, format string, records []*AuditRecord) error {
+	switch format {
+	case auditFormatTable:
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "SEQ\tTIME\tEVENT\tACTION\tOUTCOME\tUSER\tDETAILS")
+		for _, rec := range records {
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", rec.Seq, rec.Time.Local().Format("2006-01-02 15:04:05"),
+				rec.Event, rec.Action, rec.Outcome, rec.User, rec.Details())
+		}
+		if err := tw.Flush(); err != nil {
+			return fmt.Errorf("could not write records: %w", err)
+		}
+	case auditFormatJSONL:
+		enc := json.NewEncoder(w)
+		for _, rec := range records {
+			if err := enc.Encode(rec); err != nil {
+				return fmt.Errorf("could not write records: %w", err)
+			}
+		}
+	case auditFormatCSV:
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"seq", "time", "event", "action", "outcome", "user", "method", "peer", "adapters", "target", "reason", "category", "exam", "error"})
+		for _, rec := range records {
+			var peer, reason, category string
+			if rec.Peer != nil {
+				peer = rec.Peer.String()
+			}
+			if rec.Change != nil {
+				reason, category = rec.Change.Reason, rec.Change.Category
+			}
+			cw.Write([]string{strconv.FormatUint(rec.Seq, 10), rec.Time.Format(time.RFC3339), rec.Event, rec.Action,
+				rec.Outcome, rec.User, rec.Method, peer, strings.Join(rec.Adapters, " "), rec.Target, reason, category, rec.Exam, rec.Error})
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			return fmt.Errorf("could not write records: %w", err)
+		}
+	default:
+		return fmt.Errorf("unknown format: %s", format)
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	ndisMedium8023        = 0
+	ndisMediumNative80211 = 16
+)
+
+const (
+	interfaceAdminStatusUp   = 1
+	interfaceAdminStatusDown = 2
+)
+
+const (
+	mediaConnectStateUnknown      = 0
+	mediaConnectStateConnected    = 1
+	mediaConnectStateDisconnected = 2
+)
+
+// Adapter is a network adapter managed by a Backend
+type Adapter struct {
+	Name                 string `json:"name"`
+	InterfaceDescription string `json:"interface_description"`
+	MAC                  string `json:"mac"`
+	NdisMedium           int    `json:"ndis_medium"`
+	Virtual              bool   `json:"virtual"`
+	InterfaceAdminStatus int    `json:"interface_admin_status"`
+	MediaConnectState    int    `json:"media_connect_state"`
+	InterfaceIndex       int    `json:"interface_index"`
+}
+
+// Enabled returns true if the adapter is administratively up
+func (a *Adapter) Enabled() bool {
+	return a.InterfaceAdminStatus == interfaceAdminStatusUp
+}
+
+// Connected returns true if the adapter has a network connection
+func (a *Adapter) Connected() bool {
+	return a.MediaConnectState == mediaConnectStateConnected
+}
+
+// String returns a human readable description of the adapter and its status
+func (a *Adapter) String() string {
+	status := "Disabled"
+	if a.Enabled() {
+		status = "Enabled"
+		if a.Connected() {
+			status = "Connected"
+		}
+	}
+	return fmt.Sprintf("%s (%s): %s", a.Name, a.InterfaceDescription, status)
+}
+
+// Backend lists, enables, and disables network adapters
+type Backend interface {
+	// List returns all managed network adapters
+	List() ([]*Adapter, error)
+	// Enable enables the named network adapter
+	Enable(name string) error
+	// Disable disables the named network adapter
+	Disable(name string) error
+	// Close closes the Backend
+	Close() error
+}
+
+// Watcher is implemented by Backends that can notify when adapters change
+type Watcher interface {
+	// Watch sends on the returned channel when adapters may have changed. The channel is closed when ctx is canceled
+	// or watching fails
+	Watch(ctx context.Context) (<-chan struct{}, error)
+}
+
+// countEnabled returns the number of enabled adapters
+func countEnabled(adapters []*Adapter) int {
+	count := 0
+	for _, a := range adapters {
+		if a.Enabled() {
+			count++
+		}
+	}
+	return count
+}
+
+// adapterNames returns the names of the adapters
+func adapterNames(adapters []*Adapter) []string {
+	names := make([]string, 0, len(adapters))
+	for _, a := range adapters {
+		names = append(names, a.Name)
+	}
+	return names
+}
+
+// selectNamed returns the adapters with the given names, or an error if any name isn't found
+func selectNamed(adapters []*Adapter, names []string) ([]*Adapter, error) {
+	selected := make([]*Adapter, 0, len(names))
+	for _, name := range names {
+		found := false
+		for _, a := range adapters {
+			if strings.EqualFold(a.Name, name) {
+				selected = append(selected, a)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%w: %s", errUnknownAdapter, name)
+		}
+	}
+	return selected, nil
+}
+
+// partialError is returned when some adapters couldn't be changed
+type partialError struct {
+	// Failed maps adapter names to errors
+	Failed map[string]string
+}
+
+func (e *partialError) Error() string {
+	names := make([]string, 0, len(e.Failed))
+	for name := range e.Failed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return fmt.Sprintf("could not change %s", strings.Join(names, ", "))
+}
+
+// applyStatus sets the adapters to enabled or disabled, returning the adapters that were changed. If any adapters
+// can't be changed, the rest are still changed and a *partialError is returned
+func applyStatus(b Backend, adapters []*Adapter, enabled bool) ([]*Adapter, error) {
+	var changed []*Adapter
+	failed := make(map[string]string)
+	for _, a := range adapters {
+		var err error
+		if !a.Enabled() && enabled {
+			err = b.Enable(a.Name)
+		} else if a.Enabled() && !enabled {
+			err = b.Disable(a.Name)
+		} else {
+			continue
+		}
+
+		if err != nil {
+			failed[a.Name] = err.Error()
+			continue
+		}
+		changed = append(changed, a)
+	}
+
+	if len(failed) > 0 {
+		return changed, &partialError{Failed: failed}
+	}
+
+	return changed, nil
+}
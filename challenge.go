@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/korylprince/go-win-netcontrol/hash"
+)
+
+// challenge limits
+const (
+	challengeTTL  = time.Minute
+	maxChallenges = 1024
+	nonceLen      = 32
+	// maxChallengeMemory is the most memory in KiB a client will use to derive a key, so a malicious server can't
+	// exhaust the client's memory
+	maxChallengeMemory = 1024 * 1024
+)
+
+// headers carrying a challenge-response proof
+const (
+	nonceHeader = "X-Netcontrol-Nonce"
+	proofHeader = "X-Netcontrol-Proof"
+	// userHeader is the user name for GET requests, which don't have a body to send it in
+	userHeader = "X-Netcontrol-User"
+)
+
+var errInvalidChallenge = errors.New("invalid challenge")
+
+type challengeRequest struct {
+	// Username is the user that will authenticate. If empty, the shared password is used
+	Username string `json:"username,omitempty"`
+	// TOTP is true if the user will authenticate with a TOTP code instead of the password
+	TOTP bool `json:"totp,omitempty"`
+}
+
+type challengeResponse struct {
+	Error string `json:"error,omitempty"`
+	Nonce []byte `json:"nonce,omitempty"`
+	// Params are used to derive the key from the password. They aren't set for TOTP challenges, which derive the key
+	// from the code with totpParams
+	Params *hash.Params `json:"params,omitempty"`
+}
+
+type challenge struct {
+	username string
+	totp     bool
+	expires  time.Time
+}
+
+// challenges are the outstanding nonces issued to clients. Each nonce can be used once, by the user it was issued for,
+// before it expires
+type challenges struct {
+	// secret derives fake salts for unknown users, so they can't be distinguished from real users
+	secret []byte
+
+	mu      sync.Mutex
+	pending map[string]*challenge
+}
+
+func newChallenges() (*challenges, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("could not generate secret: %w", err)
+	}
+	return &challenges{secret: secret, pending: make(map[string]*challenge)}, nil
+}
+
+// issue returns a new nonce for username, authenticating with a TOTP code if totp is true
+func (c *challenges) issue(username string, totp bool) ([]byte, error) {
+	nonce := make([]byte, nonceLen)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("could not generate nonce: %w", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := serviceClock.Now()
+	if len(c.pending) >= maxChallenges {
+		for key, ch := range c.pending {
+			if now.After(ch.expires) {
+				delete(c.pending, key)
+			}
+		}
+		if len(c.pending) >= maxChallenges {
+			return nil, errBusy
+		}
+	}
+
+	c.pending[string(nonce)] = &challenge{username: strings.ToLower(username), totp: totp, expires: now.Add(challengeTTL)}
+	return nonce, nil
+}
+
+// consume removes nonce, returning its challenge and true if it was issued for username and hasn't expired
+func (c *challenges) consume(nonce []byte, username string) (*challenge, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ch, ok := c.pending[string(nonce)]
+	if !ok {
+		return nil, false
+	}
+	delete(c.pending, string(nonce))
+	return ch, ch.username == strings.ToLower(username) && serviceClock.Now().Before(ch.expires)
+}
+
+// fakeSalt returns a salt for an unknown user that is the same for every challenge
+func (c *challenges) fakeSalt(username string) []byte {
+	mac := hmac.New(sha256.New, c.secret)
+	mac.Write([]byte(strings.ToLower(username)))
+	return mac.Sum(nil)[:hash.SaltLen]
+}
+
+// proofMessage returns the message a proof is created for, binding the proof to the nonce and the whole request
+func proofMessage(nonce []byte, method, path string, body []byte) []byte {
+	msg := make([]byte, 0, len(nonce)+len(method)+len(path)+len(body)+2)
+	msg = append(msg, nonce...)
+	msg = append(msg, method+" "+path+"\n"...)
+	return append(msg, body...)
+}
+
+// Challenge is an HTTP handler that issues a nonce and the parameters to derive a user's key from their password
+func (s *Server) Challenge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		s.Logger.Warn().Err(fmt.Errorf("invalid method: %s", r.Method)).Send()
+		return
+	}
+
+	req := new(challengeRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		s.Logger.Warn().Err(fmt.Errorf("could not decode request: %w", err)).Send()
+		return
+	}
+
+	nonce, err := s.challenges.issue(req.Username, req.TOTP)
+	if errors.Is(err, errBusy) {
+		s.Logger.Warn().Str("user", req.Username).Msg("too many outstanding challenges")
+		s.writeBusy(w)
+		return
+	} else if err != nil {
+		s.Logger.Error().Err(err).Send()
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var params *hash.Params
+	if !req.TOTP {
+		acct, h := s.lookup(req.Username)
+		params = h.Params()
+		if acct == nil {
+			params.Salt = s.challenges.fakeSalt(req.Username)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(&challengeResponse{Nonce: nonce, Params: params}); err != nil {
+		s.Logger.Error().Err(fmt.Errorf("could not encode response: %w", err)).Send()
+	}
+}
+
+// authenticateProof returns the account for a challenge-response proof of msg, created with the nonce issued for name
+// and the key derived from name's password, or from name's TOTP code if the challenge was for TOTP
+func (s *Server) authenticateProof(name string, nonce, proof, msg []byte) (*account, error) {
+	ch, valid := s.challenges.consume(nonce, name)
+	if !valid {
+		return nil, errUnauthorized
+	}
+	if ch.totp {
+		return s.authenticateCodeProof(name, nonce, proof, msg)
+	}
+
+	acct, h := s.lookup(name)
+	if err := h.ValidateProof(msg, proof); err != nil || acct == nil {
+		return nil, errUnauthorized
+	}
+	return acct, nil
+}
+
+// challenge requests a nonce for cred and returns the key to create a proof with, derived from the TOTP code if set,
+// or the password otherwise
+func (c *Client) challenge(cred credentials) (nonce, key []byte, err error) {
+	totp := cred.Code != ""
+	body := new(bytes.Buffer)
+	if err = json.NewEncoder(body).Encode(&challengeRequest{Username: cred.Username, TOTP: totp}); err != nil {
+		return nil, nil, fmt.Errorf("could not encode body: %w", err)
+	}
+
+	resp, err := c.client.Post("http://unix/challenge", "application/json", body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not post challenge request: %w", requestError(err))
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusServiceUnavailable:
+		return nil, nil, errBusy
+	default:
+		return nil, nil, fmt.Errorf("unexpected challenge status: %d %s", resp.StatusCode, resp.Status)
+	}
+
+	ch := new(challengeResponse)
+	if err = json.NewDecoder(resp.Body).Decode(ch); err != nil {
+		return nil, nil, fmt.Errorf("could not decode challenge: %w", err)
+	}
+	if len(ch.Nonce) != nonceLen {
+		return nil, nil, errInvalidChallenge
+	}
+	if totp {
+		return ch.Nonce, totpParams(ch.Nonce).Key([]byte(cred.Code)), nil
+	}
+	if ch.Params == nil || len(ch.Params.Salt) != hash.SaltLen || ch.Params.Memory > maxChallengeMemory {
+		return nil, nil, errInvalidChallenge
+	}
+
+	return ch.Nonce, ch.Params.Key([]byte(cred.Password)), nil
+}
+
+// post encodes v as JSON and posts it to path, authenticated with a challenge-response proof of cred's password or
+// TOTP code. Neither is sent. If cred has an unlock code or remote unlock, it must be in v, and no proof is added. If cred has none of
+// these and c has a Session, the request is authenticated with the session instead. If the session is no longer
+// valid, it's cleared and errSessionExpired is returned
+func (c *Client) post(path string, cred credentials, v interface{}) (*http.Response, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode body: %w", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, "http://unix"+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("could not create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	return c.do(req, cred, body)
+}
+
+// get sends a GET request for path with query, authenticating like post. The proof covers the query instead of a
+// body, and the user name is sent in a header
+func (c *Client) get(path string, cred credentials, query url.Values) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, "http://unix"+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not create request: %w", err)
+	}
+	if cred.Username != "" {
+		req.Header.Set(userHeader, cred.Username)
+	}
+
+	return c.do(req, cred, []byte(req.URL.RawQuery))
+}
+
+// do sends req, authenticating with the session if there is one and cred has no password or code, or a
+// challenge-response proof of cred over signed otherwise
+func (c *Client) do(req *http.Request, cred credentials, signed []byte) (*http.Response, error) {
+	sess := c.Session()
+	if cred.UnlockCode != "" || cred.Remote != nil {
+		sess = nil
+	} else if cred.Password == "" && cred.Code == "" && sess != nil {
+		req.Header.Set("Authorization", "Bearer "+sess.Token)
+	} else {
+		sess = nil
+		nonce, key, err := c.challenge(cred)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set(nonceHeader, base64.StdEncoding.EncodeToString(nonce))
+		req.Header.Set(proofHeader, base64.StdEncoding.EncodeToString(hash.Proof(key, proofMessage(nonce, req.Method, req.URL.Path, signed))))
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not send request: %w", requestError(err))
+	}
+
+	if sess != nil && resp.StatusCode == http.StatusUnauthorized {
+		resp.Body.Close()
+		c.mu.Lock()
+		if c.session == sess {
+			c.session = nil
+		}
+		c.mu.Unlock()
+		return nil, errSessionExpired
+	}
+
+	return resp, nil
+}
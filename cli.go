@@ -16,7 +16,8 @@ import (
 	"golang.org/x/sys/windows/svc/mgr"
 )
 
-var CLI struct {
+// ServiceCLI holds the Windows service commands
+type ServiceCLI struct {
 	Service *ServiceCmd `cmd:"" help:"monitor or install monitoring service"`
 }
 
@@ -119,6 +120,15 @@ func (c *InstallServiceCmd) Run() error {
 		return err
 	}
 
+	// keep an existing key, so statements from before a reinstall can still be checked
+	created, err := newAttestKey(attestKeyPath, attestPublicKeyPath)
+	if err != nil {
+		return err
+	}
+	if created {
+		fmt.Println("Attestation public key written to", attestPublicKeyPath)
+	}
+
 	if err := CreateLink(filepath.Join(ServiceConfig.InstallPath, ServiceConfig.ExecName), filepath.Join(`C:\Users\Public\Desktop`, fmt.Sprintf("%s.lnk", ServiceConfig.DisplayName))); err != nil {
 		return fmt.Errorf("could not install shortcut: %w", err)
 	}
@@ -0,0 +1,1184 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/korylprince/go-win-netcontrol/hash"
+	"golang.org/x/term"
+)
+
+// exit codes for client commands
+const (
+	exitError        = 1
+	exitUnauthorized = 2
+	exitServiceDown  = 3
+	exitPartial      = 4
+)
+
+// CLI is the command line interface
+var CLI struct {
+	ServiceCLI
+	Enable     *EnableCmd     `cmd:"" help:"enable network access"`
+	Disable    *DisableCmd    `cmd:"" help:"disable network access"`
+	Status     *StatusCmd     `cmd:"" help:"show network status"`
+	Password   *PasswordCmd   `cmd:"" help:"manage the password"`
+	User       *UserCmd       `cmd:"" help:"manage users"`
+	Lockout    *LockoutCmd    `cmd:"" help:"manage failed sign in lockouts"`
+	Codes      *CodesCmd      `cmd:"" help:"manage printable single-use unlock codes"`
+	UnlockCode *UnlockCodeCmd `cmd:"" name:"unlock-code" help:"respond to remote unlock challenges or set up remote unlock"`
+	Audit      *AuditCmd      `cmd:"" help:"list or check the audit log"`
+	Attest     *AttestCmd     `cmd:"" help:"create or verify signed statements of the network state"`
+	Report     *ReportCmd     `cmd:"" help:"create a report of the network state during an event"`
+	Exam       *ExamCmd       `cmd:"" help:"schedule, end, or show named exam sessions"`
+}
+
+// exitCode returns the process exit code for err
+func exitCode(err error) int {
+	var partialErr *partialError
+	switch {
+	case errors.Is(err, errUnauthorized), errors.Is(err, errForbidden), errors.Is(err, errLockedOut), errors.Is(err, errSessionExpired):
+		return exitUnauthorized
+	case errors.Is(err, errServiceDown):
+		return exitServiceDown
+	case errors.As(err, &partialErr):
+		return exitPartial
+	default:
+		return exitError
+	}
+}
+
+// PasswordFlags reads a user name and password or code from an environment variable, stdin, or a prompt
+type PasswordFlags struct {
+	User          string `env:"NETCONTROL_USER" help:"user to authenticate as (uses the shared password if empty)"`
+	Password      string `hidden:"" env:"NETCONTROL_PASSWORD" help:"password (use the environment variable instead of the flag)"`
+	PasswordStdin bool   `help:"read the password or code from stdin"`
+	TOTP          bool   `name:"totp" help:"authenticate with a one-time code from an authenticator app instead of the password"`
+}
+
+// UnlockFlags adds the single-use credentials to PasswordFlags. They're only accepted by requests that change the
+// network status, so other commands only take PasswordFlags
+type UnlockFlags struct {
+	PasswordFlags
+	UnlockCode   bool `help:"authenticate with a single-use code from an unlock code sheet instead of the password"`
+	RemoteUnlock bool `help:"show a challenge to read to IT and enter their response instead of the password"`
+}
+
+// stdin is shared so multiple lines can be read without losing buffered input
+var stdin = bufio.NewReader(os.Stdin)
+
+// readLine reads a single line from stdin
+func readLine() (string, error) {
+	line, err := stdin.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		if err == io.EOF {
+			return "", errors.New("no input")
+		}
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// promptSecret prompts for a secret on the terminal without echoing it
+func promptSecret(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	secret, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	return string(secret), nil
+}
+
+// ReadCredentials returns the unlock code if UnlockCode is set, a remote unlock response if RemoteUnlock is set, or
+// the credentials read by PasswordFlags otherwise
+func (f *UnlockFlags) ReadCredentials() (credentials, error) {
+	cred := credentials{Username: f.User}
+	if f.RemoteUnlock {
+		challenge, expires, err := NewClient().RemoteChallenge()
+		if err != nil {
+			return cred, fmt.Errorf("could not get challenge: %w", err)
+		}
+		fmt.Fprintf(os.Stderr, "Read this challenge to IT: %s (expires at %s)\n", challenge, expires.Local().Format("15:04"))
+		fmt.Fprint(os.Stderr, "Response: ")
+		resp, err := readLine()
+		if err != nil {
+			return cred, fmt.Errorf("could not read response: %w", err)
+		}
+		return credentials{Remote: &remoteUnlock{Challenge: challenge, Response: strings.TrimSpace(resp)}}, nil
+	}
+
+	if f.UnlockCode {
+		read := func() (string, error) { return promptSecret("Unlock code: ") }
+		if f.PasswordStdin {
+			read = readLine
+		}
+		code, err := read()
+		if err != nil {
+			return cred, fmt.Errorf("could not read unlock code: %w", err)
+		}
+		return credentials{UnlockCode: strings.TrimSpace(code)}, nil
+	}
+
+	return f.PasswordFlags.ReadCredentials()
+}
+
+// ReadCredentials returns the user name and password, or the TOTP code if TOTP is set
+func (f *PasswordFlags) ReadCredentials() (credentials, error) {
+	cred := credentials{Username: f.User}
+	if f.TOTP {
+		if f.User == "" {
+			return cred, errors.New("--totp requires --user")
+		}
+		read := func() (string, error) { return promptSecret("Code: ") }
+		if f.PasswordStdin {
+			read = readLine
+		}
+		code, err := read()
+		if err != nil {
+			return cred, fmt.Errorf("could not read code: %w", err)
+		}
+		cred.Code = strings.TrimSpace(code)
+		return cred, nil
+	}
+
+	if f.Password != "" {
+		cred.Password = f.Password
+		return cred, nil
+	}
+
+	read := func() (string, error) { return promptSecret("Password: ") }
+	if f.PasswordStdin {
+		read = readLine
+	}
+
+	passwd, err := read()
+	if err != nil {
+		return cred, fmt.Errorf("could not read password: %w", err)
+	}
+	cred.Password = passwd
+	return cred, nil
+}
+
+// printJSON prints v as indented JSON
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "    ")
+	if err := enc.Encode(v); err != nil {
+		return fmt.Errorf("could not encode output: %w", err)
+	}
+	return nil
+}
+
+// printResult prints the result of a status change
+func printResult(resp *response, err error, asJSON bool) error {
+	if asJSON {
+		if resp == nil {
+			resp = new(response)
+			if err != nil {
+				resp.Error = err.Error()
+			}
+		}
+		if jsonErr := printJSON(resp); jsonErr != nil {
+			return jsonErr
+		}
+		return err
+	}
+
+	if resp != nil {
+		for _, name := range resp.Changed {
+			fmt.Println("Changed:", name)
+		}
+		for name, msg := range resp.Failed {
+			fmt.Printf("Failed: %s: %s\n", name, msg)
+		}
+		if resp.Pending != nil {
+			fmt.Printf("Approved by %s. A second person must enable within %s\n", resp.Pending.User, formatRemaining(resp.Pending.Remaining()))
+		}
+		if resp.Grant != nil {
+			fmt.Printf("Network enabled until %s (%s remaining)\n", resp.Grant.Expires.Local().Format("15:04:05"), formatRemaining(resp.Grant.Remaining()))
+		}
+		if resp.Exam != nil {
+			fmt.Println("Exam:", resp.Exam)
+		}
+	}
+	return err
+}
+
+// ReasonFlags read the reason for a change from flags or a prompt
+type ReasonFlags struct {
+	Reason   string `help:"reason for the change"`
+	Category string `help:"category of the reason, from the configured categories"`
+}
+
+// ReadReason returns the reason and category, prompting for them if they're empty and the service requires them
+func (f *ReasonFlags) ReadReason() (string, string, error) {
+	if f.Reason != "" && f.Category != "" {
+		return f.Reason, f.Category, nil
+	}
+
+	st, err := NewClient().Status()
+	if err != nil || !st.ReasonRequired {
+		// the service will reject the request if it can't be checked here
+		return f.Reason, f.Category, nil
+	}
+
+	reason, category := f.Reason, f.Category
+	if reason == "" {
+		fmt.Fprint(os.Stderr, "Reason: ")
+		if reason, err = readLine(); err != nil {
+			return "", "", fmt.Errorf("could not read reason: %w", err)
+		}
+	}
+	if category == "" && len(st.ReasonCategories) > 0 {
+		fmt.Fprintf(os.Stderr, "Category (%s): ", strings.Join(st.ReasonCategories, ", "))
+		if category, err = readLine(); err != nil {
+			return "", "", fmt.Errorf("could not read category: %w", err)
+		}
+	}
+	return reason, category, nil
+}
+
+type EnableCmd struct {
+	UnlockFlags
+	ReasonFlags
+	Adapter  []string      `help:"only enable the given adapter (can be repeated)"`
+	Force    bool          `help:"enable all adapters instead of restoring the adapters that were enabled before disabling"`
+	Duration time.Duration `help:"disable the network again after the given duration, e.g. 5m"`
+	JSON     bool          `name:"json" help:"output JSON"`
+}
+
+// requestDuration returns d in whole seconds. Durations under a second are rejected, since they would be sent as 0,
+// which enables the network indefinitely
+func requestDuration(d time.Duration) (int, error) {
+	if d > 0 && d < time.Second {
+		return 0, fmt.Errorf("%w: %s is less than a second", errInvalidDuration, d)
+	}
+	return int(d.Seconds()), nil
+}
+
+func (c *EnableCmd) Run() error {
+	duration, err := requestDuration(c.Duration)
+	if err != nil {
+		return err
+	}
+
+	cred, err := c.ReadCredentials()
+	if err != nil {
+		return err
+	}
+
+	reason, category, err := c.ReadReason()
+	if err != nil {
+		return err
+	}
+
+	resp, err := NewClient().SetStatus(&request{
+		Username: cred.Username, Password: cred.Password, Code: cred.Code, UnlockCode: cred.UnlockCode, RemoteUnlock: cred.Remote,
+		Enabled: true, Adapters: c.Adapter, Force: c.Force, Duration: duration, Reason: reason, Category: category,
+	})
+	return printResult(resp, err, c.JSON)
+}
+
+type DisableCmd struct {
+	UnlockFlags
+	ReasonFlags
+	Adapter []string `help:"only disable the given adapter (can be repeated)"`
+	JSON    bool     `name:"json" help:"output JSON"`
+}
+
+func (c *DisableCmd) Run() error {
+	cred, err := c.ReadCredentials()
+	if err != nil {
+		return err
+	}
+
+	reason, category, err := c.ReadReason()
+	if err != nil {
+		return err
+	}
+
+	resp, err := NewClient().SetStatus(&request{
+		Username: cred.Username, Password: cred.Password, Code: cred.Code, UnlockCode: cred.UnlockCode, RemoteUnlock: cred.Remote,
+		Adapters: c.Adapter, Reason: reason, Category: category,
+	})
+	return printResult(resp, err, c.JSON)
+}
+
+type StatusCmd struct {
+	JSON bool `name:"json" help:"output JSON"`
+}
+
+func (c *StatusCmd) Run() error {
+	st, err := NewClient().Status()
+	if err != nil {
+		if c.JSON {
+			printJSON(&statusResponse{Error: err.Error()})
+		}
+		return err
+	}
+
+	if c.JSON {
+		if err = printJSON(st); err != nil {
+			return err
+		}
+		return statusError(st)
+	}
+
+	fmt.Println("Network:", st.Network())
+	if st.Grant != nil {
+		fmt.Printf("Grant: enabled until %s (%s remaining)\n", st.Grant.Expires.Local().Format("15:04:05"), formatRemaining(st.Grant.Remaining()))
+	}
+	if st.LastChange != nil {
+		fmt.Println("Last change:", st.LastChange)
+	}
+	if st.Approval != nil {
+		fmt.Println(st.Approval)
+	}
+	if st.Exam != nil {
+		fmt.Println("Exam:", st.Exam)
+	}
+	for _, l := range st.Lockouts {
+		fmt.Println(l)
+	}
+	fmt.Println("Adapters:")
+	for _, a := range st.Adapters {
+		fmt.Println("   ", a)
+	}
+	if st.Peer != nil {
+		fmt.Println("Connected as:", st.Peer)
+	}
+	fmt.Println("Version:", st.Version)
+
+	return statusError(st)
+}
+
+// statusError returns the error the service reported reading the adapters, if any
+func statusError(st *statusResponse) error {
+	if st.Error != "" {
+		return errors.New(st.Error)
+	}
+	return nil
+}
+
+type PasswordCmd struct {
+	Change *ChangePasswordCmd `cmd:"" help:"change the password"`
+}
+
+type ChangePasswordCmd struct {
+	PasswordFlags
+	NewPassword string `hidden:"" env:"NETCONTROL_NEW_PASSWORD" help:"new password (use the environment variable instead of the flag)"`
+}
+
+// readNewPassword returns newPasswd if set, otherwise the next line of stdin if fromStdin is true, or a confirmed
+// prompt
+func readNewPassword(newPasswd string, fromStdin bool) (string, error) {
+	if newPasswd != "" {
+		return newPasswd, nil
+	}
+
+	if fromStdin {
+		passwd, err := readLine()
+		if err != nil {
+			return "", fmt.Errorf("could not read new password: %w", err)
+		}
+		return passwd, nil
+	}
+
+	passwd, err := promptSecret("New password: ")
+	if err != nil {
+		return "", fmt.Errorf("could not read new password: %w", err)
+	}
+	confirm, err := promptSecret("Confirm new password: ")
+	if err != nil {
+		return "", fmt.Errorf("could not read new password: %w", err)
+	}
+	if passwd != confirm {
+		return "", errors.New("passwords do not match")
+	}
+	return passwd, nil
+}
+
+func (c *ChangePasswordCmd) Run() error {
+	cred, err := c.ReadCredentials()
+	if err != nil {
+		return err
+	}
+
+	newPasswd, err := readNewPassword(c.NewPassword, c.PasswordStdin)
+	if err != nil {
+		return err
+	}
+
+	if err = NewClient().ChangePassword(cred, newPasswd); err != nil {
+		return err
+	}
+
+	fmt.Println("Password changed")
+	return nil
+}
+
+type UserCmd struct {
+	List   *ListUserCmd   `cmd:"" help:"list users"`
+	Add    *AddUserCmd    `cmd:"" help:"add a user"`
+	Remove *RemoveUserCmd `cmd:"" help:"remove a user"`
+	TOTP   *TOTPUserCmd   `cmd:"" name:"totp" help:"set up or remove a user's authenticator app"`
+}
+
+type ListUserCmd struct {
+	PasswordFlags
+	JSON bool `name:"json" help:"output JSON"`
+}
+
+func (c *ListUserCmd) Run() error {
+	cred, err := c.ReadCredentials()
+	if err != nil {
+		return err
+	}
+
+	resp, err := NewClient().ManageUsers(&userRequest{Username: cred.Username, Password: cred.Password, Code: cred.Code, Action: userActionList})
+	if err != nil {
+		return err
+	}
+
+	if c.JSON {
+		return printJSON(resp.Users)
+	}
+	for _, u := range resp.Users {
+		if u.TOTP {
+			fmt.Printf("%s (%s, authenticator app)\n", u.Name, u.Role)
+			continue
+		}
+		fmt.Printf("%s (%s)\n", u.Name, u.Role)
+	}
+	return nil
+}
+
+type AddUserCmd struct {
+	PasswordFlags
+	Name        string `arg:"" help:"name of the user to add"`
+	Role        Role   `required:"" enum:"proctor,coach,admin" help:"role of the user: proctor (disable only), coach (enable, disable, and grants), or admin (everything, including managing users)"`
+	NewPassword string `hidden:"" env:"NETCONTROL_NEW_PASSWORD" help:"password of the new user (use the environment variable instead of the flag)"`
+}
+
+func (c *AddUserCmd) Run() error {
+	cred, err := c.ReadCredentials()
+	if err != nil {
+		return err
+	}
+
+	newPasswd, err := readNewPassword(c.NewPassword, c.PasswordStdin)
+	if err != nil {
+		return err
+	}
+
+	if _, err = NewClient().ManageUsers(&userRequest{
+		Username: cred.Username, Password: cred.Password, Code: cred.Code, Action: userActionAdd, Name: c.Name, Role: c.Role, NewPassword: newPasswd,
+	}); err != nil {
+		return err
+	}
+
+	fmt.Println("Added user:", c.Name)
+	return nil
+}
+
+type RemoveUserCmd struct {
+	PasswordFlags
+	Name string `arg:"" help:"name of the user to remove"`
+}
+
+func (c *RemoveUserCmd) Run() error {
+	cred, err := c.ReadCredentials()
+	if err != nil {
+		return err
+	}
+
+	if _, err = NewClient().ManageUsers(&userRequest{Username: cred.Username, Password: cred.Password, Code: cred.Code, Action: userActionRemove, Name: c.Name}); err != nil {
+		return err
+	}
+
+	fmt.Println("Removed user:", c.Name)
+	return nil
+}
+
+type TOTPUserCmd struct {
+	PasswordFlags
+	Name   string `arg:"" help:"name of the user"`
+	Remove bool   `help:"remove the user's TOTP secret instead of generating a new one"`
+	QRFile string `name:"qr-file" type:"path" help:"write the QR code to a PNG file instead of the terminal"`
+}
+
+func (c *TOTPUserCmd) Run() error {
+	cred, err := c.ReadCredentials()
+	if err != nil {
+		return err
+	}
+
+	action := userActionTOTP
+	if c.Remove {
+		action = userActionRemoveTOTP
+	}
+
+	resp, err := NewClient().ManageUsers(&userRequest{Username: cred.Username, Password: cred.Password, Code: cred.Code, Action: action, Name: c.Name})
+	if err != nil {
+		return err
+	}
+
+	if c.Remove {
+		fmt.Println("Removed TOTP secret:", c.Name)
+		return nil
+	}
+	if resp.TOTP == nil {
+		return errors.New("no TOTP secret returned")
+	}
+
+	t, err := hash.ParseTOTP(resp.TOTP.Secret)
+	if err != nil {
+		return fmt.Errorf("could not parse TOTP secret: %w", err)
+	}
+
+	fmt.Println("Add this account to an authenticator app. It won't be shown again.")
+	fmt.Println("Secret:", resp.TOTP.Secret)
+	fmt.Println("URI:", resp.TOTP.URI)
+
+	if c.QRFile != "" {
+		png, err := t.QRPNG(totpIssuer, c.Name, 256)
+		if err != nil {
+			return err
+		}
+		if err = os.WriteFile(c.QRFile, png, 0600); err != nil {
+			return fmt.Errorf("could not write QR code: %w", err)
+		}
+		fmt.Println("QR code written to", c.QRFile)
+		return nil
+	}
+
+	qr, err := t.QRString(totpIssuer, c.Name)
+	if err != nil {
+		return err
+	}
+	fmt.Print(qr)
+	return nil
+}
+
+type LockoutCmd struct {
+	Clear *ClearLockoutCmd `cmd:"" help:"clear failed sign in attempts"`
+}
+
+type ClearLockoutCmd struct {
+	PasswordFlags
+	Name string `arg:"" optional:"" help:"UID or account name of the caller to clear, or \"unknown\" for callers that couldn't be identified (default: all)"`
+}
+
+func (c *ClearLockoutCmd) Run() error {
+	cred, err := c.ReadCredentials()
+	if err != nil {
+		return err
+	}
+
+	if err = NewClient().ClearLockout(cred, c.Name); err != nil {
+		return err
+	}
+
+	fmt.Println("Lockout cleared")
+	return nil
+}
+
+type CodesCmd struct {
+	Generate *GenerateCodesCmd `cmd:"" help:"generate a batch of unlock codes and print a sheet of them"`
+	List     *ListCodesCmd     `cmd:"" help:"list batches of unlock codes"`
+	Revoke   *RevokeCodesCmd   `cmd:"" help:"revoke a batch of unlock codes"`
+}
+
+type GenerateCodesCmd struct {
+	PasswordFlags
+	Count  int    `default:"20" help:"number of codes to generate (at most 99)"`
+	Role   Role   `default:"coach" enum:"proctor,coach" help:"role of the codes: proctor (disable only) or coach (enable, disable, and grants)"`
+	Format string `default:"text" enum:"text,csv,html" help:"format of the sheet: text, csv, or html"`
+	Output string `short:"o" type:"path" help:"write the sheet to a file instead of stdout"`
+}
+
+func (c *GenerateCodesCmd) Run() error {
+	cred, err := c.ReadCredentials()
+	if err != nil {
+		return err
+	}
+
+	id, codes, err := generateUnlockCodes(c.Count)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Hashing %d codes...\n", len(codes))
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		if hashes[i], err = newHash(code); err != nil {
+			return err
+		}
+	}
+
+	if _, err = NewClient().ManageUnlockCodes(&unlockCodesRequest{
+		Username: cred.Username, Password: cred.Password, Code: cred.Code, Action: unlockActionGenerate, Batch: id, Role: c.Role, Hashes: hashes,
+	}); err != nil {
+		return err
+	}
+
+	out := os.Stdout
+	if c.Output != "" {
+		if out, err = os.OpenFile(c.Output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600); err != nil {
+			return fmt.Errorf("could not create sheet: %w", err)
+		}
+		defer out.Close()
+	}
+
+	batch := &UnlockBatch{ID: id, Role: c.Role, Created: time.Now()}
+	if err = writeUnlockSheet(out, c.Format, batch, codes); err != nil {
+		return fmt.Errorf("could not write sheet: %w", err)
+	}
+	fmt.Fprintln(os.Stderr, "Generated batch:", id)
+	return nil
+}
+
+type ListCodesCmd struct {
+	PasswordFlags
+	JSON bool `name:"json" help:"output JSON"`
+}
+
+func (c *ListCodesCmd) Run() error {
+	cred, err := c.ReadCredentials()
+	if err != nil {
+		return err
+	}
+
+	resp, err := NewClient().ManageUnlockCodes(&unlockCodesRequest{Username: cred.Username, Password: cred.Password, Code: cred.Code, Action: unlockActionList})
+	if err != nil {
+		return err
+	}
+
+	if c.JSON {
+		return printJSON(resp.Batches)
+	}
+	for _, b := range resp.Batches {
+		fmt.Printf("%s (%s): %d of %d used, generated %s\n", b.ID, b.Role, b.Used, b.Total, b.Created.Local().Format("2006-01-02 15:04"))
+	}
+	return nil
+}
+
+type RevokeCodesCmd struct {
+	PasswordFlags
+	Batch string `arg:"" help:"id of the batch to revoke"`
+}
+
+func (c *RevokeCodesCmd) Run() error {
+	cred, err := c.ReadCredentials()
+	if err != nil {
+		return err
+	}
+
+	if _, err = NewClient().ManageUnlockCodes(&unlockCodesRequest{
+		Username: cred.Username, Password: cred.Password, Code: cred.Code, Action: unlockActionRevoke, Batch: c.Batch,
+	}); err != nil {
+		return err
+	}
+
+	fmt.Println("Revoked batch:", c.Batch)
+	return nil
+}
+
+type UnlockCodeCmd struct {
+	Respond   *RespondUnlockCodeCmd `cmd:"" default:"withargs" help:"print the response to a remote unlock challenge"`
+	NewSecret *NewSecretCmd         `cmd:"" help:"generate a new remote unlock master secret"`
+	Setup     *SetupUnlockCodeCmd   `cmd:"" help:"set up remote unlock on this machine"`
+}
+
+type RespondUnlockCodeCmd struct {
+	SecretFile string `required:"" type:"existingfile" env:"NETCONTROL_UNLOCK_SECRET" help:"file containing the master secret"`
+	Challenge  string `arg:"" help:"challenge shown on the locked machine"`
+}
+
+func (c *RespondUnlockCodeCmd) Run() error {
+	master, err := readMasterSecret(c.SecretFile)
+	if err != nil {
+		return err
+	}
+
+	machine, _, ok := splitChallenge(c.Challenge)
+	if !ok {
+		return errors.New("invalid challenge")
+	}
+
+	fmt.Println("Response:", remoteResponse(deriveMachineKey(master, machine), c.Challenge))
+	return nil
+}
+
+type NewSecretCmd struct {
+	Output string `short:"o" required:"" type:"path" help:"file to write the master secret to"`
+}
+
+func (c *NewSecretCmd) Run() error {
+	secret, err := newMasterSecret()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(c.Output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("could not create secret file: %w", err)
+	}
+	defer f.Close()
+	if _, err = fmt.Fprintln(f, secret); err != nil {
+		return fmt.Errorf("could not write secret: %w", err)
+	}
+
+	fmt.Println("Master secret written to", c.Output)
+	return nil
+}
+
+type SetupUnlockCodeCmd struct {
+	PasswordFlags
+	SecretFile string `type:"existingfile" env:"NETCONTROL_UNLOCK_SECRET" help:"file containing the master secret"`
+	Disable    bool   `help:"disable remote unlock on this machine"`
+}
+
+func (c *SetupUnlockCodeCmd) Run() error {
+	if c.SecretFile == "" && !c.Disable {
+		return errors.New("--secret-file or --disable is required")
+	}
+
+	var master []byte
+	if !c.Disable {
+		var err error
+		if master, err = readMasterSecret(c.SecretFile); err != nil {
+			return err
+		}
+	}
+
+	cred, err := c.ReadCredentials()
+	if err != nil {
+		return err
+	}
+
+	if err = NewClient().SetupRemoteUnlock(cred, master); err != nil {
+		return err
+	}
+
+	if c.Disable {
+		fmt.Println("Remote unlock disabled")
+		return nil
+	}
+	fmt.Println("Remote unlock set up for", machineID())
+	return nil
+}
+
+type AuditCmd struct {
+	List   *ListAuditCmd   `cmd:"" help:"list audit records"`
+	Verify *VerifyAuditCmd `cmd:"" help:"check the audit log hasn't been truncated, edited, or reordered"`
+}
+
+type ListAuditCmd struct {
+	PasswordFlags
+	From    string `help:"only list records at or after this time, e.g. \"2026-03-14 09:00\""`
+	To      string `help:"only list records at or before this time"`
+	Name    string `name:"name" help:"only list records for this user (a glob, e.g. \"coach*\")"`
+	Action  string `help:"only list records for this action, e.g. enable, disable, grant, or manage"`
+	Event   string `help:"only list records of this event: auth, change, approval, reconcile, config, service, or exam"`
+	Outcome string `help:"only list records with this outcome, e.g. success, failure, denied, or locked-out"`
+	Exam    string `help:"only list records made during the exam with this ID"`
+	Limit   int    `help:"list at most this many records (default: all)"`
+	Format  string `default:"table" enum:"table,jsonl,csv" help:"output format: table, jsonl (JSON lines), or csv"`
+}
+
+func (c *ListAuditCmd) Run() error {
+	f := &auditFilter{User: c.Name, Action: c.Action, Event: c.Event, Outcome: c.Outcome, Exam: c.Exam}
+	var err error
+	if c.From != "" {
+		if f.From, err = parseTime(c.From); err != nil {
+			return err
+		}
+	}
+	if c.To != "" {
+		if f.To, err = parseTime(c.To); err != nil {
+			return err
+		}
+	}
+
+	cred, err := c.ReadCredentials()
+	if err != nil {
+		return err
+	}
+
+	records, err := fetchAudit(NewClient(), cred, f, c.Limit)
+	if err != nil {
+		return err
+	}
+
+	return writeAuditRecords(os.Stdout, c.Format, records)
+}
+
+// fetchAudit requests the audit records selected by f from the service, a page at a time, until limit records have
+// been read, or all records if limit is zero. If cred has a password or code, client is signed in while reading, so
+// each page doesn't need it again
+func fetchAudit(client *Client, cred credentials, f *auditFilter, limit int) ([]*AuditRecord, error) {
+	if cred.Password != "" || cred.Code != "" {
+		if _, err := client.Login(cred); err != nil {
+			return nil, err
+		}
+		defer client.Logout()
+		cred = credentials{}
+	}
+
+	records := make([]*AuditRecord, 0)
+	for {
+		f.Limit = maxAuditLimit
+		if limit > 0 && limit-len(records) < f.Limit {
+			f.Limit = limit - len(records)
+		}
+		page, err := client.Audit(cred, f)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, page.Records...)
+		if page.Next == 0 || (limit > 0 && len(records) >= limit) {
+			return records, nil
+		}
+		f.After = page.Next
+	}
+}
+
+type VerifyAuditCmd struct {
+	File string `type:"path" help:"audit log to check (default: the service's audit log)"`
+	Key  string `type:"path" help:"audit key the log is chained with (default: the service's audit key)"`
+}
+
+func (c *VerifyAuditCmd) Run() error {
+	path := c.File
+	if path == "" {
+		path = auditPath
+	}
+	keyPath := c.Key
+	if keyPath == "" {
+		keyPath = auditKeyPath
+	}
+
+	key, err := readAuditKey(keyPath)
+	if err != nil {
+		return err
+	}
+
+	summary, err := VerifyAudit(path, key)
+	if err != nil {
+		return err
+	}
+
+	if summary.Records == 0 {
+		fmt.Println("Audit log OK: no records")
+		return nil
+	}
+	fmt.Printf("Audit log OK: %d records from %s to %s\n", summary.Records,
+		summary.First.Local().Format("Jan 2 15:04:05"), summary.Last.Local().Format("Jan 2 15:04:05"))
+	return nil
+}
+
+type AttestCmd struct {
+	Create *CreateAttestCmd `cmd:"" default:"withargs" help:"create a signed statement of the network state during a window of time"`
+	Verify *VerifyAttestCmd `cmd:"" help:"check a signed statement against an exported public key"`
+	Key    *AttestKeyCmd    `cmd:"" help:"export the public key used to check statements"`
+}
+
+type CreateAttestCmd struct {
+	From   string `required:"" help:"start of the window, e.g. \"2026-03-14 09:00\""`
+	To     string `help:"end of the window (default: now)"`
+	File   string `type:"path" help:"audit log to read (default: the service's audit log)"`
+	Output string `short:"o" type:"path" help:"write the statement to a file instead of stdout"`
+}
+
+func (c *CreateAttestCmd) Run() error {
+	from, err := parseTime(c.From)
+	if err != nil {
+		return err
+	}
+	to := time.Now()
+	if c.To != "" {
+		if to, err = parseTime(c.To); err != nil {
+			return err
+		}
+	}
+
+	path := c.File
+	if path == "" {
+		path = auditPath
+	}
+
+	key, err := loadAttestKey(attestKeyPath)
+	if err != nil {
+		return err
+	}
+	auditKey, err := readAuditKey(auditKeyPath)
+	if err != nil {
+		return err
+	}
+
+	a, err := newAttestation(path, auditKey, from, to)
+	if err != nil {
+		return err
+	}
+
+	signed, err := signAttestation(a, key)
+	if err != nil {
+		return err
+	}
+
+	buf, err := json.MarshalIndent(signed, "", "    ")
+	if err != nil {
+		return fmt.Errorf("could not encode statement: %w", err)
+	}
+	buf = append(buf, '\n')
+
+	if c.Output == "" {
+		_, err = os.Stdout.Write(buf)
+		return err
+	}
+	if err = os.WriteFile(c.Output, buf, 0644); err != nil {
+		return fmt.Errorf("could not write statement: %w", err)
+	}
+	fmt.Fprintln(os.Stderr, "Statement written to", c.Output)
+	return nil
+}
+
+type VerifyAttestCmd struct {
+	Key  string `required:"" type:"existingfile" help:"public key exported with attest key"`
+	File string `arg:"" type:"existingfile" help:"signed statement to check"`
+}
+
+func (c *VerifyAttestCmd) Run() error {
+	pub, err := readAttestPublicKey(c.Key)
+	if err != nil {
+		return err
+	}
+
+	buf, err := os.ReadFile(c.File)
+	if err != nil {
+		return fmt.Errorf("could not read statement: %w", err)
+	}
+
+	a, err := VerifyAttestation(buf, pub)
+	if err != nil {
+		return err
+	}
+
+	const format = "Jan 2 15:04:05"
+	fmt.Println("Signature OK")
+	fmt.Println("Machine:", a.Machine)
+	fmt.Printf("Window: %s to %s\n", a.From.Local().Format(format), a.To.Local().Format(format))
+	for _, p := range a.Periods {
+		state := "Unlocked"
+		if p.Locked {
+			state = "Locked"
+		}
+		line := fmt.Sprintf("    %s to %s: %s", p.Start.Local().Format(format), p.End.Local().Format(format), state)
+		if p.User != "" {
+			line += " by " + p.User
+		}
+		if p.Reason != "" {
+			line += fmt.Sprintf(" (%s)", p.Reason)
+		}
+		fmt.Println(line)
+	}
+	fmt.Println("Total unlocked:", time.Duration(a.UnlockedSeconds)*time.Second)
+	fmt.Println("Events:", len(a.Events))
+	return nil
+}
+
+type AttestKeyCmd struct {
+	Output string `short:"o" type:"path" help:"write the public key to a file instead of stdout"`
+}
+
+func (c *AttestKeyCmd) Run() error {
+	key, err := loadAttestKey(attestKeyPath)
+	if err != nil {
+		return err
+	}
+
+	buf, err := encodeAttestPublicKey(key.Public().(ed25519.PublicKey))
+	if err != nil {
+		return err
+	}
+
+	if c.Output == "" {
+		_, err = os.Stdout.Write(buf)
+		return err
+	}
+	if err = os.WriteFile(c.Output, buf, 0644); err != nil {
+		return fmt.Errorf("could not write public key: %w", err)
+	}
+	fmt.Fprintln(os.Stderr, "Public key", keyFingerprint(key.Public().(ed25519.PublicKey)), "written to", c.Output)
+	return nil
+}
+
+type ReportCmd struct {
+	PasswordFlags
+	From     string `required:"" help:"start of the event, e.g. \"2026-03-14 09:00\""`
+	To       string `help:"end of the event (default: now)"`
+	Format   string `default:"html" enum:"html,text" help:"format of the report: html or text"`
+	Template string `type:"existingfile" help:"template to use instead of the built-in template"`
+	Output   string `short:"o" type:"path" help:"write the report to a file instead of stdout"`
+}
+
+func (c *ReportCmd) Run() error {
+	from, err := parseTime(c.From)
+	if err != nil {
+		return err
+	}
+	to := time.Now()
+	if c.To != "" {
+		if to, err = parseTime(c.To); err != nil {
+			return err
+		}
+	}
+	if !to.After(from) {
+		return errors.New("the end of the event must be after the start")
+	}
+
+	cred, err := c.ReadCredentials()
+	if err != nil {
+		return err
+	}
+
+	client := NewClient()
+	status, err := client.Status()
+	if err != nil {
+		return err
+	}
+
+	// records before the event are needed to know if the network was locked when it started
+	records, err := fetchAudit(client, cred, &auditFilter{To: to}, 0)
+	if err != nil {
+		return err
+	}
+
+	w := io.Writer(os.Stdout)
+	if c.Output != "" {
+		f, err := os.Create(c.Output)
+		if err != nil {
+			return fmt.Errorf("could not create report: %w", err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if err = writeReport(w, c.Format, c.Template, newReport(records, status, from, to)); err != nil {
+		return err
+	}
+	if c.Output != "" {
+		fmt.Fprintln(os.Stderr, "Report written to", c.Output)
+	}
+	return nil
+}
+
+type ExamCmd struct {
+	Start  *StartExamCmd  `cmd:"" help:"schedule an exam, disabling the network from its start until its end"`
+	End    *EndExamCmd    `cmd:"" help:"end the exam early and restore the network, or cancel it if it hasn't started"`
+	Status *StatusExamCmd `cmd:"" help:"show the scheduled or in progress exam"`
+}
+
+type StartExamCmd struct {
+	PasswordFlags
+	Name     string        `arg:"" help:"name of the exam, e.g. \"Regional Math 2026\""`
+	Start    string        `help:"when to disable the network, e.g. 9:00 or \"2026-03-14 09:00\" (default: now)"`
+	End      string        `help:"when to restore the network, e.g. 12:00 or \"2026-03-14 12:00\""`
+	Duration time.Duration `help:"restore the network after the given duration from the start, e.g. 3h, instead of --end"`
+	Notes    string        `help:"notes about the exam"`
+	Category string        `help:"category of the exam, from the configured reason categories"`
+	JSON     bool          `name:"json" help:"output JSON"`
+}
+
+func (c *StartExamCmd) Run() error {
+	if (c.End == "") == (c.Duration == 0) {
+		return errors.New("one of --end or --duration is required")
+	}
+
+	now := time.Now()
+	req := &examRequest{Action: examActionStart, Name: c.Name, Notes: c.Notes, Category: c.Category}
+	var err error
+	if c.Start != "" {
+		if req.Start, err = parseExamTime(c.Start, now); err != nil {
+			return err
+		}
+	}
+	if c.End != "" {
+		if req.End, err = parseExamTime(c.End, now); err != nil {
+			return err
+		}
+	} else {
+		start := req.Start
+		if start.IsZero() {
+			start = now
+		}
+		req.End = start.Add(c.Duration)
+	}
+
+	cred, err := c.ReadCredentials()
+	if err != nil {
+		return err
+	}
+	req.Username, req.Password, req.Code = cred.Username, cred.Password, cred.Code
+
+	resp, err := NewClient().Exam(req)
+	return printResult(resp, err, c.JSON)
+}
+
+type EndExamCmd struct {
+	PasswordFlags
+	ID   string `name:"id" help:"only end the exam with the given ID"`
+	JSON bool   `name:"json" help:"output JSON"`
+}
+
+func (c *EndExamCmd) Run() error {
+	cred, err := c.ReadCredentials()
+	if err != nil {
+		return err
+	}
+
+	resp, err := NewClient().Exam(&examRequest{
+		Username: cred.Username, Password: cred.Password, Code: cred.Code, Action: examActionEnd, ID: c.ID,
+	})
+	if err == nil && !c.JSON && resp.Pending == nil {
+		fmt.Println("Exam ended")
+	}
+	return printResult(resp, err, c.JSON)
+}
+
+type StatusExamCmd struct {
+	JSON bool `name:"json" help:"output JSON"`
+}
+
+func (c *StatusExamCmd) Run() error {
+	st, err := NewClient().Status()
+	if err != nil {
+		return err
+	}
+
+	if c.JSON {
+		return printJSON(st.Exam)
+	}
+
+	if st.Exam == nil {
+		fmt.Println("No exam is scheduled")
+		return nil
+	}
+	fmt.Println("Exam:", st.Exam)
+	if st.Exam.Started != nil {
+		fmt.Printf("Started at %s, ends in %s\n", st.Exam.Started.Local().Format("15:04"), st.Exam.Remaining().Round(time.Minute))
+	}
+	if st.Exam.Notes != "" {
+		fmt.Println("Notes:", st.Exam.Notes)
+	}
+	return nil
+}
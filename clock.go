@@ -0,0 +1,34 @@
+package main
+
+import "time"
+
+// timer is a scheduled function that can be stopped
+type timer interface {
+	Stop() bool
+}
+
+// clock tells the time and schedules functions
+type clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) timer
+}
+
+// systemClock is the real time
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) timer {
+	return time.AfterFunc(d, f)
+}
+
+// serviceClock is used for everything the service timestamps or expires, such as changes, grants, lockouts, exams,
+// and audit records. Tests replace it with a clock they control instead of sleeping
+var serviceClock clock = systemClock{}
+
+// until returns the time until t by serviceClock
+func until(t time.Time) time.Duration {
+	return t.Sub(serviceClock.Now())
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var configPath = filepath.Join(installPath, "config.json")
+
+// DefaultReconcileInterval is the default interval between polling reconciles
+const DefaultReconcileInterval = 30 * time.Second
+
+// Config is the service configuration
+type Config struct {
+	// Adapters selects the network adapters that are controlled. If nil, DefaultSelection is used
+	Adapters *Selection `json:"adapters,omitempty"`
+	// ReconcileInterval is the number of seconds between checks that locked adapters are still disabled. Adapter
+	// changes are also detected immediately when possible. If zero, DefaultReconcileInterval is used
+	ReconcileInterval int `json:"reconcile_interval,omitempty"`
+	// PasswordHash is the base64 encoded password hash. If empty, the hash embedded at build time is used
+	PasswordHash string `json:"password_hash,omitempty"`
+	// Users are named accounts with their own passwords and roles
+	Users []*User `json:"users,omitempty"`
+	// SharedPasswordRole is the role of the shared password. If empty, the shared password has the admin role until
+	// the first user is added, and can't be used after
+	SharedPasswordRole Role `json:"shared_password_role,omitempty"`
+	// LockoutThreshold is the number of failed authentication attempts for a user before it's locked out. If zero,
+	// DefaultLockoutThreshold is used
+	LockoutThreshold int `json:"lockout_threshold,omitempty"`
+	// LockoutDuration is the number of seconds a user is locked out for. If zero, DefaultLockoutDuration is used
+	LockoutDuration int `json:"lockout_duration,omitempty"`
+	// VerifyConcurrency is the maximum number of password hashes evaluated at once. Each evaluation uses 64 MB of
+	// memory. If zero, DefaultVerifyConcurrency is used
+	VerifyConcurrency int `json:"verify_concurrency,omitempty"`
+	// VerifyQueue is the maximum number of password hash evaluations waiting to start. Further requests are rejected
+	// until the queue has room. If zero, DefaultVerifyQueue is used
+	VerifyQueue int `json:"verify_queue,omitempty"`
+	// SessionDuration is the number of seconds a GUI sign in lasts. If zero, DefaultSessionDuration is used
+	SessionDuration int `json:"session_duration,omitempty"`
+	// TOTPSkew is the number of 30 second time steps before and after the current time that TOTP codes are accepted,
+	// allowing for clock drift. If zero, DefaultTOTPSkew is used. If negative, only the current code is accepted
+	TOTPSkew int `json:"totp_skew,omitempty"`
+	// UnlockBatches are batches of single-use unlock codes
+	UnlockBatches []*UnlockBatch `json:"unlock_batches,omitempty"`
+	// RemoteUnlockKey is the base64 encoded key derived for this machine from the remote unlock master secret. If
+	// empty, remote unlock is disabled
+	RemoteUnlockKey string `json:"remote_unlock_key,omitempty"`
+	// TwoPersonEnable requires enable requests to be approved by two different users, the second within
+	// ApprovalWindow seconds of the first
+	TwoPersonEnable bool `json:"two_person_enable,omitempty"`
+	// ApprovalWindow is the number of seconds a second user has to approve an enable request. If zero,
+	// DefaultApprovalWindow is used
+	ApprovalWindow int `json:"approval_window,omitempty"`
+	// RequireReason requires a reason for every network change, and a category if ReasonCategories is set
+	RequireReason bool `json:"require_reason,omitempty"`
+	// ReasonCategories are the categories a reason can be given, e.g. "Contest end" or "Technical issue"
+	ReasonCategories []string `json:"reason_categories,omitempty"`
+	// PeerRules allow or deny requests based on the identity of the process connecting to the service. The first
+	// matching rule is used, and requests are allowed if no rule matches
+	PeerRules []*PeerRule `json:"peer_rules,omitempty"`
+}
+
+// reconcileInterval returns the configured reconcile interval
+func (c *Config) reconcileInterval() time.Duration {
+	if c.ReconcileInterval <= 0 {
+		return DefaultReconcileInterval
+	}
+	return time.Duration(c.ReconcileInterval) * time.Second
+}
+
+// lockoutThreshold returns the configured lockout threshold
+func (c *Config) lockoutThreshold() int {
+	if c.LockoutThreshold <= 0 {
+		return DefaultLockoutThreshold
+	}
+	return c.LockoutThreshold
+}
+
+// lockoutDuration returns the configured lockout duration
+func (c *Config) lockoutDuration() time.Duration {
+	if c.LockoutDuration <= 0 {
+		return DefaultLockoutDuration
+	}
+	return time.Duration(c.LockoutDuration) * time.Second
+}
+
+// verifyConcurrency returns the configured verify concurrency
+func (c *Config) verifyConcurrency() int {
+	if c.VerifyConcurrency <= 0 {
+		return DefaultVerifyConcurrency
+	}
+	return c.VerifyConcurrency
+}
+
+// verifyQueue returns the configured verify queue size
+func (c *Config) verifyQueue() int {
+	if c.VerifyQueue <= 0 {
+		return DefaultVerifyQueue
+	}
+	return c.VerifyQueue
+}
+
+// sessionDuration returns the configured session duration
+func (c *Config) sessionDuration() time.Duration {
+	if c.SessionDuration <= 0 {
+		return DefaultSessionDuration
+	}
+	return time.Duration(c.SessionDuration) * time.Second
+}
+
+// approvalWindow returns the configured approval window
+func (c *Config) approvalWindow() time.Duration {
+	if c.ApprovalWindow <= 0 {
+		return DefaultApprovalWindow
+	}
+	return time.Duration(c.ApprovalWindow) * time.Second
+}
+
+// sharedPasswordRole returns the configured role of the shared password, or an empty role if it's disabled
+func (c *Config) sharedPasswordRole() Role {
+	if c.SharedPasswordRole != "" {
+		return c.SharedPasswordRole
+	}
+	if len(c.Users) == 0 {
+		return RoleAdmin
+	}
+	return ""
+}
+
+// hasAdmin returns true if the shared password or a user has the admin role
+func (c *Config) hasAdmin() bool {
+	if c.sharedPasswordRole() == RoleAdmin {
+		return true
+	}
+	for _, u := range c.Users {
+		if u.Role == RoleAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// totpSkew returns the configured TOTP skew
+func (c *Config) totpSkew() uint {
+	if c.TOTPSkew < 0 {
+		return 0
+	}
+	if c.TOTPSkew == 0 {
+		return DefaultTOTPSkew
+	}
+	return uint(c.TOTPSkew)
+}
+
+// migrateHashes replaces legacy password and unlock code hashes, which store the key itself and can be used to
+// authenticate, with hashes that store only a verifier. It returns true if any were replaced
+func (c *Config) migrateHashes() (bool, error) {
+	hashes := []*string{&c.PasswordHash}
+	for _, u := range c.Users {
+		hashes = append(hashes, &u.PasswordHash)
+	}
+	for _, b := range c.UnlockBatches {
+		for _, code := range b.Codes {
+			hashes = append(hashes, &code.Hash)
+		}
+	}
+
+	migrated := false
+	for _, h := range hashes {
+		if *h == "" {
+			continue
+		}
+		ok, err := migrateHash(h)
+		if err != nil {
+			return false, err
+		}
+		migrated = migrated || ok
+	}
+	return migrated, nil
+}
+
+// LoadConfig reads the Config at path. If path doesn't exist, the default Config is returned
+func LoadConfig(path string) (*Config, error) {
+	c := new(Config)
+
+	buf, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("could not read config: %w", err)
+	} else if err == nil {
+		if err = json.Unmarshal(buf, c); err != nil {
+			return nil, fmt.Errorf("could not decode config: %w", err)
+		}
+	}
+
+	if c.Adapters == nil {
+		c.Adapters = DefaultSelection
+	}
+	if err = c.Adapters.Validate(); err != nil {
+		return nil, fmt.Errorf("could not validate adapter selection: %w", err)
+	}
+
+	if c.PasswordHash != "" {
+		if _, err = parseHash(c.PasswordHash); err != nil {
+			return nil, fmt.Errorf("could not parse password hash: %w", err)
+		}
+	}
+
+	if c.SharedPasswordRole != "" {
+		if err = c.SharedPasswordRole.Validate(); err != nil {
+			return nil, fmt.Errorf("could not validate shared password role: %w", err)
+		}
+	}
+
+	for i, u := range c.Users {
+		if err = u.Validate(); err != nil {
+			return nil, fmt.Errorf("could not validate user: %w", err)
+		}
+		if findUser(c.Users[:i], u.Name) != nil {
+			return nil, fmt.Errorf("could not validate user: %w: duplicate user %s", errInvalidUser, u.Name)
+		}
+	}
+
+	if err = validateRemoteUnlockKey(c.RemoteUnlockKey); err != nil {
+		return nil, err
+	}
+
+	for i, b := range c.UnlockBatches {
+		if err = b.Validate(); err != nil {
+			return nil, fmt.Errorf("could not validate unlock codes: %w", err)
+		}
+		if findBatch(c.UnlockBatches[:i], b.ID) != nil {
+			return nil, fmt.Errorf("could not validate unlock codes: %w: duplicate batch %s", errInvalidBatch, b.ID)
+		}
+	}
+
+	for _, r := range c.PeerRules {
+		if err = r.Validate(); err != nil {
+			return nil, fmt.Errorf("could not validate peer rules: %w", err)
+		}
+	}
+
+	return c, nil
+}
+
+// Save writes the Config to path, restricting access to it with protectFile
+func (c *Config) Save(path string) error {
+	buf, err := json.MarshalIndent(c, "", "    ")
+	if err != nil {
+		return fmt.Errorf("could not encode config: %w", err)
+	}
+
+	if err = writeFileAtomic(path, buf, true); err != nil {
+		return fmt.Errorf("could not write config: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// users recorded for changes not made by a user
+const (
+	// sharedPasswordUser is recorded for changes authenticated by the shared password
+	sharedPasswordUser = "password"
+	// systemUser is recorded for changes made automatically by the service
+	systemUser = "system"
+)
+
+var (
+	errUnknownAdapter  = errors.New("unknown adapter")
+	errGrantReplaced   = errors.New("grant was replaced")
+	errInvalidDuration = errors.New("invalid duration")
+)
+
+// stepError is an error that occurred during a step of a status change
+type stepError struct {
+	Step string
+	Err  error
+}
+
+func (e *stepError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Step, e.Err)
+}
+
+func (e *stepError) Unwrap() error {
+	return e.Err
+}
+
+// statusChange is a requested change to network adapter statuses
+type statusChange struct {
+	// User is the user making the change
+	User string
+	// Approvers are the other users that approved the change, if it required more than one person
+	Approvers []string
+	// Reason and Category explain why the change was made
+	Reason   string
+	Category string
+	Enabled  bool
+	// Adapters limits the change to the named adapters. If empty, all selected adapters are changed
+	Adapters []string
+	// Force enables all selected adapters instead of restoring the snapshot
+	Force bool
+	// Duration temporarily enables the network, disabling it again once the Duration has passed
+	Duration time.Duration
+
+	// expire is set when the change is caused by the expiration of a grant. The change is only applied if expire is
+	// still the active grant
+	expire *Grant
+	// exam is set when the change starts or ends an exam. The change is only applied if exam is still scheduled, and
+	// not started if it starts it. exam is started or removed with the rest of the state once the adapters change
+	exam *Exam
+}
+
+// nextSnapshot returns the snapshot to save after disabling adapters. Disabling all adapters replaces the snapshot
+// with the adapters that are enabled, unless the network is already locked, so a second disable doesn't lose the
+// adapters to restore. Disabling named adapters only replaces their entries. s.mu must be held
+func (s *Server) nextSnapshot(adapters []*Adapter, all bool) *Snapshot {
+	if all && s.State.Locked && s.State.Snapshot != nil {
+		return s.State.Snapshot
+	}
+
+	snapshot := &Snapshot{Time: serviceClock.Now(), Adapters: make([]string, 0)}
+	if !all && s.State.Snapshot != nil {
+		snapshot.Time = s.State.Snapshot.Time
+		for _, name := range s.State.Snapshot.Adapters {
+			found := false
+			for _, a := range adapters {
+				if a.Name == name {
+					found = true
+					break
+				}
+			}
+			if !found {
+				snapshot.Adapters = append(snapshot.Adapters, name)
+			}
+		}
+	}
+	for _, a := range adapters {
+		if a.Enabled() {
+			snapshot.Adapters = append(snapshot.Adapters, a.Name)
+		}
+	}
+	return snapshot
+}
+
+// restoreSnapshot removes the adapters from the state snapshot, removing the snapshot once it's empty or all
+// adapters have been restored
+func (s *Server) restoreSnapshot(adapters []*Adapter, all bool) {
+	if s.State.Snapshot == nil {
+		return
+	}
+	if all {
+		s.State.Snapshot = nil
+		return
+	}
+	remaining := make([]string, 0, len(s.State.Snapshot.Adapters))
+	for _, name := range s.State.Snapshot.Adapters {
+		found := false
+		for _, a := range adapters {
+			if a.Name == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			remaining = append(remaining, name)
+		}
+	}
+	s.State.Snapshot.Adapters = remaining
+}
+
+// change applies c. Disabling adapters saves the enabled adapters to a snapshot, and enabling all adapters restores
+// the snapshot unless c.Force is set. The state is only updated once at least one adapter has changed, or there was
+// nothing to change
+func (s *Server) change(c *statusChange) (changed []*Adapter, err error) {
+	if c.Duration < 0 || (c.Duration > 0 && !c.Enabled) {
+		return nil, fmt.Errorf("%w: duration must be positive and can only be used to enable", errInvalidDuration)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if c.expire != nil && c.expire != s.State.Grant {
+		return nil, errGrantReplaced
+	}
+	if c.exam != nil && (c.exam != s.State.Exam || (!c.Enabled && c.exam.Started != nil)) {
+		return nil, errExamEnded
+	}
+
+	last := s.State.LastChange
+	defer func() { s.auditChange(c, changed, last, err) }()
+
+	// recover panics, because WMI seems to be pretty buggy
+	defer func() {
+		if r := recover(); r != nil {
+			err = &stepError{Step: "panic", Err: fmt.Errorf("panic: %v", r)}
+		}
+	}()
+
+	conn, err := s.NewBackend()
+	if err != nil {
+		return nil, &stepError{Step: "backend", Err: fmt.Errorf("could not create backend: %w", err)}
+	}
+	defer conn.Close()
+
+	adapters, err := s.Config.Adapters.List(conn)
+	if err != nil {
+		return nil, &stepError{Step: "List", Err: fmt.Errorf("could not list adapters: %w", err)}
+	}
+
+	if len(c.Adapters) > 0 {
+		if adapters, err = selectNamed(adapters, c.Adapters); err != nil {
+			return nil, err
+		}
+	}
+
+	wasLocked := s.State.Locked
+	var snapshot *Snapshot
+	if !c.Enabled {
+		snapshot = s.nextSnapshot(adapters, len(c.Adapters) == 0)
+	} else if s.State.Snapshot != nil && len(c.Adapters) == 0 && !c.Force {
+		restore := make([]*Adapter, 0, len(adapters))
+		for _, a := range adapters {
+			if s.State.Snapshot.Contains(a.Name) {
+				restore = append(restore, a)
+			}
+		}
+		adapters = restore
+	}
+
+	// continue updating state if only some adapters failed to change
+	changed, applyErr := applyStatus(conn, adapters, c.Enabled)
+	if applyErr != nil && len(changed) == 0 {
+		// leave the desired state and snapshot as they were, since nothing changed
+		s.Logger.Error().Err(applyErr).Str("user", c.User).Msg("could not set status")
+		return nil, &stepError{Step: "SetStatus", Err: fmt.Errorf("could not set status: %w", applyErr)}
+	}
+
+	if !c.Enabled {
+		s.State.Snapshot = snapshot
+	} else if s.State.Snapshot != nil {
+		s.restoreSnapshot(adapters, len(c.Adapters) == 0)
+	}
+
+	// update desired state
+	if len(c.Adapters) == 0 {
+		s.State.Locked = !c.Enabled
+		s.State.Allowed = nil
+	} else if s.State.Locked {
+		s.State.allow(adapters, c.Enabled)
+	}
+
+	// grants are replaced by new grants and canceled by changes to all adapters
+	if c.Enabled && c.Duration > 0 {
+		now := serviceClock.Now()
+		s.State.Grant = &Grant{Start: now, Expires: now.Add(c.Duration), Adapters: c.Adapters}
+	} else if len(c.Adapters) == 0 || c.expire != nil {
+		s.State.Grant = nil
+	}
+	s.scheduleGrant()
+
+	// the exam starts or ends with the change, so it's only saved once the adapters have changed
+	if c.exam != nil {
+		if c.Enabled {
+			s.State.Exam = nil
+		} else {
+			now := serviceClock.Now()
+			c.exam.Started, c.exam.WasLocked = &now, wasLocked
+		}
+		s.scheduleExam()
+	}
+
+	s.State.LastChange = c.record(changed)
+	if c.Enabled && s.State.Grant != nil {
+		s.State.LastChange.Expires = &s.State.Grant.Expires
+	}
+
+	if err = s.State.Save(statePath); err != nil {
+		return changed, &stepError{Step: "state", Err: err}
+	}
+
+	method := "Disabled"
+	if c.Enabled {
+		method = "Enabled"
+	}
+	event := s.Logger.Info()
+	if applyErr != nil {
+		event = s.Logger.Error().Err(applyErr)
+		var partialErr *partialError
+		if errors.As(applyErr, &partialErr) {
+			event = event.Interface("failed", partialErr.Failed)
+		}
+	}
+	event = event.Str("user", c.User)
+	if len(c.Approvers) > 0 {
+		event = event.Strs("approvers", c.Approvers)
+	}
+	if c.Reason != "" {
+		event = event.Str("reason", c.Reason)
+	}
+	if c.Category != "" {
+		event = event.Str("category", c.Category)
+	}
+	event = event.Strs("changed", adapterNames(changed)).Bool("force", c.Force).Bool("expired", c.expire != nil)
+	if s.State.Grant != nil {
+		event = event.Time("expires", s.State.Grant.Expires).Dur("remaining", s.State.Grant.Remaining())
+	}
+	event.Msg(fmt.Sprintf("interfaces set to %s", method))
+
+	if applyErr != nil {
+		return changed, &stepError{Step: "SetStatus", Err: fmt.Errorf("could not set status: %w", applyErr)}
+	}
+
+	return changed, nil
+}
+
+// record returns the Change recorded for c, which changed the adapters in changed
+func (c *statusChange) record(changed []*Adapter) *Change {
+	return &Change{
+		Time: serviceClock.Now(), User: c.User, Approvers: c.Approvers, Reason: c.Reason, Category: c.Category,
+		Enabled: c.Enabled, Adapters: c.Adapters, Changed: adapterNames(changed), Force: c.Force,
+	}
+}
+
+// auditChange records the result of applying c, which changed the adapters in changed. last is the last change before
+// c was applied. Any change to the adapters is recorded, even if a later step failed, so it isn't missing from
+// statements. s.mu must be held
+func (s *Server) auditChange(c *statusChange, changed []*Adapter, last *Change, err error) {
+	action := string(actionDisable)
+	if c.Enabled {
+		action = string(actionEnable)
+		if c.Duration > 0 {
+			action = string(actionGrant)
+		}
+	}
+
+	rec := &AuditRecord{Event: auditChange, Action: action, Outcome: auditSuccess, User: c.User, Adapters: c.Adapters}
+	if c.exam != nil {
+		rec.Exam = c.exam.ID
+	}
+	switch {
+	case err != nil && len(changed) > 0:
+		rec.Outcome, rec.Error = auditPartial, err.Error()
+	case err != nil:
+		rec.Outcome, rec.Error = auditFailure, err.Error()
+	}
+	if len(changed) > 0 || err == nil {
+		rec.Change = s.State.LastChange
+		if rec.Change == last {
+			// a later step failed before the change was recorded in the state
+			rec.Change = c.record(changed)
+		}
+	}
+
+	s.audit(rec)
+}
+
+// scheduleGrant schedules the active grant to expire, replacing any previously scheduled grant. s.mu must be held
+func (s *Server) scheduleGrant() {
+	if s.grantTimer != nil {
+		s.grantTimer.Stop()
+		s.grantTimer = nil
+	}
+
+	g := s.State.Grant
+	if g == nil {
+		return
+	}
+
+	s.grantTimer = serviceClock.AfterFunc(g.Remaining(), func() {
+		s.Logger.Info().Time("expires", g.Expires).Msg("grant expired")
+		if _, err := s.change(&statusChange{User: systemUser, Reason: "grant expired", Enabled: false, Adapters: g.Adapters, expire: g}); err != nil && !errors.Is(err, errGrantReplaced) {
+			s.Logger.Error().Err(err).Msg("could not disable network after grant expired")
+		}
+	})
+}
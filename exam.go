@@ -0,0 +1,437 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// examIDLen is the length of an exam ID
+const examIDLen = 8
+
+// examRetryInterval is how long until an exam's start or end is tried again after it fails
+const examRetryInterval = time.Minute
+
+var (
+	errInvalidExam = errors.New("invalid exam")
+	errExamEnded   = errors.New("exam has ended")
+)
+
+// Exam is a named exam session. The network is disabled when the exam starts, and restored to its state before the
+// exam when it ends
+type Exam struct {
+	// ID tags the audit records made while the exam is in progress
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Owner string `json:"owner"`
+	Notes string `json:"notes,omitempty"`
+	// Category is one of the configured reason categories, recorded with the exam's changes
+	Category string `json:"category,omitempty"`
+	// Start and End are the planned start and end of the exam
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// Started is set once the exam has started
+	Started *time.Time `json:"started,omitempty"`
+	// WasLocked is set if the network was locked when the exam started, so it's left locked when the exam ends
+	WasLocked bool `json:"was_locked,omitempty"`
+	// Approvers are the users that approved scheduling an exam that enables the network when it ends
+	Approvers []string `json:"approvers,omitempty"`
+}
+
+// Remaining returns the time remaining until the exam ends
+func (e *Exam) Remaining() time.Duration {
+	if r := until(e.End); r > 0 {
+		return r
+	}
+	return 0
+}
+
+// String returns a human readable description of the exam
+func (e *Exam) String() string {
+	state := "scheduled"
+	if e.Started != nil {
+		state = "in progress"
+	}
+	return fmt.Sprintf("%s (%s) %s, %s to %s, by %s", e.Name, e.ID, state,
+		e.Start.Local().Format("Jan 2 15:04"), e.End.Local().Format("Jan 2 15:04"), e.Owner)
+}
+
+// change returns the change that disables the network when e starts, or restores it when e ends. The end on schedule
+// is approved by the users that approved scheduling e
+func (e *Exam) change(user string, enabled bool) *statusChange {
+	reason := "exam started: "
+	if enabled {
+		reason = "exam ended: "
+	}
+	c := &statusChange{User: user, Reason: reason + e.Name, Category: e.Category, Enabled: enabled, exam: e}
+	if enabled && user == systemUser {
+		c.Approvers = e.Approvers
+	}
+	return c
+}
+
+// parseExamTime parses s as a time of day today, e.g. "9:00", or a time accepted by parseTime
+func parseExamTime(s string, now time.Time) (time.Time, error) {
+	if t, err := time.ParseInLocation("15:04", s, time.Local); err == nil {
+		y, m, d := now.Local().Date()
+		return time.Date(y, m, d, t.Hour(), t.Minute(), 0, 0, time.Local), nil
+	}
+	return parseTime(s)
+}
+
+// exam actions
+const (
+	// examActionStart schedules an exam, starting it immediately if its start has passed
+	examActionStart = "start"
+	// examActionEnd ends the exam early, or cancels it if it hasn't started
+	examActionEnd = "end"
+)
+
+type examRequest struct {
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Code     string `json:"code,omitempty"`
+	// Action is "start" or "end"
+	Action   string `json:"action"`
+	Name     string `json:"name,omitempty"`
+	Notes    string `json:"notes,omitempty"`
+	Category string `json:"category,omitempty"`
+	// Start is when the network is disabled. If zero or in the past, the exam starts immediately
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// ID limits ending to the exam with the given ID, so a stale request can't end a different exam
+	ID string `json:"id,omitempty"`
+}
+
+// newExam returns the exam requested by req, with its name, notes, and category checked against the configured
+// reason policy
+func (c *Config) newExam(req *examRequest, now time.Time) (*Exam, error) {
+	name, category, err := c.validateReason(req.Name, req.Category)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return nil, fmt.Errorf("%w: a name is required", errInvalidExam)
+	}
+	notes := strings.TrimSpace(req.Notes)
+	if utf8.RuneCountInString(notes) > maxReasonLen {
+		return nil, fmt.Errorf("%w: notes must be at most %d characters", errInvalidExam, maxReasonLen)
+	}
+
+	start := req.Start
+	if start.IsZero() || start.Before(now) {
+		start = now
+	}
+	if !req.End.After(start) {
+		return nil, fmt.Errorf("%w: the end must be after the start", errInvalidExam)
+	}
+
+	return &Exam{Name: name, Notes: notes, Category: category, Start: start, End: req.End}, nil
+}
+
+// createExam schedules e, failing if another exam is scheduled. The exam isn't started, even if its start has passed
+func (s *Server) createExam(e *Exam) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if other := s.State.Exam; other != nil {
+		return fmt.Errorf("%w: %s is already scheduled", errInvalidExam, other.Name)
+	}
+
+	s.State.Exam = e
+	if err := s.State.Save(statePath); err != nil {
+		s.State.Exam = nil
+		return &stepError{Step: "state", Err: err}
+	}
+	if e.Start.After(serviceClock.Now()) {
+		s.scheduleExam()
+	}
+
+	s.audit(&AuditRecord{Event: auditExam, Action: "create", Outcome: auditSuccess, User: e.Owner, Target: e.Name, Exam: e.ID})
+	s.Logger.Info().Str("exam", e.ID).Str("name", e.Name).Str("user", e.Owner).Time("start", e.Start).Time("end", e.End).Msg("exam scheduled")
+	return nil
+}
+
+// startExam disables the network with e's change, which marks e as started and schedules it to end
+func (s *Server) startExam(e *Exam, user string) ([]*Adapter, error) {
+	changed, err := s.change(e.change(user, false))
+
+	s.mu.Lock()
+	started := e.Started != nil
+	s.mu.Unlock()
+	if started {
+		s.audit(&AuditRecord{Event: auditExam, Action: "start", Outcome: auditSuccess, User: user, Target: e.Name, Exam: e.ID})
+		s.Logger.Info().Str("exam", e.ID).Str("name", e.Name).Str("user", user).Time("end", e.End).Msg("exam started")
+	}
+
+	return changed, err
+}
+
+// endExam removes c.exam and, if the exam had started and the network wasn't locked before it, enables the network
+// with c. If enabling fails, the exam is kept, so it can be ended again
+func (s *Server) endExam(c *statusChange) ([]*Adapter, error) {
+	e := c.exam
+
+	s.mu.Lock()
+	if s.State.Exam != e {
+		s.mu.Unlock()
+		return nil, errExamEnded
+	}
+	started, restore := e.Started != nil, e.Started != nil && !e.WasLocked
+	if !restore {
+		s.State.Exam = nil
+		if err := s.State.Save(statePath); err != nil {
+			s.State.Exam = e
+			s.mu.Unlock()
+			return nil, &stepError{Step: "state", Err: err}
+		}
+		s.scheduleExam()
+	}
+	s.mu.Unlock()
+
+	var changed []*Adapter
+	var err error
+	if restore {
+		changed, err = s.change(c)
+		s.mu.Lock()
+		ended := s.State.Exam != e
+		s.mu.Unlock()
+		if !ended {
+			return changed, err
+		}
+	}
+
+	action := "end"
+	if !started {
+		action = "cancel"
+	}
+	s.audit(&AuditRecord{Event: auditExam, Action: action, Outcome: auditSuccess, User: c.User, Target: e.Name, Exam: e.ID})
+	s.Logger.Info().Str("exam", e.ID).Str("name", e.Name).Str("user", c.User).Msg(fmt.Sprintf("exam %s", action))
+
+	return changed, err
+}
+
+// scheduleExam schedules the exam to start or end, replacing any previously scheduled exam. s.mu must be held
+func (s *Server) scheduleExam() {
+	if s.examTimer != nil {
+		s.examTimer.Stop()
+		s.examTimer = nil
+	}
+
+	e := s.State.Exam
+	if e == nil || e.Started == nil {
+		s.examID.Store("")
+	}
+	if e == nil {
+		return
+	}
+
+	d := until(e.Start)
+	if e.Started != nil {
+		s.examID.Store(e.ID)
+		d = e.Remaining()
+	}
+	s.examTimer = serviceClock.AfterFunc(d, func() { s.runExam(e) })
+}
+
+// runExam starts or ends e when it's scheduled to. If that fails without changing the exam, it's tried again after
+// examRetryInterval
+func (s *Server) runExam(e *Exam) {
+	s.mu.Lock()
+	started := e.Started != nil
+	s.mu.Unlock()
+
+	var err error
+	msg := "could not start exam"
+	switch {
+	case started:
+		_, err = s.endExam(e.change(systemUser, true))
+		msg = "could not restore network after exam ended"
+	// the service may have been stopped for the whole exam
+	case serviceClock.Now().Before(e.End):
+		_, err = s.startExam(e, systemUser)
+	default:
+		_, err = s.endExam(e.change(systemUser, true))
+	}
+	if err == nil || errors.Is(err, errExamEnded) {
+		return
+	}
+	s.Logger.Error().Err(err).Str("exam", e.ID).Dur("retry", examRetryInterval).Msg(msg)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.State.Exam == e && (e.Started != nil) == started {
+		s.examTimer = serviceClock.AfterFunc(examRetryInterval, func() { s.runExam(e) })
+	}
+}
+
+// activeExamID returns the ID of the exam in progress, or an empty string if there isn't one
+func (s *Server) activeExamID() string {
+	id, _ := s.examID.Load().(string)
+	return id
+}
+
+// ManageExam is an HTTP handler that schedules, starts, or ends an exam. Starting requires the disable and grant
+// actions, since the network is restored automatically when the exam ends. If the network isn't locked, the exam's
+// end will enable it, so starting also requires the enable action and is subject to the two-person rule. Ending early
+// requires the enable action and is subject to the two-person rule
+func (s *Server) ManageExam(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		s.Logger.Warn().Err(fmt.Errorf("invalid method: %s", r.Method)).Send()
+		return
+	}
+
+	req := new(examRequest)
+	body, ok := s.readRequest(w, r, req)
+	if !ok {
+		return
+	}
+
+	// validate the exam first, so single-use credentials aren't used up by an invalid request
+	var (
+		e        *Exam
+		err      error
+		actions  []action
+		unlocked bool
+	)
+	switch req.Action {
+	case examActionStart:
+		actions = []action{actionDisable, actionGrant}
+		s.mu.Lock()
+		e, err = s.Config.newExam(req, serviceClock.Now())
+		unlocked = !s.State.Locked
+		s.mu.Unlock()
+		if unlocked {
+			actions = append(actions, actionEnable)
+		}
+	case examActionEnd:
+		actions = []action{actionEnable}
+	default:
+		err = fmt.Errorf("invalid action: %q", req.Action)
+	}
+	if err != nil {
+		s.Logger.Warn().Err(err).Send()
+		s.writeResponse(w, http.StatusBadRequest, &response{Error: err.Error()})
+		return
+	}
+
+	acct := s.authorize(w, r, body, credentials{Username: req.Username, Password: req.Password, Code: req.Code}, actions...)
+	if acct == nil {
+		return
+	}
+
+	if req.Action == examActionStart {
+		s.startExamRequest(w, e, acct, unlocked)
+		return
+	}
+	s.endExamRequest(w, req.ID, acct)
+}
+
+// startExamRequest schedules e for acct, starting it if its start has passed, and writes the response. If unlocked,
+// e's end will enable the network, so it's checked against the two-person rule first
+func (s *Server) startExamRequest(w http.ResponseWriter, e *Exam, acct *account, unlocked bool) {
+	if unlocked {
+		c := e.change(acct.Name, true)
+		if pending, ok, err := s.approve(acct, c); err != nil {
+			s.writeResponse(w, http.StatusForbidden, &response{Error: err.Error()})
+			return
+		} else if !ok {
+			s.writeResponse(w, http.StatusAccepted, &response{Pending: pending})
+			return
+		}
+		e.Approvers = c.Approvers
+	}
+
+	id, err := randomString(examIDLen)
+	if err != nil {
+		s.Logger.Error().Err(err).Send()
+		s.writeResponse(w, http.StatusInternalServerError, &response{Error: "Error (id): Please try again later"})
+		return
+	}
+	e.ID, e.Owner = id, acct.Name
+
+	if err = s.createExam(e); err != nil {
+		s.writeChangeError(w, nil, err)
+		return
+	}
+
+	var changed []*Adapter
+	if !e.Start.After(serviceClock.Now()) {
+		if changed, err = s.startExam(e, acct.Name); err != nil {
+			// an exam that couldn't be started isn't left scheduled without a timer to start it
+			s.mu.Lock()
+			started := e.Started != nil
+			s.mu.Unlock()
+			if !started {
+				if _, cancelErr := s.endExam(e.change(acct.Name, true)); cancelErr != nil && !errors.Is(cancelErr, errExamEnded) {
+					s.Logger.Error().Err(cancelErr).Str("exam", e.ID).Msg("could not cancel exam that couldn't be started")
+				}
+			}
+			s.writeChangeError(w, changed, err)
+			return
+		}
+	}
+
+	s.mu.Lock()
+	exam := *e
+	s.mu.Unlock()
+	s.writeResponse(w, http.StatusOK, &response{Changed: adapterNames(changed), Exam: &exam})
+}
+
+// endExamRequest ends the exam for acct and writes the response. If id is set, it must match the exam
+func (s *Server) endExamRequest(w http.ResponseWriter, id string, acct *account) {
+	s.mu.Lock()
+	e := s.State.Exam
+	var restore bool
+	if e != nil {
+		restore = e.Started != nil && !e.WasLocked
+	}
+	s.mu.Unlock()
+
+	if e == nil || (id != "" && !strings.EqualFold(id, e.ID)) {
+		err := fmt.Errorf("%w: no exam is scheduled", errInvalidExam)
+		if id != "" {
+			err = fmt.Errorf("%w: %s isn't scheduled", errInvalidExam, id)
+		}
+		s.Logger.Warn().Err(err).Send()
+		s.writeResponse(w, http.StatusBadRequest, &response{Error: err.Error()})
+		return
+	}
+
+	c := e.change(acct.Name, true)
+	if restore {
+		if pending, ok, err := s.approve(acct, c); err != nil {
+			s.writeResponse(w, http.StatusForbidden, &response{Error: err.Error()})
+			return
+		} else if !ok {
+			s.writeResponse(w, http.StatusAccepted, &response{Pending: pending})
+			return
+		}
+	}
+
+	changed, err := s.endExam(c)
+	if err != nil {
+		s.writeChangeError(w, changed, err)
+		return
+	}
+
+	s.writeResponse(w, http.StatusOK, &response{Changed: adapterNames(changed)})
+}
+
+// Exam sends an exam request, authenticating with a challenge-response proof of req.Password or req.Code. If ending
+// the exam is waiting for a second user to approve it, the response's Pending is set
+func (c *Client) Exam(req *examRequest) (*response, error) {
+	body := *req
+	body.Password, body.Code = "", ""
+	resp, err := c.post("/exam", credentials{Username: req.Username, Password: req.Password, Code: req.Code}, &body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return decodeResponse(resp)
+}
@@ -1,7 +1,9 @@
 package hash
 
 import (
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/subtle"
 	"encoding/binary"
 	"errors"
@@ -13,28 +15,52 @@ import (
 // hash errors
 var (
 	ErrInvalidHashLength = errors.New("invalid hash length")
+	ErrInvalidVersion    = errors.New("invalid hash version")
 	ErrInvalidPassword   = errors.New("invalid password")
+	ErrInvalidProof      = errors.New("invalid proof")
 )
 
 const (
+	// version is the first byte of a marshaled Hash. Legacy hashes have no version and store the key itself
+	version       = 1
 	saltLen       = 16
 	keyLen        = 32
-	timeOffset    = saltLen
+	saltOffset    = 1
+	timeOffset    = saltOffset + saltLen
 	memoryOffset  = timeOffset + 4
 	threadsOffset = memoryOffset + 4
 	hashOffset    = threadsOffset + 1
 
 	// HashLen is the length of a marshaled Hash
 	HashLen = hashOffset + keyLen
+	// LegacyHashLen is the length of a marshaled legacy Hash
+	LegacyHashLen = HashLen - saltOffset
+	// SaltLen is the length of a Hash's salt
+	SaltLen = saltLen
 )
 
-// Hash represents an argon2id key with all of its parameters
+// Hash represents an argon2id key with all of its parameters. Only a verifier of the key is stored, so the Hash can't
+// be used to create proofs: the verifier is the SHA-256 hash of the client key, the HMAC of "Client Key" with the
+// argon2id key, as in SCRAM (RFC 5802)
 type Hash struct {
-	salt    [saltLen]byte
-	time    uint32
-	memory  uint32
-	threads uint8
-	hash    [keyLen]byte
+	salt     [saltLen]byte
+	time     uint32
+	memory   uint32
+	threads  uint8
+	verifier [keyLen]byte
+	legacy   bool
+}
+
+// clientKey returns the client key for key
+func clientKey(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("Client Key"))
+	return mac.Sum(nil)
+}
+
+// verifier returns the verifier for key
+func verifier(key []byte) [keyLen]byte {
+	return sha256.Sum256(clientKey(key))
 }
 
 // New returns a new Hash with the given password and parameters
@@ -44,49 +70,114 @@ func New(password []byte, time, memory uint32, threads uint8) (*Hash, error) {
 		return nil, fmt.Errorf("could not generate salt")
 	}
 
-	hash := argon2.IDKey(password, salt, time, memory, threads, keyLen)
+	key := argon2.IDKey(password, salt, time, memory, threads, keyLen)
 
 	var s [saltLen]byte
 	copy(s[:], salt)
 
-	var h [keyLen]byte
-	copy(h[:], hash)
-
-	return &Hash{salt: s, time: time, memory: memory, threads: threads, hash: h}, nil
+	return &Hash{salt: s, time: time, memory: memory, threads: threads, verifier: verifier(key)}, nil
 }
 
-// MarshalBinary encodes h into binary form and returns the result
+// MarshalBinary encodes h into binary form and returns the result. Legacy hashes are encoded in the current form
 func (h *Hash) MarshalBinary() ([]byte, error) {
 	hash := make([]byte, HashLen)
-	copy(hash, h.salt[:])
+	hash[0] = version
+	copy(hash[saltOffset:], h.salt[:])
 	binary.BigEndian.PutUint32(hash[timeOffset:], h.time)
 	binary.BigEndian.PutUint32(hash[memoryOffset:], h.memory)
 	hash[threadsOffset] = h.threads
-	copy(hash[hashOffset:], h.hash[:])
+	copy(hash[hashOffset:], h.verifier[:])
 	return hash, nil
 }
 
-// UnmarshalBinary decodes data into h
+// UnmarshalBinary decodes data into h. Legacy hashes, which store the key instead of its verifier, are converted
 func (h *Hash) UnmarshalBinary(data []byte) error {
+	h.legacy = len(data) == LegacyHashLen
+	if h.legacy {
+		// legacy hashes are the current form without the version
+		data = append([]byte{version}, data...)
+	}
 	if len(data) != HashLen {
 		return ErrInvalidHashLength
 	}
-	copy(h.salt[:], data[:saltLen])
+	if data[0] != version {
+		return ErrInvalidVersion
+	}
+	copy(h.salt[:], data[saltOffset:timeOffset])
 	h.time = binary.BigEndian.Uint32(data[timeOffset:memoryOffset])
 	h.memory = binary.BigEndian.Uint32(data[memoryOffset:threadsOffset])
 	h.threads = data[threadsOffset]
-	copy(h.hash[:], data[hashOffset:])
+	if h.legacy {
+		h.verifier = verifier(data[hashOffset:])
+	} else {
+		copy(h.verifier[:], data[hashOffset:])
+	}
 	return nil
 }
 
+// Legacy returns true if h was unmarshaled from a legacy hash, and should be marshaled again to replace it
+func (h *Hash) Legacy() bool {
+	return h.legacy
+}
+
 // Validate returns an error if the password cannot be validated against the Hash
 func (h *Hash) Validate(password []byte) error {
-	hash2 := argon2.IDKey(password, h.salt[:], h.time, h.memory, h.threads, keyLen)
-	if subtle.ConstantTimeEq(int32(len(h.hash)), int32(len(hash2))) != 1 {
+	v := verifier(argon2.IDKey(password, h.salt[:], h.time, h.memory, h.threads, keyLen))
+	if subtle.ConstantTimeCompare(h.verifier[:], v[:]) != 1 {
 		return ErrInvalidPassword
 	}
-	if subtle.ConstantTimeCompare(h.hash[:], hash2) != 1 {
-		return ErrInvalidPassword
+	return nil
+}
+
+// Params are the parameters used to derive a Hash's key from a password
+type Params struct {
+	Salt    []byte `json:"salt"`
+	Time    uint32 `json:"time"`
+	Memory  uint32 `json:"memory"`
+	Threads uint8  `json:"threads"`
+}
+
+// Params returns the parameters used to derive h's key from a password
+func (h *Hash) Params() *Params {
+	return &Params{Salt: append([]byte(nil), h.salt[:]...), Time: h.time, Memory: h.memory, Threads: h.threads}
+}
+
+// Key derives the key for password with p. The verifier of the correct password's key is the Hash's verifier
+func (p *Params) Key(password []byte) []byte {
+	return argon2.IDKey(password, p.Salt, p.Time, p.Memory, p.Threads, keyLen)
+}
+
+// signature returns the HMAC of msg with verifier
+func signature(verifier, msg []byte) []byte {
+	mac := hmac.New(sha256.New, verifier)
+	mac.Write(msg)
+	return mac.Sum(nil)
+}
+
+// Proof returns a proof of knowledge of key for msg: the client key XORed with the signature of msg by the key's
+// verifier. The verifier can recover the client key from the proof and check it, but can't create a proof itself
+func Proof(key, msg []byte) []byte {
+	ck := clientKey(key)
+	v := sha256.Sum256(ck)
+	sig := signature(v[:], msg)
+	for i := range sig {
+		sig[i] ^= ck[i]
+	}
+	return sig
+}
+
+// ValidateProof returns an error if proof wasn't created by Proof with the key h verifies and msg
+func (h *Hash) ValidateProof(msg, proof []byte) error {
+	if len(proof) != keyLen {
+		return ErrInvalidProof
+	}
+	ck := signature(h.verifier[:], msg)
+	for i := range ck {
+		ck[i] ^= proof[i]
+	}
+	v := sha256.Sum256(ck)
+	if subtle.ConstantTimeCompare(h.verifier[:], v[:]) != 1 {
+		return ErrInvalidProof
 	}
 	return nil
 }
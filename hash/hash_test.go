@@ -39,7 +39,7 @@ func TestHash(t *testing.T) {
 	}
 
 	h2 := new(hash.Hash)
-	if err = h2.UnmarshalBinary(hBytes[1:]); err == nil {
+	if err = h2.UnmarshalBinary(hBytes[2:]); err == nil {
 		t.Fatalf(`invalid hash length: want: "invalid hash length", have: %v`, err)
 	}
 
@@ -66,3 +66,92 @@ func TestHash(t *testing.T) {
 
 	fmt.Printf("%s: %#v\n", pass, base64.StdEncoding.EncodeToString(hBytes))
 }
+
+func TestProof(t *testing.T) {
+	h, err := hash.New([]byte("password"), 1, 8*1024, 1)
+	if err != nil {
+		t.Fatalf("create hash error: want: nil, have: %v", err)
+	}
+
+	msg := []byte("message")
+	if err = h.ValidateProof(msg, hash.Proof(h.Params().Key([]byte("password")), msg)); err != nil {
+		t.Errorf("validate proof error: want: nil, have: %v", err)
+	}
+
+	if err = h.ValidateProof(msg, hash.Proof(h.Params().Key([]byte("bad")), msg)); !errors.Is(err, hash.ErrInvalidProof) {
+		t.Errorf("invalid password proof error: want: %v, have: %v", hash.ErrInvalidProof, err)
+	}
+
+	if err = h.ValidateProof([]byte("other"), hash.Proof(h.Params().Key([]byte("password")), msg)); !errors.Is(err, hash.ErrInvalidProof) {
+		t.Errorf("other message proof error: want: %v, have: %v", hash.ErrInvalidProof, err)
+	}
+}
+
+func TestProofVerifier(t *testing.T) {
+	h, err := hash.New([]byte("password"), 1, 8*1024, 1)
+	if err != nil {
+		t.Fatalf("create hash error: want: nil, have: %v", err)
+	}
+	buf, err := h.MarshalBinary()
+	if err != nil {
+		t.Fatalf("marshal hash error: want: nil, have: %v", err)
+	}
+
+	// the stored hash alone can't create a proof
+	msg := []byte("message")
+	if err = h.ValidateProof(msg, hash.Proof(buf[len(buf)-32:], msg)); !errors.Is(err, hash.ErrInvalidProof) {
+		t.Errorf("stored hash proof error: want: %v, have: %v", hash.ErrInvalidProof, err)
+	}
+	if err = h.ValidateProof(msg, []byte("short")); !errors.Is(err, hash.ErrInvalidProof) {
+		t.Errorf("short proof error: want: %v, have: %v", hash.ErrInvalidProof, err)
+	}
+}
+
+func TestLegacyHash(t *testing.T) {
+	h, err := hash.New([]byte("password"), 1, 8*1024, 1)
+	if err != nil {
+		t.Fatalf("create hash error: want: nil, have: %v", err)
+	}
+	buf, err := h.MarshalBinary()
+	if err != nil {
+		t.Fatalf("marshal hash error: want: nil, have: %v", err)
+	}
+	if h.Legacy() {
+		t.Errorf("new hash legacy: want: false, have: true")
+	}
+
+	// legacy hashes have no version and store the key
+	key := h.Params().Key([]byte("password"))
+	legacy := append(append([]byte(nil), buf[1:len(buf)-32]...), key...)
+	if len(legacy) != hash.LegacyHashLen {
+		t.Fatalf("legacy hash length: want: %d, have: %d", hash.LegacyHashLen, len(legacy))
+	}
+
+	h2 := new(hash.Hash)
+	if err = h2.UnmarshalBinary(legacy); err != nil {
+		t.Fatalf("unmarshal legacy hash error: want: nil, have: %v", err)
+	}
+	if !h2.Legacy() {
+		t.Errorf("legacy: want: true, have: false")
+	}
+	if err = h2.Validate([]byte("password")); err != nil {
+		t.Errorf("legacy validate error: want: nil, have: %v", err)
+	}
+	msg := []byte("message")
+	if err = h2.ValidateProof(msg, hash.Proof(key, msg)); err != nil {
+		t.Errorf("legacy validate proof error: want: nil, have: %v", err)
+	}
+
+	h2Bytes, err := h2.MarshalBinary()
+	if err != nil {
+		t.Fatalf("marshal hash error: want: nil, have: %v", err)
+	}
+	if !bytes.Equal(buf, h2Bytes) {
+		t.Errorf("migrated hash: want: %s, have: %s", base64.StdEncoding.EncodeToString(buf), base64.StdEncoding.EncodeToString(h2Bytes))
+	}
+
+	buf[0] = 2
+	if err = h2.UnmarshalBinary(buf); !errors.Is(err, hash.ErrInvalidVersion) {
+		t.Errorf("unknown version error: want: %v, have: %v", hash.ErrInvalidVersion, err)
+	}
+}
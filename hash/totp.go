@@ -0,0 +1,158 @@
+package hash
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// TOTP errors
+var (
+	ErrInvalidSecret = errors.New("invalid secret")
+	ErrInvalidCode   = errors.New("invalid code")
+)
+
+// RFC 6238 parameters supported by common authenticator apps
+const (
+	totpSecretLen = 20
+	totpDigits    = 6
+	// TOTPPeriod is the time each TOTP code is valid for
+	TOTPPeriod = 30 * time.Second
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTP is an RFC 6238 time-based one-time password secret, using HMAC-SHA1 and 6 digit codes that change every 30
+// seconds
+type TOTP struct {
+	secret []byte
+}
+
+// NewTOTP returns a new TOTP with a random secret
+func NewTOTP() (*TOTP, error) {
+	secret := make([]byte, totpSecretLen)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("could not generate secret")
+	}
+	return &TOTP{secret: secret}, nil
+}
+
+// ParseTOTP returns the TOTP for the base32 encoded secret
+func ParseTOTP(secret string) (*TOTP, error) {
+	buf, err := totpEncoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil || len(buf) == 0 {
+		return nil, ErrInvalidSecret
+	}
+	return &TOTP{secret: buf}, nil
+}
+
+// Secret returns the base32 encoded secret
+func (t *TOTP) Secret() string {
+	return totpEncoding.EncodeToString(t.secret)
+}
+
+// Counter returns the time step at
+func (t *TOTP) Counter(at time.Time) uint64 {
+	return uint64(at.Unix()) / uint64(TOTPPeriod/time.Second)
+}
+
+// code returns the code for counter
+func (t *TOTP) code(counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, t.secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// Code returns the code at
+func (t *TOTP) Code(at time.Time) string {
+	return t.code(t.Counter(at))
+}
+
+// counters returns the counters within skew time steps of at
+func (t *TOTP) counters(at time.Time, skew uint) []uint64 {
+	now := t.Counter(at)
+	counters := make([]uint64, 0, 2*skew+1)
+	for c := now - uint64(skew); c <= now+uint64(skew); c++ {
+		counters = append(counters, c)
+	}
+	return counters
+}
+
+// Validate returns the counter of code if it's valid within skew time steps of at, or an error otherwise. Callers
+// should reject codes with counters that were already used to prevent replays
+func (t *TOTP) Validate(code string, at time.Time, skew uint) (uint64, error) {
+	var matched uint64
+	found := 0
+	for _, c := range t.counters(at, skew) {
+		if subtle.ConstantTimeCompare([]byte(t.code(c)), []byte(code)) == 1 {
+			matched, found = c, 1
+		}
+	}
+	if found == 0 {
+		return 0, ErrInvalidCode
+	}
+	return matched, nil
+}
+
+// ValidateProof returns the counter of the code proof was created with by Proof, using the key derived from the code
+// with p, if it's valid within skew time steps of at, or an error otherwise. A code has too little entropy to be the
+// key itself, since a captured proof could be checked against every code offline in moments
+func (t *TOTP) ValidateProof(msg, proof []byte, p *Params, at time.Time, skew uint) (uint64, error) {
+	var matched uint64
+	found := false
+	for _, c := range t.counters(at, skew) {
+		if hmac.Equal(Proof(p.Key([]byte(t.code(c))), msg), proof) {
+			matched, found = c, true
+		}
+	}
+	if !found {
+		return 0, ErrInvalidProof
+	}
+	return matched, nil
+}
+
+// URI returns the otpauth:// provisioning URI for account, used to add the secret to an authenticator app
+func (t *TOTP) URI(issuer, account string) string {
+	v := url.Values{}
+	v.Set("secret", t.Secret())
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(int(TOTPPeriod/time.Second)))
+	u := url.URL{Scheme: "otpauth", Host: "totp", Path: "/" + issuer + ":" + account, RawQuery: v.Encode()}
+	return u.String()
+}
+
+// QRPNG returns a PNG QR code of the provisioning URI for account, size pixels wide
+func (t *TOTP) QRPNG(issuer, account string, size int) ([]byte, error) {
+	png, err := qrcode.Encode(t.URI(issuer, account), qrcode.Medium, size)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode QR code: %w", err)
+	}
+	return png, nil
+}
+
+// QRString returns a QR code of the provisioning URI for account that can be printed to a terminal
+func (t *TOTP) QRString(issuer, account string) (string, error) {
+	q, err := qrcode.New(t.URI(issuer, account), qrcode.Medium)
+	if err != nil {
+		return "", fmt.Errorf("could not encode QR code: %w", err)
+	}
+	return q.ToSmallString(false), nil
+}
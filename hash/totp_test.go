@@ -0,0 +1,80 @@
+package hash_test
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/korylprince/go-win-netcontrol/hash"
+)
+
+func TestTOTP(t *testing.T) {
+	// RFC 6238 test secret
+	totp, err := hash.ParseTOTP("GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ")
+	if err != nil {
+		t.Fatalf("parse secret error: want: nil, have: %v", err)
+	}
+
+	for _, test := range []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	} {
+		if code := totp.Code(time.Unix(test.unix, 0)); code != test.code {
+			t.Errorf("code at %d: want: %s, have: %s", test.unix, test.code, code)
+		}
+	}
+
+	now := time.Unix(1111111109, 0)
+	counter, err := totp.Validate("081804", now.Add(hash.TOTPPeriod), 1)
+	if err != nil || counter != totp.Counter(now) {
+		t.Errorf("validate with skew: want: %d, nil, have: %d, %v", totp.Counter(now), counter, err)
+	}
+	if _, err = totp.Validate("081804", now.Add(2*hash.TOTPPeriod), 1); !errors.Is(err, hash.ErrInvalidCode) {
+		t.Errorf("validate outside skew error: want: %v, have: %v", hash.ErrInvalidCode, err)
+	}
+
+	msg := []byte("message")
+	p := &hash.Params{Salt: make([]byte, hash.SaltLen), Time: 1, Memory: 8 * 1024, Threads: 1}
+	if counter, err = totp.ValidateProof(msg, hash.Proof(p.Key([]byte("081804")), msg), p, now, 1); err != nil || counter != totp.Counter(now) {
+		t.Errorf("validate proof: want: %d, nil, have: %d, %v", totp.Counter(now), counter, err)
+	}
+	if _, err = totp.ValidateProof(msg, hash.Proof(p.Key([]byte("000000")), msg), p, now, 1); !errors.Is(err, hash.ErrInvalidProof) {
+		t.Errorf("invalid proof error: want: %v, have: %v", hash.ErrInvalidProof, err)
+	}
+	// the code itself isn't the key
+	if _, err = totp.ValidateProof(msg, hash.Proof([]byte("081804"), msg), p, now, 1); !errors.Is(err, hash.ErrInvalidProof) {
+		t.Errorf("code key proof error: want: %v, have: %v", hash.ErrInvalidProof, err)
+	}
+
+	u, err := url.Parse(totp.URI("Network Control", "coach"))
+	if err != nil {
+		t.Fatalf("parse URI error: want: nil, have: %v", err)
+	}
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/Network Control:coach" || u.Query().Get("secret") != totp.Secret() {
+		t.Errorf("URI: want: otpauth://totp/Network%%20Control:coach?secret=%s, have: %s", totp.Secret(), u)
+	}
+
+	if qr, err := totp.QRString("Network Control", "coach"); err != nil || !strings.Contains(qr, "█") {
+		t.Errorf("QR code: want: QR code, have: %q, %v", qr, err)
+	}
+
+	if _, err = hash.ParseTOTP("not base32!"); !errors.Is(err, hash.ErrInvalidSecret) {
+		t.Errorf("invalid secret error: want: %v, have: %v", hash.ErrInvalidSecret, err)
+	}
+
+	random, err := hash.NewTOTP()
+	if err != nil {
+		t.Fatalf("create TOTP error: want: nil, have: %v", err)
+	}
+	parsed, err := hash.ParseTOTP(random.Secret())
+	if err != nil || parsed.Code(now) != random.Code(now) {
+		t.Errorf("parsed secret: want: same codes, have: %v", err)
+	}
+}
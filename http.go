@@ -1,42 +1,167 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/hectane/go-acl"
+	"github.com/korylprince/go-win-netcontrol/hash"
 	"github.com/rs/zerolog"
 )
 
-var sockPath = filepath.Join(ServiceConfig.InstallPath, "control.sock")
+var sockPath = filepath.Join(installPath, "control.sock")
 
-var errUnauthorized = errors.New("unauthorized")
+var (
+	errUnauthorized = errors.New("unauthorized")
+	errServiceDown  = errors.New("service is not running")
+)
 
 type request struct {
+	// Username is the user to authenticate as. If empty, the shared password is used
+	Username string `json:"username,omitempty"`
 	Password string `json:"string"`
-	Enabled  bool   `json:"enabled"`
+	// Code is a TOTP code, used instead of Password if set
+	Code string `json:"code,omitempty"`
+	// UnlockCode is a single-use unlock code, used instead of the other credentials if set. It's sent as is, since it
+	// can't be used again
+	UnlockCode string `json:"unlock_code,omitempty"`
+	// RemoteUnlock is a remote unlock challenge and response, used instead of the other credentials if set
+	RemoteUnlock *remoteUnlock `json:"remote_unlock,omitempty"`
+	Enabled      bool          `json:"enabled"`
+	// Adapters limits the request to the named adapters. If empty, all selected adapters are changed
+	Adapters []string `json:"adapters,omitempty"`
+	// Force enables all selected adapters instead of restoring the adapters that were enabled before disabling
+	Force bool `json:"force,omitempty"`
+	// Duration is the number of seconds to enable the network for. If zero, the network stays enabled
+	Duration int `json:"duration,omitempty"`
+	// Reason explains why the change is made. It's required if the config requires it
+	Reason string `json:"reason,omitempty"`
+	// Category is one of the configured reason categories
+	Category string `json:"category,omitempty"`
 }
 
 type response struct {
 	Error string `json:"error"`
+	// Changed are the adapters that were changed
+	Changed []string `json:"changed,omitempty"`
+	// Failed maps adapters that couldn't be changed to errors
+	Failed map[string]string `json:"failed,omitempty"`
+	// Grant is the active grant, if any
+	Grant *Grant `json:"grant,omitempty"`
+	// Pending is set if the request is waiting for a second user to approve it
+	Pending *Approval `json:"pending,omitempty"`
+	// Exam is the exam that was scheduled or started
+	Exam *Exam `json:"exam,omitempty"`
 }
 
 // Server runs in an elevated Windows service to make network inferface changes
 type Server struct {
-	Logger   zerolog.Logger
-	listener net.Listener
-	server   *http.Server
+	Logger zerolog.Logger
+	Config *Config
+	State  *State
+	// NewBackend returns a Backend for each request
+	NewBackend func() (Backend, error)
+	listener   net.Listener
+	server     *http.Server
+	// mu serializes network changes and protects State, grantTimer, and examTimer
+	mu         sync.Mutex
+	grantTimer timer
+	examTimer  timer
+	ctx        context.Context
+	cancel     context.CancelFunc
+	// passhash is the configured or embedded password hash and is protected by mu
+	passhash *hash.Hash
+	// limiter delays and locks out repeated failed authentication attempts
+	limiter *limiter
+	// verifier bounds concurrent password hash evaluations
+	verifier *verifier
+	// challenges are the outstanding challenge-response nonces
+	challenges *challenges
+	// sessions are the signed in users
+	sessions *sessions
+	// remoteChallenges are the outstanding remote unlock challenges
+	remoteChallenges *remoteChallenges
+	// approval is the enable request waiting for a second user, if the two-person rule is enabled. It's protected by
+	// mu
+	approval *Approval
+	// totpUsed maps lowercase user names to the counter of the last TOTP code they used, so codes can't be replayed.
+	// It's protected by mu
+	totpUsed map[string]uint64
+	// unlockCodesInUse are the names of unlock codes authenticated by requests that haven't finished, so a code can't
+	// be used by two requests at once. It's protected by mu
+	unlockCodesInUse map[string]bool
+	// auditLog records auth attempts and state changes
+	auditLog *auditLog
+	// examID is the ID of the exam in progress, so audit records can be tagged without holding mu
+	examID atomic.Value
 }
 
 // NewServer returns a new Server with the given logger
 func NewServer(logger zerolog.Logger) (*Server, error) {
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not load config: %w", err)
+	}
+
+	migrated, err := config.migrateHashes()
+	if err != nil {
+		return nil, fmt.Errorf("could not migrate password hashes: %w", err)
+	}
+	if migrated {
+		if err = config.Save(configPath); err != nil {
+			return nil, fmt.Errorf("could not save migrated password hashes: %w", err)
+		}
+		logger.Info().Msg("migrated password hashes")
+	}
+
+	// the config may contain password hashes, so make sure it's protected
+	if _, err = os.Stat(configPath); err == nil {
+		if err = protectFile(configPath); err != nil {
+			logger.Warn().Err(err).Msg("could not protect config")
+		}
+	}
+
+	ph := passhash
+	if config.PasswordHash != "" {
+		ph = mustParseHash(config.PasswordHash)
+	}
+
+	state, err := LoadState(statePath)
+	if err != nil {
+		return nil, fmt.Errorf("could not load state: %w", err)
+	}
+
+	auditKey, err := createAuditKey(auditKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	auditLog, err := openAudit(auditPath, auditKey)
+	if err != nil {
+		return nil, fmt.Errorf("could not open audit log: %w", err)
+	}
+	if err = auditLog.Err(); err != nil {
+		logger.Error().Err(err).Msg("audit log doesn't match its head, so no records will be appended until it's moved aside")
+	}
+
+	challenges, err := newChallenges()
+	if err != nil {
+		return nil, fmt.Errorf("could not create challenges: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(sockPath), 0755); err != nil {
+		return nil, fmt.Errorf("could not create socket directory: %w", err)
+	}
+
 	if err := os.RemoveAll(sockPath); err != nil {
 		return nil, fmt.Errorf("could not remove socket: %w", err)
 	}
@@ -50,27 +175,95 @@ func NewServer(logger zerolog.Logger) (*Server, error) {
 		return nil, fmt.Errorf("could not set socket permissions: %w", err)
 	}
 
-	s := &Server{Logger: logger, listener: listener}
+	s := &Server{Logger: logger, Config: config, State: state, NewBackend: defaultBackend, listener: listener, passhash: ph,
+		limiter:          newLimiter(config.lockoutThreshold(), config.lockoutDuration()),
+		verifier:         newVerifier(config.verifyConcurrency(), config.verifyQueue()),
+		challenges:       challenges,
+		sessions:         newSessions(config.sessionDuration()),
+		totpUsed:         make(map[string]uint64),
+		unlockCodesInUse: make(map[string]bool),
+		remoteChallenges: newRemoteChallenges(),
+		auditLog:         auditLog,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.SetStatus)
+	mux.HandleFunc("/status", s.Status)
+	mux.HandleFunc("/password", s.ChangePassword)
+	mux.HandleFunc("/users", s.ManageUsers)
+	mux.HandleFunc("/lockout", s.ClearLockout)
+	mux.HandleFunc("/challenge", s.Challenge)
+	mux.HandleFunc("/login", s.Login)
+	mux.HandleFunc("/logout", s.Logout)
+	mux.HandleFunc("/unlock-codes", s.ManageUnlockCodes)
+	mux.HandleFunc("/remote-unlock", s.SetupRemoteUnlock)
+	mux.HandleFunc("/remote-unlock/challenge", s.RemoteChallenge)
+	mux.HandleFunc("/audit", s.Audit)
+	mux.HandleFunc("/exam", s.ManageExam)
+	s.server = &http.Server{Handler: s.logRequests(mux), ConnContext: s.connContext}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
 
 	return s, nil
 }
 
-// Serve serves HTTP on a unix socket until an error occurs
+// Serve resumes any active grant or exam, starts enforcing the desired network state, and serves HTTP on a unix socket until
+// an error occurs
 func (s *Server) Serve() error {
-	server := &http.Server{Handler: http.HandlerFunc(s.SetStatus)}
-	s.server = server
-	return server.Serve(s.listener)
+	s.mu.Lock()
+	if g := s.State.Grant; g != nil {
+		s.Logger.Info().Time("expires", g.Expires).Dur("remaining", g.Remaining()).Msg("resuming grant")
+	}
+	s.scheduleGrant()
+	if e := s.State.Exam; e != nil {
+		s.Logger.Info().Str("exam", e.ID).Str("name", e.Name).Time("start", e.Start).Time("end", e.End).Msg("resuming exam")
+	}
+	s.scheduleExam()
+	s.mu.Unlock()
+
+	s.audit(&AuditRecord{Event: auditService, Action: "start", Outcome: auditSuccess})
+
+	go s.reconcileLoop(s.ctx)
+
+	return s.server.Serve(s.listener)
 }
 
 // Shutdown shuts down the server
 func (s *Server) Shutdown() error {
+	if s.ctx.Err() == nil {
+		s.audit(&AuditRecord{Event: auditService, Action: "stop", Outcome: auditSuccess})
+	}
+	s.cancel()
+
+	s.mu.Lock()
+	if s.grantTimer != nil {
+		s.grantTimer.Stop()
+	}
+	if s.examTimer != nil {
+		s.examTimer.Stop()
+	}
+	s.mu.Unlock()
+
 	if err := s.server.Shutdown(context.Background()); err != nil {
 		return fmt.Errorf("could not shutdown server: %w", err)
 	}
 
+	if err := s.auditLog.Close(); err != nil {
+		return fmt.Errorf("could not close audit log: %w", err)
+	}
+
 	return nil
 }
 
+// requestActions returns the actions that must be allowed to apply req
+func requestActions(req *request) []action {
+	if !req.Enabled {
+		return []action{actionDisable}
+	}
+	if req.Duration > 0 {
+		return []action{actionEnable, actionGrant}
+	}
+	return []action{actionEnable}
+}
+
 // SetStatus is an HTTP handler that verifies a password and enables or disables network interfaces
 func (s *Server) SetStatus(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -80,104 +273,169 @@ func (s *Server) SetStatus(w http.ResponseWriter, r *http.Request) {
 	}
 
 	req := new(request)
-	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		s.Logger.Warn().Err(fmt.Errorf("could not decode request: %w", err)).Send()
+	body, ok := s.readRequest(w, r, req)
+	if !ok {
 		return
 	}
 
-	if !Validate(req.Password) {
-		w.WriteHeader(http.StatusUnauthorized)
-		s.Logger.Warn().Msg("invalid password")
+	// validate the reason first, so single-use credentials aren't used up by an invalid request
+	s.mu.Lock()
+	reason, category, err := s.Config.validateReason(req.Reason, req.Category)
+	s.mu.Unlock()
+	if err != nil {
+		s.Logger.Warn().Err(err).Send()
+		s.writeResponse(w, http.StatusBadRequest, &response{Error: err.Error()})
 		return
 	}
 
-	// recover panics, because WMI seems to be pretty buggy
-	defer func() {
-		if r := recover(); r != nil {
-			errStr := fmt.Sprintf("panic: %v", r)
-			s.Logger.Error().Msg(errStr)
-			resp := &response{Error: "Error (panic): Please try again later"}
-			w.WriteHeader(http.StatusInternalServerError)
-			if err := json.NewEncoder(w).Encode(resp); err != nil {
-				s.Logger.Error().Err(fmt.Errorf("could not encode response: %w", err)).Send()
-			}
-		}
-	}()
+	cred := credentials{Username: req.Username, Password: req.Password, Code: req.Code, UnlockCode: req.UnlockCode, Remote: req.RemoteUnlock}
+	acct := s.authorize(w, r, body, cred, requestActions(req)...)
+	if acct == nil {
+		return
+	}
+
+	c := &statusChange{
+		User: acct.Name, Reason: reason, Category: category,
+		Enabled: req.Enabled, Adapters: req.Adapters, Force: req.Force, Duration: time.Duration(req.Duration) * time.Second,
+	}
+	if pending, ok, err := s.approve(acct, c); err != nil {
+		s.finishUnlockCode(acct, false)
+		s.writeResponse(w, http.StatusForbidden, &response{Error: err.Error()})
+		return
+	} else if !ok {
+		s.finishUnlockCode(acct, false)
+		s.writeResponse(w, http.StatusAccepted, &response{Pending: pending})
+		return
+	}
 
-	conn, err := NewConn()
+	changed, err := s.change(c)
+	s.finishUnlockCode(acct, err == nil || len(changed) > 0)
 	if err != nil {
-		err = fmt.Errorf("could not create WMI conn: %w", err)
-		s.Logger.Error().Err(err).Send()
-		resp := &response{Error: "Error (WMI conn): Please try again later"}
-		w.WriteHeader(http.StatusInternalServerError)
-		if err := json.NewEncoder(w).Encode(resp); err != nil {
-			s.Logger.Error().Err(fmt.Errorf("could not encode response: %w", err)).Send()
-		}
+		s.writeChangeError(w, changed, err)
 		return
 	}
-	defer conn.Close()
 
-	if err = conn.SetStatus(req.Enabled); err != nil {
-		err = fmt.Errorf("could not set status: %w", err)
+	s.mu.Lock()
+	resp := &response{Changed: adapterNames(changed), Grant: s.State.Grant}
+	s.mu.Unlock()
+	s.writeResponse(w, http.StatusOK, resp)
+}
+
+// writeChangeError writes the response for a change that failed with err after changing the adapters in changed
+func (s *Server) writeChangeError(w http.ResponseWriter, changed []*Adapter, err error) {
+	var stepErr *stepError
+	if errors.As(err, &stepErr) {
 		s.Logger.Error().Err(err).Send()
-		resp := &response{Error: "Error (SetStatus): Please try again later"}
-		w.WriteHeader(http.StatusInternalServerError)
-		if err := json.NewEncoder(w).Encode(resp); err != nil {
-			s.Logger.Error().Err(fmt.Errorf("could not encode response: %w", err)).Send()
+		resp := &response{Error: fmt.Sprintf("Error (%s): Please try again later", stepErr.Step), Changed: adapterNames(changed)}
+		var partialErr *partialError
+		if errors.As(err, &partialErr) {
+			resp.Failed = partialErr.Failed
 		}
+		s.writeResponse(w, http.StatusInternalServerError, resp)
 		return
 	}
+	s.Logger.Warn().Err(err).Send()
+	s.writeResponse(w, http.StatusBadRequest, &response{Error: err.Error()})
+}
+
+// maxRequestSize is the maximum size of a request body
+const maxRequestSize = 1 << 20
+
+// readRequest reads the body of r and decodes it into v, returning the body so it can be authenticated. If it fails,
+// an error response is written and false is returned
+func (s *Server) readRequest(w http.ResponseWriter, r *http.Request, v interface{}) ([]byte, bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestSize))
+	if err == nil {
+		err = json.Unmarshal(body, v)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		s.Logger.Warn().Err(fmt.Errorf("could not decode request: %w", err)).Send()
+		return nil, false
+	}
+	return body, true
+}
 
-	method := "Disabled"
-	if req.Enabled {
-		method = "Enabled"
+// writeResponse writes resp with the given status code
+func (s *Server) writeResponse(w http.ResponseWriter, code int, resp *response) {
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		s.Logger.Error().Err(fmt.Errorf("could not encode response: %w", err)).Send()
 	}
-	w.WriteHeader(http.StatusOK)
-	s.Logger.Info().Msg(fmt.Sprintf("interfaces set to %s", method))
 }
 
 // Client is a client for Server
 type Client struct {
 	client *http.Client
+
+	mu sync.Mutex
+	// session is set after Login. It's only valid on the connection it was created on
+	session *Session
 }
 
-// NewClient returns a new Client
+// NewClient returns a new Client. All requests share a single connection, so a Session stays valid
 func NewClient() *Client {
 	return &Client{client: &http.Client{
 		Transport: &http.Transport{
 			DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
 				return net.Dial("unix", sockPath)
 			},
+			MaxConnsPerHost: 1,
 		},
 	}}
 }
 
-// SetStatus requests to change network interface statuses
-func (c *Client) SetStatus(passwd string, enabled bool) error {
-	body := new(bytes.Buffer)
-	if err := json.NewEncoder(body).Encode(&request{Password: passwd, Enabled: enabled}); err != nil {
-		return fmt.Errorf("could not encode body: %w", err)
+// requestError wraps err, returning errServiceDown if the service couldn't be reached
+func requestError(err error) error {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return fmt.Errorf("%w: %v", errServiceDown, err)
 	}
+	return err
+}
 
-	resp, err := c.client.Post("http://unix/", "application/json", body)
+// SetStatus requests to change network interface statuses, authenticating with a challenge-response proof of
+// req.Password or req.Code, or with req.UnlockCode or req.RemoteUnlock. If some adapters couldn't be changed, the response is returned
+// with a *partialError. If the request is waiting for a second user to approve it, the response's Pending is set
+func (c *Client) SetStatus(req *request) (*response, error) {
+	body := *req
+	body.Password, body.Code = "", ""
+	cred := credentials{Username: req.Username, Password: req.Password, Code: req.Code, UnlockCode: req.UnlockCode, Remote: req.RemoteUnlock}
+	resp, err := c.post("/", cred, &body)
 	if err != nil {
-		return fmt.Errorf("could not post request: %w", err)
+		return nil, err
 	}
 	defer resp.Body.Close()
 
+	return decodeResponse(resp)
+}
+
+// decodeResponse decodes the response to a status change. If some adapters couldn't be changed, the response is
+// returned with a *partialError
+func decodeResponse(resp *http.Response) (*response, error) {
 	switch resp.StatusCode {
-	case http.StatusOK:
-		return nil
-	case http.StatusUnauthorized:
-		return errUnauthorized
-	case http.StatusInternalServerError:
+	case http.StatusOK, http.StatusAccepted, http.StatusBadRequest, http.StatusForbidden, http.StatusInternalServerError:
 		r := new(response)
 		if err := json.NewDecoder(resp.Body).Decode(r); err != nil {
-			return fmt.Errorf("could not decode response: %w", err)
+			return nil, fmt.Errorf("could not decode response: %w", err)
 		}
-		return errors.New(r.Error)
+		if resp.StatusCode == http.StatusForbidden {
+			return nil, fmt.Errorf("%w: %s", errForbidden, r.Error)
+		}
+		if len(r.Failed) > 0 {
+			return r, &partialError{Failed: r.Failed}
+		}
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+			return nil, errors.New(r.Error)
+		}
+		return r, nil
+	case http.StatusUnauthorized:
+		return nil, errUnauthorized
+	case http.StatusTooManyRequests:
+		return nil, clientLockoutError(resp)
+	case http.StatusServiceUnavailable:
+		return nil, errBusy
 	default:
-		return fmt.Errorf("unexpected status: %d %s", resp.StatusCode, resp.Status)
+		return nil, fmt.Errorf("unexpected status: %d %s", resp.StatusCode, resp.Status)
 	}
 }
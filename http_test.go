@@ -0,0 +1,1979 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/kong"
+	"github.com/korylprince/go-win-netcontrol/hash"
+	"github.com/rs/zerolog"
+)
+
+// newTestServer starts a Server with paths in a new temporary directory, returning a client and a function to stop
+// the server
+func newTestServer(t *testing.T, backend Backend) (*Client, func()) {
+	t.Helper()
+	return newTestServerConfig(t, backend, nil)
+}
+
+// newTestServerConfig is newTestServer with config saved before starting, if not nil
+func newTestServerConfig(t *testing.T, backend Backend, config *Config) (*Client, func()) {
+	t.Helper()
+	dir := t.TempDir()
+	sockPath = filepath.Join(dir, "control.sock")
+	configPath = filepath.Join(dir, "config.json")
+	statePath = filepath.Join(dir, "state.json")
+	auditPath = filepath.Join(dir, "audit.log")
+	auditKeyPath = filepath.Join(dir, "audit.key")
+
+	if config != nil {
+		if err := config.Save(configPath); err != nil {
+			t.Fatalf("save config error: want: nil, have: %v", err)
+		}
+	}
+
+	stop := startTestServer(t, backend)
+
+	return NewClient(), stop
+}
+
+// testAuditKey returns the test server's audit key
+func testAuditKey(t *testing.T) []byte {
+	t.Helper()
+	key, err := readAuditKey(auditKeyPath)
+	if err != nil {
+		t.Fatalf("read audit key error: want: nil, have: %v", err)
+	}
+	return key
+}
+
+// startTestServer starts a Server with the current paths, returning a function to stop it
+func startTestServer(t *testing.T, backend Backend) func() {
+	t.Helper()
+	s, err := NewServer(zerolog.Nop())
+	if err != nil {
+		t.Fatalf("create server error: want: nil, have: %v", err)
+	}
+	s.NewBackend = func() (Backend, error) { return backend, nil }
+
+	go s.Serve()
+	t.Cleanup(func() { s.Shutdown() })
+
+	return func() { s.Shutdown() }
+}
+
+// fakeClock is a clock that only moves when it's advanced
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock *fakeClock
+	at    time.Time
+	f     func()
+	done  bool
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	stopped := !t.done
+	t.done = true
+	return stopped
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, at: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock forward by d, running the timers that are due in order, including timers scheduled by
+// them
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+
+	for {
+		c.mu.Lock()
+		var due []*fakeTimer
+		for _, t := range c.timers {
+			if !t.done && !t.at.After(c.now) {
+				due = append(due, t)
+			}
+		}
+		sort.Slice(due, func(i, j int) bool { return due[i].at.Before(due[j].at) })
+		if len(due) > 0 {
+			due[0].done = true
+		}
+		c.mu.Unlock()
+
+		if len(due) == 0 {
+			return
+		}
+		due[0].f()
+	}
+}
+
+// useFakeClock replaces serviceClock with a fakeClock for the rest of the test
+func useFakeClock(t *testing.T) *fakeClock {
+	t.Helper()
+	c := &fakeClock{now: time.Now()}
+	serviceClock = c
+	t.Cleanup(func() { serviceClock = systemClock{} })
+	return c
+}
+
+// setStatus calls client.SetStatus, ignoring the response
+func setStatus(client *Client, req *request) error {
+	_, err := client.SetStatus(req)
+	return err
+}
+
+func testAdapters() []*Adapter {
+	return []*Adapter{
+		{Name: "Ethernet", InterfaceDescription: "Intel(R) Ethernet Connection", InterfaceAdminStatus: interfaceAdminStatusUp, InterfaceIndex: 1},
+		{Name: "Wi-Fi", InterfaceDescription: "Intel(R) Wi-Fi 6 AX201", NdisMedium: ndisMediumNative80211, InterfaceAdminStatus: interfaceAdminStatusDown, InterfaceIndex: 2},
+		{Name: "vEthernet (Default Switch)", InterfaceDescription: "Hyper-V Virtual Ethernet Adapter", Virtual: true, InterfaceAdminStatus: interfaceAdminStatusUp, InterfaceIndex: 3},
+	}
+}
+
+func TestServerSetStatus(t *testing.T) {
+	backend := NewSimBackend(testAdapters()...)
+	client, stop := newTestServer(t, backend)
+	defer stop()
+
+	if err := setStatus(client, &request{Password: "bad", Enabled: true}); !errors.Is(err, errUnauthorized) || exitCode(err) != exitUnauthorized {
+		t.Errorf("invalid password error: want: %v, have: %v", errUnauthorized, err)
+	}
+
+	if err := setStatus(client, &request{Password: "password"}); err != nil {
+		t.Fatalf("disable error: want: nil, have: %v", err)
+	}
+	adapters, _ := DefaultSelection.List(backend)
+	if enabled := countEnabled(adapters); enabled != 0 {
+		t.Errorf("enabled after disable: want: 0, have: %d", enabled)
+	}
+
+	if err := setStatus(client, &request{Password: "password", Enabled: true, Force: true}); err != nil {
+		t.Fatalf("enable error: want: nil, have: %v", err)
+	}
+	adapters, _ = DefaultSelection.List(backend)
+	if enabled := countEnabled(adapters); enabled != len(adapters) {
+		t.Errorf("enabled after enable: want: %d, have: %d", len(adapters), enabled)
+	}
+
+	adapters, _ = backend.List()
+	if !adapters[2].Enabled() {
+		t.Errorf("unselected adapter: want: enabled, have: disabled")
+	}
+}
+
+func TestServerSetStatusAdapters(t *testing.T) {
+	backend := NewSimBackend(testAdapters()...)
+	client, stop := newTestServer(t, backend)
+	defer stop()
+
+	if err := setStatus(client, &request{Password: "password", Adapters: []string{"wi-fi", "Ethernet"}}); err != nil {
+		t.Fatalf("disable error: want: nil, have: %v", err)
+	}
+	if err := setStatus(client, &request{Password: "password", Enabled: true, Adapters: []string{"Wi-Fi"}}); err != nil {
+		t.Fatalf("enable error: want: nil, have: %v", err)
+	}
+	adapters, _ := backend.List()
+	if adapters[0].Enabled() || !adapters[1].Enabled() {
+		t.Errorf("adapter status: want: Ethernet disabled, Wi-Fi enabled, have: %v, %v", adapters[0], adapters[1])
+	}
+
+	if err := setStatus(client, &request{Password: "password", Adapters: []string{"vEthernet (Default Switch)"}}); err == nil || !strings.Contains(err.Error(), "unknown adapter") {
+		t.Errorf("unselected adapter error: want: unknown adapter, have: %v", err)
+	}
+}
+
+func TestServerSnapshot(t *testing.T) {
+	backend := NewSimBackend(testAdapters()...)
+	client, stop := newTestServer(t, backend)
+	defer stop()
+
+	if err := setStatus(client, &request{Password: "password"}); err != nil {
+		t.Fatalf("disable error: want: nil, have: %v", err)
+	}
+
+	// a second disable shouldn't overwrite the snapshot
+	if err := setStatus(client, &request{Password: "password"}); err != nil {
+		t.Fatalf("disable error: want: nil, have: %v", err)
+	}
+
+	// snapshot should survive a restart
+	st, err := LoadState(statePath)
+	if err != nil {
+		t.Fatalf("load state error: want: nil, have: %v", err)
+	}
+	if st.Snapshot == nil || len(st.Snapshot.Adapters) != 1 || st.Snapshot.Adapters[0] != "Ethernet" {
+		t.Fatalf("snapshot: want: [Ethernet], have: %v", st.Snapshot)
+	}
+	stop()
+	stop = startTestServer(t, backend)
+
+	if err := setStatus(client, &request{Password: "password", Enabled: true}); err != nil {
+		t.Fatalf("enable error: want: nil, have: %v", err)
+	}
+	adapters, _ := backend.List()
+	if !adapters[0].Enabled() || adapters[1].Enabled() {
+		t.Errorf("restored status: want: Ethernet enabled, Wi-Fi disabled, have: %v, %v", adapters[0], adapters[1])
+	}
+	if st, _ := LoadState(statePath); st.Snapshot != nil {
+		t.Errorf("snapshot after restore: want: nil, have: %v", st.Snapshot)
+	}
+
+	if err := setStatus(client, &request{Password: "password", Enabled: true, Force: true}); err != nil {
+		t.Fatalf("force enable error: want: nil, have: %v", err)
+	}
+	adapters, _ = backend.List()
+	if !adapters[1].Enabled() {
+		t.Errorf("force enable: want: Wi-Fi enabled, have: %v", adapters[1])
+	}
+
+	// disabling all adapters replaces the snapshot, so an adapter disabled beforehand isn't restored
+	if err := setStatus(client, &request{Password: "password", Adapters: []string{"Wi-Fi"}}); err != nil {
+		t.Fatalf("disable error: want: nil, have: %v", err)
+	}
+	if err := setStatus(client, &request{Password: "password"}); err != nil {
+		t.Fatalf("disable error: want: nil, have: %v", err)
+	}
+	if st, _ := LoadState(statePath); st.Snapshot == nil || len(st.Snapshot.Adapters) != 1 || st.Snapshot.Adapters[0] != "Ethernet" {
+		t.Errorf("replaced snapshot: want: [Ethernet], have: %v", st.Snapshot)
+	}
+}
+
+func TestServerGrant(t *testing.T) {
+	clk := useFakeClock(t)
+	backend := NewSimBackend(testAdapters()...)
+	client, stop := newTestServer(t, backend)
+	defer stop()
+
+	if err := setStatus(client, &request{Password: "password", Duration: 60}); err == nil || !strings.Contains(err.Error(), "invalid duration") {
+		t.Errorf("disable with duration error: want: invalid duration, have: %v", err)
+	}
+	// a duration under a second would be sent as 0, enabling the network indefinitely
+	if err := (&EnableCmd{Duration: 500 * time.Millisecond}).Run(); !errors.Is(err, errInvalidDuration) {
+		t.Errorf("sub-second duration error: want: %v, have: %v", errInvalidDuration, err)
+	}
+
+	if err := setStatus(client, &request{Password: "password"}); err != nil {
+		t.Fatalf("disable error: want: nil, have: %v", err)
+	}
+
+	resp, err := client.SetStatus(&request{Password: "password", Enabled: true, Duration: 60})
+	if err != nil {
+		t.Fatalf("grant error: want: nil, have: %v", err)
+	}
+	grant := resp.Grant
+	if grant == nil || grant.Remaining() != time.Minute {
+		t.Fatalf("grant: want: 1m0s remaining, have: %v", grant)
+	}
+	// the change is timestamped by the service clock, like the grant
+	if st, _ := client.Status(); st.LastChange == nil || !st.LastChange.Time.Equal(clk.Now()) || !grant.Start.Equal(clk.Now()) {
+		t.Errorf("change time: want: %v, have: %v", clk.Now(), st.LastChange)
+	}
+	clk.Advance(30 * time.Second)
+	if adapters, _ := backend.List(); !adapters[0].Enabled() {
+		t.Errorf("status during grant: want: Ethernet enabled, have: %v", adapters[0])
+	}
+
+	// grant should survive a restart
+	stop()
+	stop = startTestServer(t, backend)
+
+	// requests are only served once the grant has been resumed
+	if _, err = client.Status(); err != nil {
+		t.Fatalf("status error: want: nil, have: %v", err)
+	}
+	clk.Advance(30 * time.Second)
+	if adapters, _ := backend.List(); adapters[0].Enabled() {
+		t.Errorf("status after grant: want: Ethernet disabled, have: %v", adapters[0])
+	}
+	if st, _ := LoadState(statePath); st.Grant != nil || st.Snapshot == nil {
+		t.Errorf("state after grant: want: snapshot and no grant, have: %v, %v", st.Snapshot, st.Grant)
+	}
+}
+
+// waitFor waits up to a few seconds for f to return true
+func waitFor(t *testing.T, msg string, f func() bool) {
+	t.Helper()
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(50 * time.Millisecond) {
+		if f() {
+			return
+		}
+	}
+	t.Errorf("timed out waiting for %s", msg)
+}
+
+func TestServerReconcile(t *testing.T) {
+	backend := NewSimBackend(testAdapters()...)
+	client, stop := newTestServer(t, backend)
+	defer stop()
+
+	if err := setStatus(client, &request{Password: "password"}); err != nil {
+		t.Fatalf("disable error: want: nil, have: %v", err)
+	}
+
+	enabled := func(name string) func() bool {
+		return func() bool {
+			adapters, _ := backend.List()
+			for _, a := range adapters {
+				if a.Name == name {
+					return a.Enabled()
+				}
+			}
+			return false
+		}
+	}
+	disabled := func(name string) func() bool {
+		return func() bool { return !enabled(name)() }
+	}
+
+	if err := backend.Enable("Ethernet"); err != nil {
+		t.Fatalf("enable error: want: nil, have: %v", err)
+	}
+	waitFor(t, "Ethernet to be disabled", disabled("Ethernet"))
+
+	backend.Add(&Adapter{Name: "Ethernet 3", InterfaceDescription: "Remote NDIS based Internet Sharing Device", InterfaceAdminStatus: interfaceAdminStatusUp, InterfaceIndex: 4})
+	waitFor(t, "tethered adapter to be disabled", disabled("Ethernet 3"))
+
+	// individually enabled adapters are allowed while locked
+	if err := setStatus(client, &request{Password: "password", Enabled: true, Adapters: []string{"Wi-Fi"}}); err != nil {
+		t.Fatalf("enable error: want: nil, have: %v", err)
+	}
+	if err := backend.Enable("Ethernet"); err != nil {
+		t.Fatalf("enable error: want: nil, have: %v", err)
+	}
+	waitFor(t, "Ethernet to be disabled", disabled("Ethernet"))
+	if !enabled("Wi-Fi")() {
+		t.Errorf("allowed adapter: want: enabled, have: disabled")
+	}
+
+	// unlocked adapters aren't enforced
+	if err := setStatus(client, &request{Password: "password", Enabled: true}); err != nil {
+		t.Fatalf("enable error: want: nil, have: %v", err)
+	}
+	if err := backend.Enable("Ethernet 3"); err != nil {
+		t.Fatalf("enable error: want: nil, have: %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if !enabled("Ethernet 3")() {
+		t.Errorf("unlocked adapter: want: enabled, have: disabled")
+	}
+}
+
+func TestServerStatus(t *testing.T) {
+	backend := NewSimBackend(testAdapters()...)
+	client, stop := newTestServer(t, backend)
+	defer stop()
+
+	if _, err := client.SetStatus(&request{Password: "password", Enabled: true, Duration: 60}); err != nil {
+		t.Fatalf("grant error: want: nil, have: %v", err)
+	}
+
+	st, err := client.Status()
+	if err != nil {
+		t.Fatalf("status error: want: nil, have: %v", err)
+	}
+	if st.Verify == nil || st.Verify.Concurrency != DefaultVerifyConcurrency || st.Verify.Queue != DefaultVerifyQueue {
+		t.Errorf("verify metrics: want: default limits, have: %+v", st.Verify)
+	}
+	if len(st.Adapters) != 2 || st.Locked || st.Version != version {
+		t.Errorf("status: want: 2 adapters, unlocked, version %s, have: %d adapters, locked %v, version %s", version, len(st.Adapters), st.Locked, st.Version)
+	}
+	if st.Grant == nil || st.LastChange == nil || st.LastChange.User != sharedPasswordUser || st.LastChange.Expires == nil {
+		t.Errorf("status: want: grant and last change, have: %v, %v", st.Grant, st.LastChange)
+	}
+	if network := st.Network(); network != "Enabled" {
+		t.Errorf("network: want: Enabled, have: %s", network)
+	}
+
+	// the network state comes from the adapters, not just the desired state
+	if err = setStatus(client, &request{Password: "password"}); err != nil {
+		t.Fatalf("disable error: want: nil, have: %v", err)
+	}
+	// keep the reconciler from disabling it again
+	backend.SetFault(func(op, name string) error {
+		if op == "disable" && name == "Wi-Fi" {
+			return errors.New("access denied")
+		}
+		return nil
+	})
+	if err = backend.Enable("Wi-Fi"); err != nil {
+		t.Fatalf("enable error: want: nil, have: %v", err)
+	}
+	if st, err = client.Status(); err != nil {
+		t.Fatalf("status error: want: nil, have: %v", err)
+	}
+	if network := st.Network(); network != "Partially enabled (1 of 2 adapters) (locked)" {
+		t.Errorf("network: want: Partially enabled (1 of 2 adapters) (locked), have: %s", network)
+	}
+
+	backend.SetFault(func(op, name string) error { panic("WMI crashed") })
+	if st, err = client.Status(); err != nil || st.Error == "" {
+		t.Errorf("status error: want: panic error, have: %v, %v", err, st)
+	}
+	if network := st.Network(); network != "Unknown" {
+		t.Errorf("network: want: Unknown, have: %s", network)
+	}
+	if err = statusError(st); err == nil || exitCode(err) != exitError {
+		t.Errorf("status exit error: want: error, have: %v", err)
+	}
+
+	stop()
+	if _, err = client.Status(); !errors.Is(err, errServiceDown) || exitCode(err) != exitServiceDown {
+		t.Errorf("stopped service error: want: %v, have: %v", errServiceDown, err)
+	}
+}
+
+func TestServerSetStatusFault(t *testing.T) {
+	backend := NewSimBackend(testAdapters()...)
+	client, stop := newTestServer(t, backend)
+	defer stop()
+
+	if err := setStatus(client, &request{Password: "password", Enabled: true, Force: true}); err != nil {
+		t.Fatalf("enable error: want: nil, have: %v", err)
+	}
+
+	// a disable that changes nothing leaves the state as it was
+	backend.SetFault(func(op, name string) error {
+		if op == "disable" {
+			return errors.New("access denied")
+		}
+		return nil
+	})
+	if err := setStatus(client, &request{Password: "password"}); err == nil {
+		t.Errorf("failed disable error: want: error, have: nil")
+	}
+	if st, _ := LoadState(statePath); st.Locked || st.Snapshot != nil {
+		t.Errorf("state after failed disable: want: unlocked without snapshot, have: %v, %v", st.Locked, st.Snapshot)
+	}
+
+	backend.SetFault(func(op, name string) error {
+		if op == "disable" && name == "Ethernet" {
+			return errors.New("access denied")
+		}
+		return nil
+	})
+	resp, err := client.SetStatus(&request{Password: "password"})
+	var partialErr *partialError
+	if !errors.As(err, &partialErr) || partialErr.Failed["Ethernet"] == "" || exitCode(err) != exitPartial {
+		t.Errorf("fault error: want: partial error, have: %v", err)
+	}
+	if resp == nil || len(resp.Changed) != 1 || resp.Changed[0] != "Wi-Fi" {
+		t.Errorf("fault response: want: Wi-Fi changed, have: %v", resp)
+	}
+
+	backend.SetFault(func(op, name string) error {
+		panic("WMI crashed")
+	})
+	if err := setStatus(client, &request{Password: "password"}); err == nil || !strings.Contains(err.Error(), "panic") {
+		t.Errorf("panic error: want: panic error, have: %v", err)
+	}
+}
+
+func TestServerChangePassword(t *testing.T) {
+	backend := NewSimBackend(testAdapters()...)
+	client, stop := newTestServer(t, backend)
+	defer stop()
+
+	if err := client.ChangePassword(credentials{Password: "bad"}, "new"); !errors.Is(err, errUnauthorized) {
+		t.Errorf("invalid password error: want: %v, have: %v", errUnauthorized, err)
+	}
+	if err := client.ChangePassword(credentials{Password: "password"}, ""); err == nil || err.Error() != errEmptyPassword.Error() {
+		t.Errorf("empty password error: want: %v, have: %v", errEmptyPassword, err)
+	}
+	if err := client.ChangePassword(credentials{Password: "password"}, "new"); err != nil {
+		t.Fatalf("change password error: want: nil, have: %v", err)
+	}
+
+	if err := setStatus(client, &request{Password: "password"}); !errors.Is(err, errUnauthorized) {
+		t.Errorf("old password error: want: %v, have: %v", errUnauthorized, err)
+	}
+	if err := setStatus(client, &request{Password: "new"}); err != nil {
+		t.Errorf("new password error: want: nil, have: %v", err)
+	}
+
+	// password should persist across restarts
+	stop()
+	startTestServer(t, backend)
+	if err := setStatus(client, &request{Password: "new", Enabled: true}); err != nil {
+		t.Errorf("new password after restart error: want: nil, have: %v", err)
+	}
+
+	info, err := os.Stat(configPath)
+	if err != nil {
+		t.Fatalf("stat config error: want: nil, have: %v", err)
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm() != 0600 {
+		t.Errorf("config permissions: want: %v, have: %v", os.FileMode(0600), info.Mode().Perm())
+	}
+}
+
+func TestServerMigrateHashes(t *testing.T) {
+	// a hash of "password" that stores the key instead of its verifier
+	legacy := "+qhTwm04Dpw5pQooSWds+gAAAAIAAQAAAdOE2CPYWHU5vcTz5fgGTd3dSQiNKW5OA5U+QtsV/ukG"
+	backend := NewSimBackend(testAdapters()...)
+	client, stop := newTestServerConfig(t, backend, &Config{PasswordHash: legacy})
+	defer stop()
+
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("load config error: want: nil, have: %v", err)
+	}
+	if config.PasswordHash != passhashstr {
+		t.Errorf("migrated hash: want: %s, have: %s", passhashstr, config.PasswordHash)
+	}
+	if err = setStatus(client, &request{Password: "password"}); err != nil {
+		t.Errorf("migrated password error: want: nil, have: %v", err)
+	}
+}
+
+func TestServerUsers(t *testing.T) {
+	backend := NewSimBackend(testAdapters()...)
+	client, stop := newTestServer(t, backend)
+	defer stop()
+
+	// the first user disables the shared password, so it must be an admin
+	if _, err := client.ManageUsers(&userRequest{Password: "password", Action: userActionAdd, Name: "coach", Role: RoleCoach, NewPassword: "coachpass"}); err == nil || !strings.Contains(err.Error(), "must be an admin") {
+		t.Errorf("add first coach error: want: must be an admin, have: %v", err)
+	}
+	if _, err := client.ManageUsers(&userRequest{Password: "password", Action: userActionAdd, Name: "admin", Role: RoleAdmin, NewPassword: "adminpass"}); err != nil {
+		t.Fatalf("add admin error: want: nil, have: %v", err)
+	}
+	// the shared password can't be used once users exist
+	if err := setStatus(client, &request{Password: "password"}); !errors.Is(err, errUnauthorized) {
+		t.Errorf("shared password error: want: %v, have: %v", errUnauthorized, err)
+	}
+
+	add := func(name string, role Role) error {
+		_, err := client.ManageUsers(&userRequest{Username: "admin", Password: "adminpass", Action: userActionAdd, Name: name, Role: role, NewPassword: name + "pass"})
+		return err
+	}
+	if err := add("proctor", RoleProctor); err != nil {
+		t.Fatalf("add proctor error: want: nil, have: %v", err)
+	}
+	if err := add("coach", RoleCoach); err != nil {
+		t.Fatalf("add coach error: want: nil, have: %v", err)
+	}
+	if err := add("Coach", RoleAdmin); err == nil {
+		t.Errorf("duplicate user error: want: error, have: nil")
+	}
+	if err := add("other", "root"); err == nil || !strings.Contains(err.Error(), "invalid role") {
+		t.Errorf("invalid role error: want: invalid role, have: %v", err)
+	}
+
+	if err := setStatus(client, &request{Username: "proctor", Password: "proctorpass"}); err != nil {
+		t.Fatalf("proctor disable error: want: nil, have: %v", err)
+	}
+	if err := setStatus(client, &request{Username: "proctor", Password: "proctorpass", Enabled: true}); !errors.Is(err, errForbidden) || exitCode(err) != exitUnauthorized {
+		t.Errorf("proctor enable error: want: %v, have: %v", errForbidden, err)
+	}
+	if _, err := client.ManageUsers(&userRequest{Username: "coach", Password: "coachpass", Action: userActionList}); !errors.Is(err, errForbidden) {
+		t.Errorf("coach list users error: want: %v, have: %v", errForbidden, err)
+	}
+	if err := setStatus(client, &request{Username: "nobody", Password: "password", Enabled: true}); !errors.Is(err, errUnauthorized) {
+		t.Errorf("unknown user error: want: %v, have: %v", errUnauthorized, err)
+	}
+	if err := setStatus(client, &request{Username: "COACH", Password: "coachpass", Enabled: true, Duration: 60}); err != nil {
+		t.Fatalf("coach grant error: want: nil, have: %v", err)
+	}
+	if st, _ := client.Status(); st.LastChange == nil || st.LastChange.User != "coach" {
+		t.Errorf("last change user: want: coach, have: %v", st.LastChange)
+	}
+
+	// users should be able to change their own password, and should persist across restarts
+	if err := client.ChangePassword(credentials{Username: "coach", Password: "coachpass"}, "newpass"); err != nil {
+		t.Fatalf("change password error: want: nil, have: %v", err)
+	}
+	stop()
+	stop = startTestServer(t, backend)
+	if err := setStatus(client, &request{Username: "coach", Password: "newpass"}); err != nil {
+		t.Errorf("new password after restart error: want: nil, have: %v", err)
+	}
+
+	if _, err := client.ManageUsers(&userRequest{Username: "admin", Password: "adminpass", Action: userActionRemove, Name: "coach"}); err != nil {
+		t.Fatalf("remove user error: want: nil, have: %v", err)
+	}
+	resp, err := client.ManageUsers(&userRequest{Username: "admin", Password: "adminpass", Action: userActionList})
+	if err != nil {
+		t.Fatalf("list users error: want: nil, have: %v", err)
+	}
+	if len(resp.Users) != 2 || resp.Users[0].Name != "admin" || resp.Users[1].Name != "proctor" || resp.Users[1].Role != RoleProctor {
+		t.Errorf("users: want: [admin proctor], have: %v", resp.Users)
+	}
+	if _, err = client.ManageUsers(&userRequest{Username: "admin", Password: "adminpass", Action: userActionRemove, Name: "admin"}); err == nil || !strings.Contains(err.Error(), "last admin") {
+		t.Errorf("remove last admin error: want: last admin, have: %v", err)
+	}
+
+	// the shared password can be given a role
+	stop()
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("load config error: want: nil, have: %v", err)
+	}
+	config.SharedPasswordRole = RoleProctor
+	if err = config.Save(configPath); err != nil {
+		t.Fatalf("save config error: want: nil, have: %v", err)
+	}
+	startTestServer(t, backend)
+	if err = setStatus(client, &request{Password: "password"}); err != nil {
+		t.Errorf("shared password disable error: want: nil, have: %v", err)
+	}
+	if err = setStatus(client, &request{Password: "password", Enabled: true}); !errors.Is(err, errForbidden) {
+		t.Errorf("shared password enable error: want: %v, have: %v", errForbidden, err)
+	}
+}
+
+func TestServerLockout(t *testing.T) {
+	clk := useFakeClock(t)
+	backend := NewSimBackend(testAdapters()...)
+	client, stop := newTestServerConfig(t, backend, &Config{LockoutThreshold: 3})
+	defer stop()
+
+	if _, err := client.ManageUsers(&userRequest{Password: "password", Action: userActionAdd, Name: "admin", Role: RoleAdmin, NewPassword: "adminpass"}); err != nil {
+		t.Fatalf("add admin error: want: nil, have: %v", err)
+	}
+	if _, err := client.ManageUsers(&userRequest{Username: "admin", Password: "adminpass", Action: userActionAdd, Name: "coach", Role: RoleCoach, NewPassword: "coachpass"}); err != nil {
+		t.Fatalf("add coach error: want: nil, have: %v", err)
+	}
+	if _, err := client.Login(credentials{Username: "admin", Password: "adminpass"}); err != nil {
+		t.Fatalf("login error: want: nil, have: %v", err)
+	}
+	signedOut := NewClient()
+
+	for i := 0; i < 2; i++ {
+		if err := setStatus(signedOut, &request{Username: "coach", Password: "bad"}); !errors.Is(err, errUnauthorized) {
+			t.Fatalf("invalid password error: want: %v, have: %v", errUnauthorized, err)
+		}
+	}
+	if err := setStatus(signedOut, &request{Username: "coach", Password: "coachpass"}); !errors.Is(err, errLockedOut) || exitCode(err) != exitUnauthorized {
+		t.Errorf("delayed error: want: %v, have: %v", errLockedOut, err)
+	}
+	clk.Advance(time.Second)
+	if err := setStatus(signedOut, &request{Username: "coach", Password: "bad"}); !errors.Is(err, errUnauthorized) {
+		t.Fatalf("invalid password error: want: %v, have: %v", errUnauthorized, err)
+	}
+	if err := setStatus(signedOut, &request{Username: "coach", Password: "coachpass"}); !errors.Is(err, errLockedOut) {
+		t.Errorf("locked error: want: %v, have: %v", errLockedOut, err)
+	}
+
+	// names that don't exist all count against the same name
+	for i := 0; i < 3; i++ {
+		clk.Advance(time.Second)
+		if err := setStatus(signedOut, &request{Username: "nobody" + strconv.Itoa(i), Password: "bad"}); !errors.Is(err, errUnauthorized) {
+			t.Fatalf("invalid user error: want: %v, have: %v", errUnauthorized, err)
+		}
+	}
+	if err := setStatus(signedOut, &request{Username: "nobody", Password: "bad"}); !errors.Is(err, errLockedOut) {
+		t.Errorf("invalid user locked error: want: %v, have: %v", errLockedOut, err)
+	}
+
+	st, err := client.Status()
+	if err != nil {
+		t.Fatalf("status error: want: nil, have: %v", err)
+	}
+	if len(st.Lockouts) != 2 || st.Lockouts[0].Name != "" || st.Lockouts[1].Name != "coach" {
+		t.Fatalf("lockouts: want: unknown names and coach, have: %v", st.Lockouts)
+	}
+	for _, l := range st.Lockouts {
+		if l.Peer != limiterKey(st.Peer) || !l.Locked {
+			t.Errorf("lockout: want: %s locked, have: %v", limiterKey(st.Peer), l)
+		}
+	}
+	if l := st.Lockouts[1]; l.Remaining() != DefaultLockoutDuration-3*time.Second {
+		t.Errorf("coach lockout remaining: want: %v, have: %v", DefaultLockoutDuration-3*time.Second, l.Remaining())
+	}
+
+	// the locked out peer can still sign in as an admin and clear its own lockout
+	if err = signedOut.ClearLockout(credentials{Username: "admin", Password: "adminpass"}, limiterKey(st.Peer)); err != nil {
+		t.Fatalf("clear own lockout error: want: nil, have: %v", err)
+	}
+	if err = setStatus(signedOut, &request{Username: "coach", Password: "coachpass"}); err != nil {
+		t.Errorf("cleared password error: want: nil, have: %v", err)
+	}
+
+	// a session isn't subject to the lockout, so an admin can clear a lockout of their own name
+	for i := 0; i < 3; i++ {
+		clk.Advance(time.Minute)
+		setStatus(signedOut, &request{Username: "admin", Password: "bad"})
+	}
+	if err = setStatus(signedOut, &request{Username: "admin", Password: "adminpass"}); !errors.Is(err, errLockedOut) {
+		t.Errorf("admin locked error: want: %v, have: %v", errLockedOut, err)
+	}
+	if err = client.ClearLockout(credentials{}, limiterKey(st.Peer)); err != nil {
+		t.Fatalf("clear lockout error: want: nil, have: %v", err)
+	}
+	if err = setStatus(signedOut, &request{Username: "admin", Password: "adminpass"}); err != nil {
+		t.Errorf("cleared admin password error: want: nil, have: %v", err)
+	}
+
+	// lockouts expire
+	for i := 0; i < 3; i++ {
+		clk.Advance(time.Minute)
+		setStatus(signedOut, &request{Username: "admin", Password: "bad"})
+	}
+	if err = setStatus(signedOut, &request{Username: "admin", Password: "adminpass"}); !errors.Is(err, errLockedOut) {
+		t.Errorf("locked again error: want: %v, have: %v", errLockedOut, err)
+	}
+	clk.Advance(DefaultLockoutDuration)
+	if err = setStatus(signedOut, &request{Username: "admin", Password: "adminpass"}); err != nil {
+		t.Errorf("expired lockout error: want: nil, have: %v", err)
+	}
+
+	// the number of peers tracked is capped
+	l := newLimiter(3, time.Minute)
+	for i := 0; i < maxLimiterPeers+10; i++ {
+		p := &Peer{UID: strconv.Itoa(i)}
+		l.begin(p, "")
+		l.end(p, "", false)
+	}
+	if len(l.attempts) != maxLimiterPeers {
+		t.Errorf("tracked peers: want: %d, have: %d", maxLimiterPeers, len(l.attempts))
+	}
+}
+
+func TestServerChallenge(t *testing.T) {
+	backend := NewSimBackend(testAdapters()...)
+	client, stop := newTestServer(t, backend)
+	defer stop()
+
+	// send posts body with a proof created from passwd, returning the status code
+	send := func(nonce, key []byte, body string) int {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, "http://unix/", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("create request error: want: nil, have: %v", err)
+		}
+		req.Header.Set(nonceHeader, base64.StdEncoding.EncodeToString(nonce))
+		req.Header.Set(proofHeader, base64.StdEncoding.EncodeToString(hash.Proof(key, proofMessage(nonce, http.MethodPost, "/", []byte(body)))))
+		resp, err := client.client.Do(req)
+		if err != nil {
+			t.Fatalf("post error: want: nil, have: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	nonce, key, err := client.challenge(credentials{Password: "password"})
+	if err != nil {
+		t.Fatalf("challenge error: want: nil, have: %v", err)
+	}
+	if code := send(nonce, key, `{"enabled":false}`); code != http.StatusOK {
+		t.Errorf("proof status: want: %d, have: %d", http.StatusOK, code)
+	}
+	if code := send(nonce, key, `{"enabled":false}`); code != http.StatusUnauthorized {
+		t.Errorf("replayed proof status: want: %d, have: %d", http.StatusUnauthorized, code)
+	}
+
+	// a successful request resets failed attempts, so the next failure isn't delayed
+	if err = setStatus(client, &request{Password: "password"}); err != nil {
+		t.Fatalf("disable error: want: nil, have: %v", err)
+	}
+
+	// the proof is bound to the request body
+	nonce, key, _ = client.challenge(credentials{Password: "password"})
+	req, _ := http.NewRequest(http.MethodPost, "http://unix/", strings.NewReader(`{"enabled":true}`))
+	req.Header.Set(nonceHeader, base64.StdEncoding.EncodeToString(nonce))
+	req.Header.Set(proofHeader, base64.StdEncoding.EncodeToString(hash.Proof(key, proofMessage(nonce, http.MethodPost, "/", []byte(`{"enabled":false}`)))))
+	resp, err := client.client.Do(req)
+	if err != nil {
+		t.Fatalf("post error: want: nil, have: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("tampered body status: want: %d, have: %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	if err = setStatus(client, &request{Password: "password"}); err != nil {
+		t.Fatalf("disable error: want: nil, have: %v", err)
+	}
+
+	// passwords aren't accepted without a proof
+	if resp, err = client.client.Post("http://unix/", "application/json", strings.NewReader(`{"string":"password"}`)); err != nil {
+		t.Fatalf("post error: want: nil, have: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("plaintext password status: want: %d, have: %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+	if err = setStatus(client, &request{Password: "password"}); err != nil {
+		t.Fatalf("disable error: want: nil, have: %v", err)
+	}
+
+	// the stored hash can't create a proof
+	stored, err := passhash.MarshalBinary()
+	if err != nil {
+		t.Fatalf("marshal hash error: want: nil, have: %v", err)
+	}
+	nonce, _, _ = client.challenge(credentials{Password: "password"})
+	if code := send(nonce, stored[len(stored)-len(key):], `{"enabled":false}`); code != http.StatusUnauthorized {
+		t.Errorf("stored hash proof status: want: %d, have: %d", http.StatusUnauthorized, code)
+	}
+	if err = setStatus(client, &request{Password: "password"}); err != nil {
+		t.Fatalf("disable error: want: nil, have: %v", err)
+	}
+
+	// nonces are bound to the user they were issued for
+	nonce, key, _ = client.challenge(credentials{Username: "nobody", Password: "password"})
+	if code := send(nonce, key, `{"enabled":false}`); code != http.StatusUnauthorized {
+		t.Errorf("other user's nonce status: want: %d, have: %d", http.StatusUnauthorized, code)
+	}
+
+	// unknown users get a stable fake salt
+	fetch := func(name string) *challengeResponse {
+		t.Helper()
+		resp, err := client.client.Post("http://unix/challenge", "application/json", strings.NewReader(`{"username":"`+name+`"}`))
+		if err != nil {
+			t.Fatalf("challenge error: want: nil, have: %v", err)
+		}
+		defer resp.Body.Close()
+		ch := new(challengeResponse)
+		if err = json.NewDecoder(resp.Body).Decode(ch); err != nil {
+			t.Fatalf("decode challenge error: want: nil, have: %v", err)
+		}
+		return ch
+	}
+	if a, b := fetch("nobody"), fetch("NOBODY"); len(a.Params.Salt) != hash.SaltLen || !bytes.Equal(a.Params.Salt, b.Params.Salt) || bytes.Equal(a.Nonce, b.Nonce) {
+		t.Errorf("unknown user challenge: want: same salt, different nonces, have: %v, %v", a, b)
+	}
+}
+
+func TestServerSession(t *testing.T) {
+	backend := NewSimBackend(testAdapters()...)
+	client, stop := newTestServer(t, backend)
+	defer stop()
+
+	if _, err := client.Login(credentials{Password: "bad"}); !errors.Is(err, errUnauthorized) {
+		t.Errorf("invalid password error: want: %v, have: %v", errUnauthorized, err)
+	}
+	sess, err := client.Login(credentials{Password: "password"})
+	if err != nil {
+		t.Fatalf("login error: want: nil, have: %v", err)
+	}
+	if sess.User != sharedPasswordUser || sess.Role != RoleAdmin || sess.Remaining() < DefaultSessionDuration-time.Minute || client.Session() != sess {
+		t.Errorf("session: want: shared password admin session, have: %+v", sess)
+	}
+
+	if err = setStatus(client, &request{}); err != nil {
+		t.Fatalf("session disable error: want: nil, have: %v", err)
+	}
+
+	// sessions are bound to the connection they were created on
+	other := NewClient()
+	other.session = sess
+	if err = setStatus(other, &request{Enabled: true}); !errors.Is(err, errSessionExpired) || other.Session() != nil {
+		t.Errorf("other connection error: want: %v, have: %v", errSessionExpired, err)
+	}
+
+	// changing the password revokes sessions
+	if err = client.ChangePassword(credentials{Password: "password"}, "new"); err != nil {
+		t.Fatalf("change password error: want: nil, have: %v", err)
+	}
+	if err = setStatus(client, &request{Enabled: true}); !errors.Is(err, errSessionExpired) {
+		t.Errorf("revoked session error: want: %v, have: %v", errSessionExpired, err)
+	}
+
+	if _, err = client.Login(credentials{Password: "new"}); err != nil {
+		t.Fatalf("login error: want: nil, have: %v", err)
+	}
+	if err = client.Logout(); err != nil {
+		t.Fatalf("logout error: want: nil, have: %v", err)
+	}
+	if err = setStatus(client, &request{Enabled: true}); !errors.Is(err, errUnauthorized) {
+		t.Errorf("logged out error: want: %v, have: %v", errUnauthorized, err)
+	}
+}
+
+func TestServerTOTP(t *testing.T) {
+	backend := NewSimBackend(testAdapters()...)
+	client, stop := newTestServerConfig(t, backend, &Config{SharedPasswordRole: RoleAdmin})
+	defer stop()
+
+	if _, err := client.ManageUsers(&userRequest{Password: "password", Action: userActionAdd, Name: "coach", Role: RoleCoach, NewPassword: "coachpass"}); err != nil {
+		t.Fatalf("add coach error: want: nil, have: %v", err)
+	}
+	resp, err := client.ManageUsers(&userRequest{Password: "password", Action: userActionTOTP, Name: "coach"})
+	if err != nil || resp.TOTP == nil {
+		t.Fatalf("provision error: want: nil, have: %v", err)
+	}
+	if !strings.HasPrefix(resp.TOTP.URI, "otpauth://totp/") {
+		t.Errorf("uri: want: otpauth://totp/..., have: %s", resp.TOTP.URI)
+	}
+	totp, err := hash.ParseTOTP(resp.TOTP.Secret)
+	if err != nil {
+		t.Fatalf("parse secret error: want: nil, have: %v", err)
+	}
+
+	code := totp.Code(time.Now())
+	if err = setStatus(client, &request{Username: "coach", Code: code, Enabled: true}); err != nil {
+		t.Fatalf("code error: want: nil, have: %v", err)
+	}
+	if err = setStatus(client, &request{Username: "coach", Code: code}); !errors.Is(err, errUnauthorized) {
+		t.Errorf("replayed code error: want: %v, have: %v", errUnauthorized, err)
+	}
+
+	// the next code is accepted within the default skew
+	if err = setStatus(client, &request{Username: "coach", Code: totp.Code(time.Now().Add(hash.TOTPPeriod))}); err != nil {
+		t.Errorf("next code error: want: nil, have: %v", err)
+	}
+	if err = setStatus(client, &request{Username: "coach", Password: "coachpass"}); err != nil {
+		t.Errorf("password error: want: nil, have: %v", err)
+	}
+
+	users, err := client.ManageUsers(&userRequest{Password: "password", Action: userActionList})
+	if err != nil || len(users.Users) != 1 || !users.Users[0].TOTP {
+		t.Errorf("list users: want: coach with TOTP, have: %v, %v", users, err)
+	}
+
+	if _, err = client.ManageUsers(&userRequest{Password: "password", Action: userActionRemoveTOTP, Name: "coach"}); err != nil {
+		t.Fatalf("remove TOTP error: want: nil, have: %v", err)
+	}
+	if err = setStatus(client, &request{Username: "coach", Code: totp.Code(time.Now().Add(-hash.TOTPPeriod))}); !errors.Is(err, errUnauthorized) {
+		t.Errorf("removed TOTP error: want: %v, have: %v", errUnauthorized, err)
+	}
+}
+
+func TestServerUnlockCodes(t *testing.T) {
+	backend := NewSimBackend(testAdapters()...)
+	client, stop := newTestServer(t, backend)
+	defer stop()
+
+	id, codes, err := generateUnlockCodes(2)
+	if err != nil {
+		t.Fatalf("generate error: want: nil, have: %v", err)
+	}
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i], _ = newHash(code)
+	}
+	if _, err = client.ManageUnlockCodes(&unlockCodesRequest{Password: "password", Action: unlockActionGenerate, Batch: id, Role: RoleAdmin, Hashes: hashes}); err == nil {
+		t.Errorf("admin batch error: want: error, have: nil")
+	}
+	if _, err = client.ManageUnlockCodes(&unlockCodesRequest{Password: "password", Action: unlockActionGenerate, Batch: id, Role: RoleCoach, Hashes: hashes}); err != nil {
+		t.Fatalf("add batch error: want: nil, have: %v", err)
+	}
+
+	// a code isn't used up by a change that fails
+	if err = setStatus(client, &request{Password: "password"}); err != nil {
+		t.Fatalf("disable error: want: nil, have: %v", err)
+	}
+	backend.SetFault(func(op, name string) error {
+		if op == "enable" {
+			return errors.New("access denied")
+		}
+		return nil
+	})
+	if err = setStatus(client, &request{UnlockCode: codes[0], Enabled: true}); err == nil {
+		t.Errorf("failed change error: want: error, have: nil")
+	}
+	backend.SetFault(nil)
+
+	if err = setStatus(client, &request{UnlockCode: strings.ToLower(codes[0]), Enabled: true}); err != nil {
+		t.Fatalf("unlock code error: want: nil, have: %v", err)
+	}
+	if st, _ := client.Status(); st.LastChange == nil || st.LastChange.User != unlockCodeName(id, 1) {
+		t.Errorf("last change user: want: %s, have: %v", unlockCodeName(id, 1), st.LastChange)
+	}
+	if err = setStatus(client, &request{UnlockCode: codes[0]}); !errors.Is(err, errUnauthorized) {
+		t.Errorf("used code error: want: %v, have: %v", errUnauthorized, err)
+	}
+
+	// used codes should persist across restarts
+	stop()
+	startTestServer(t, backend)
+	resp, err := client.ManageUnlockCodes(&unlockCodesRequest{Password: "password", Action: unlockActionList})
+	if err != nil {
+		t.Fatalf("list error: want: nil, have: %v", err)
+	}
+	if len(resp.Batches) != 1 || resp.Batches[0].ID != id || resp.Batches[0].Total != 2 || resp.Batches[0].Used != 1 {
+		t.Errorf("batches: want: %s with 1 of 2 used, have: %v", id, resp.Batches)
+	}
+
+	if _, err = client.ManageUnlockCodes(&unlockCodesRequest{Password: "password", Action: unlockActionRevoke, Batch: id}); err != nil {
+		t.Fatalf("revoke error: want: nil, have: %v", err)
+	}
+	if err = setStatus(client, &request{UnlockCode: codes[1]}); !errors.Is(err, errUnauthorized) {
+		t.Errorf("revoked code error: want: %v, have: %v", errUnauthorized, err)
+	}
+}
+
+func TestCLIUnlockFlags(t *testing.T) {
+	parser, err := kong.New(&CLI)
+	if err != nil {
+		t.Fatalf("new parser error: want: nil, have: %v", err)
+	}
+	for _, args := range [][]string{{"enable", "--unlock-code"}, {"disable", "--remote-unlock"}} {
+		if _, err = parser.Parse(args); err != nil {
+			t.Errorf("%v error: want: nil, have: %v", args, err)
+		}
+	}
+	// single-use credentials can only change the network status, so other commands don't take them
+	for _, args := range [][]string{{"user", "list", "--unlock-code"}, {"exam", "end", "--remote-unlock"}, {"lockout", "clear", "--unlock-code"}} {
+		if _, err = parser.Parse(args); err == nil || !strings.Contains(err.Error(), "unknown flag") {
+			t.Errorf("%v error: want: unknown flag, have: %v", args, err)
+		}
+	}
+}
+
+func TestServerRemoteUnlock(t *testing.T) {
+	clk := useFakeClock(t)
+	backend := NewSimBackend(testAdapters()...)
+	client, stop := newTestServer(t, backend)
+	defer stop()
+
+	if _, _, err := client.RemoteChallenge(); !errors.Is(err, errRemoteUnlockDisabled) {
+		t.Errorf("disabled challenge error: want: %v, have: %v", errRemoteUnlockDisabled, err)
+	}
+
+	secret, _ := newMasterSecret()
+	master, _ := base64.StdEncoding.DecodeString(secret)
+	if err := client.SetupRemoteUnlock(credentials{Password: "password"}, master); err != nil {
+		t.Fatalf("setup error: want: nil, have: %v", err)
+	}
+
+	challenge, expires, err := client.RemoteChallenge()
+	if err != nil {
+		t.Fatalf("challenge error: want: nil, have: %v", err)
+	}
+	if machine, _, _ := splitChallenge(challenge); machine != machineID() || until(expires) != remoteUnlockTTL {
+		t.Errorf("challenge: want: %s-..., have: %s expiring %v", machineID(), challenge, expires)
+	}
+
+	// IT derives the response from the master secret and the machine ID in the challenge
+	machine, _, _ := splitChallenge(challenge)
+	resp := remoteResponse(deriveMachineKey(master, machine), challenge)
+	if err = setStatus(client, &request{RemoteUnlock: &remoteUnlock{Challenge: challenge, Response: strings.ToLower(resp)}, Enabled: true}); err != nil {
+		t.Fatalf("remote unlock error: want: nil, have: %v", err)
+	}
+	if err = setStatus(client, &request{RemoteUnlock: &remoteUnlock{Challenge: challenge, Response: resp}}); !errors.Is(err, errUnauthorized) {
+		t.Errorf("reused challenge error: want: %v, have: %v", errUnauthorized, err)
+	}
+
+	// each peer can only be issued a challenge every remoteChallengeInterval
+	if _, _, err = client.RemoteChallenge(); !errors.Is(err, errChallengeRate) {
+		t.Errorf("rate limited challenge error: want: %v, have: %v", errChallengeRate, err)
+	}
+	clk.Advance(remoteChallengeInterval)
+
+	// a successful unlock resets failures
+	challenge, _, _ = client.RemoteChallenge()
+	resp = remoteResponse(deriveMachineKey(master, machine), challenge)
+	if err = setStatus(client, &request{RemoteUnlock: &remoteUnlock{Challenge: challenge, Response: resp}, Enabled: true}); err != nil {
+		t.Fatalf("second remote unlock error: want: nil, have: %v", err)
+	}
+
+	// a wrong response uses up the challenge
+	clk.Advance(remoteChallengeInterval)
+	challenge, _, _ = client.RemoteChallenge()
+	setStatus(client, &request{RemoteUnlock: &remoteUnlock{Challenge: challenge, Response: "AAAA-AAAA"}})
+	resp = remoteResponse(deriveMachineKey(master, machine), challenge)
+	if err = setStatus(client, &request{RemoteUnlock: &remoteUnlock{Challenge: challenge, Response: resp}}); !errors.Is(err, errUnauthorized) {
+		t.Errorf("challenge after wrong response error: want: %v, have: %v", errUnauthorized, err)
+	}
+
+	// when the table is full, the oldest challenge is dropped instead of refusing new ones
+	c := newRemoteChallenges()
+	var first string
+	for i := 0; i <= maxRemoteChallenges; i++ {
+		clk.Advance(time.Second)
+		ch, err := c.issue(machineID(), &Peer{UID: strconv.Itoa(i)})
+		if err != nil {
+			t.Fatalf("challenge %d error: want: nil, have: %v", i, err)
+		}
+		if i == 0 {
+			first = ch
+		}
+	}
+	if _, nonce, _ := splitChallenge(first); len(c.pending) != maxRemoteChallenges || c.consume(nonce) {
+		t.Errorf("full challenges: want: %d without the first, have: %d", maxRemoteChallenges, len(c.pending))
+	}
+}
+
+func TestServerTwoPerson(t *testing.T) {
+	backend := NewSimBackend(testAdapters()...)
+	client, stop := newTestServerConfig(t, backend, &Config{SharedPasswordRole: RoleAdmin})
+	defer stop()
+
+	for _, name := range []string{"coach", "coach2"} {
+		if _, err := client.ManageUsers(&userRequest{Password: "password", Action: userActionAdd, Name: name, Role: RoleCoach, NewPassword: name + "pass"}); err != nil {
+			t.Fatalf("add %s error: want: nil, have: %v", name, err)
+		}
+	}
+	if err := setStatus(client, &request{Password: "password"}); err != nil {
+		t.Fatalf("disable error: want: nil, have: %v", err)
+	}
+	stop()
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("load config error: want: nil, have: %v", err)
+	}
+	config.TwoPersonEnable = true
+	if err = config.Save(configPath); err != nil {
+		t.Fatalf("save config error: want: nil, have: %v", err)
+	}
+	stop = startTestServer(t, backend)
+
+	resp, err := client.SetStatus(&request{Username: "coach", Password: "coachpass", Enabled: true})
+	if err != nil || resp.Pending == nil || resp.Pending.User != "coach" {
+		t.Fatalf("first approval: want: pending by coach, have: %v, %v", resp, err)
+	}
+	if adapters, _ := backend.List(); adapters[0].Enabled() {
+		t.Errorf("status after first approval: want: Ethernet disabled, have: %v", adapters[0])
+	}
+	if st, _ := client.Status(); st.Approval == nil || st.Approval.User != "coach" {
+		t.Errorf("status approval: want: coach, have: %v", st.Approval)
+	}
+
+	// the same user can't approve twice
+	if resp, err = client.SetStatus(&request{Username: "COACH", Password: "coachpass", Enabled: true}); err != nil || resp.Pending == nil {
+		t.Errorf("same user approval: want: pending, have: %v, %v", resp, err)
+	}
+	// a different request replaces the approval
+	if resp, err = client.SetStatus(&request{Username: "coach2", Password: "coach2pass", Enabled: true, Force: true}); err != nil || resp.Pending == nil || resp.Pending.User != "coach2" {
+		t.Errorf("different request approval: want: pending by coach2, have: %v, %v", resp, err)
+	}
+
+	// only named users can request or approve, so the shared password and single-use credentials can't
+	if _, err = client.SetStatus(&request{Password: "password", Enabled: true, Force: true}); !errors.Is(err, errForbidden) {
+		t.Errorf("shared password approval error: want: %v, have: %v", errForbidden, err)
+	}
+	id, codes, _ := generateUnlockCodes(1)
+	hashes := []string{""}
+	hashes[0], _ = newHash(codes[0])
+	if _, err = client.ManageUnlockCodes(&unlockCodesRequest{Password: "password", Action: unlockActionGenerate, Batch: id, Role: RoleCoach, Hashes: hashes}); err != nil {
+		t.Fatalf("add batch error: want: nil, have: %v", err)
+	}
+	if _, err = client.SetStatus(&request{UnlockCode: codes[0], Enabled: true, Force: true}); !errors.Is(err, errForbidden) {
+		t.Errorf("unlock code approval error: want: %v, have: %v", errForbidden, err)
+	}
+	if st, _ := client.Status(); st.Approval == nil || st.Approval.User != "coach2" {
+		t.Errorf("approval after rejected approvers: want: coach2, have: %v", st.Approval)
+	}
+
+	if resp, err = client.SetStatus(&request{Username: "coach", Password: "coachpass", Enabled: true, Force: true}); err != nil || resp.Pending != nil {
+		t.Fatalf("second approval: want: enabled, have: %v, %v", resp, err)
+	}
+	if adapters, _ := backend.List(); !adapters[0].Enabled() {
+		t.Errorf("status after second approval: want: Ethernet enabled, have: %v", adapters[0])
+	}
+	st, _ := client.Status()
+	if st.Approval != nil || st.LastChange == nil || st.LastChange.User != "coach" || len(st.LastChange.Approvers) != 1 || st.LastChange.Approvers[0] != "coach2" {
+		t.Errorf("last change: want: coach approved by coach2, have: %v, %v", st.LastChange, st.Approval)
+	}
+
+	// disabling only needs one person
+	if resp, err = client.SetStatus(&request{Username: "coach", Password: "coachpass"}); err != nil || resp.Pending != nil {
+		t.Errorf("disable: want: disabled, have: %v, %v", resp, err)
+	}
+
+	// an exam started while the network is locked leaves it locked, so it only needs one person to start or end
+	if resp, err = client.Exam(&examRequest{Username: "coach", Password: "coachpass", Action: examActionStart, Name: "Chemistry", End: time.Now().Add(time.Hour)}); err != nil || resp.Pending != nil || resp.Exam == nil {
+		t.Fatalf("locked exam start: want: started, have: %v, %v", resp, err)
+	}
+	if resp, err = client.Exam(&examRequest{Username: "coach", Password: "coachpass", Action: examActionEnd}); err != nil || resp.Pending != nil {
+		t.Fatalf("locked exam end: want: ended, have: %v, %v", resp, err)
+	}
+	if adapters, _ := backend.List(); adapters[0].Enabled() {
+		t.Errorf("status after locked exam: want: Ethernet disabled, have: %v", adapters[0])
+	}
+
+	// an exam started while the network is unlocked enables it when it ends, so scheduling it needs two people
+	for _, name := range []string{"coach", "coach2"} {
+		if _, err = client.SetStatus(&request{Username: name, Password: name + "pass", Enabled: true}); err != nil {
+			t.Fatalf("enable error: want: nil, have: %v", err)
+		}
+	}
+	exam := &examRequest{Username: "coach", Password: "coachpass", Action: examActionStart, Name: "Physics", End: time.Now().Add(time.Hour)}
+	if resp, err = client.Exam(exam); err != nil || resp.Pending == nil || resp.Pending.User != "coach" {
+		t.Fatalf("unlocked exam first approval: want: pending by coach, have: %v, %v", resp, err)
+	}
+	if st, _ = client.Status(); st.Exam != nil {
+		t.Errorf("status after first approval: want: no exam, have: %v", st.Exam)
+	}
+	exam.Username, exam.Password = "coach2", "coach2pass"
+	if resp, err = client.Exam(exam); err != nil || resp.Pending != nil || resp.Exam == nil {
+		t.Fatalf("unlocked exam second approval: want: started, have: %v, %v", resp, err)
+	}
+	if resp.Exam.WasLocked || len(resp.Exam.Approvers) != 1 || resp.Exam.Approvers[0] != "coach" {
+		t.Errorf("unlocked exam: want: unlocked, approved by coach, have: %v, %v", resp.Exam.WasLocked, resp.Exam.Approvers)
+	}
+}
+
+func TestServerReason(t *testing.T) {
+	backend := NewSimBackend(testAdapters()...)
+	client, stop := newTestServer(t, backend)
+	defer stop()
+
+	if err := setStatus(client, &request{Password: "password", Reason: "  contest started  "}); err != nil {
+		t.Fatalf("disable error: want: nil, have: %v", err)
+	}
+	if st, _ := client.Status(); st.LastChange == nil || st.LastChange.Reason != "contest started" || st.ReasonRequired {
+		t.Errorf("last change reason: want: contest started, have: %v", st.LastChange)
+	}
+
+	stop()
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("load config error: want: nil, have: %v", err)
+	}
+	config.RequireReason = true
+	config.ReasonCategories = []string{"Contest end", "Technical issue"}
+	if err = config.Save(configPath); err != nil {
+		t.Fatalf("save config error: want: nil, have: %v", err)
+	}
+	stop = startTestServer(t, backend)
+
+	if err = setStatus(client, &request{Password: "password", Enabled: true}); err == nil || !strings.Contains(err.Error(), "reason is required") {
+		t.Errorf("missing reason error: want: reason is required, have: %v", err)
+	}
+	if err = setStatus(client, &request{Password: "password", Enabled: true, Reason: "router down"}); err == nil || !strings.Contains(err.Error(), "category is required") {
+		t.Errorf("missing category error: want: category is required, have: %v", err)
+	}
+	if err = setStatus(client, &request{Password: "password", Enabled: true, Reason: "router down", Category: "other"}); err == nil || !strings.Contains(err.Error(), "unknown category") {
+		t.Errorf("unknown category error: want: unknown category, have: %v", err)
+	}
+	if err = setStatus(client, &request{Password: "password", Enabled: true, Reason: "router down", Category: "technical ISSUE"}); err != nil {
+		t.Fatalf("enable error: want: nil, have: %v", err)
+	}
+
+	st, _ := client.Status()
+	if !st.ReasonRequired || len(st.ReasonCategories) != 2 {
+		t.Errorf("reason policy: want: required with 2 categories, have: %v, %v", st.ReasonRequired, st.ReasonCategories)
+	}
+	if st.LastChange == nil || st.LastChange.Reason != "router down" || st.LastChange.Category != "Technical issue" {
+		t.Errorf("last change reason: want: router down [Technical issue], have: %v", st.LastChange)
+	}
+}
+
+func TestServerPeerRules(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are only tested on linux")
+	}
+	me, err := user.Current()
+	if err != nil {
+		t.Fatalf("current user error: want: nil, have: %v", err)
+	}
+
+	backend := NewSimBackend(testAdapters()...)
+	client, stop := newTestServer(t, backend)
+	defer stop()
+
+	st, err := client.Status()
+	if err != nil {
+		t.Fatalf("status error: want: nil, have: %v", err)
+	}
+	if st.Peer == nil || st.Peer.UID != me.Uid || st.Peer.User != me.Username || st.Peer.PID != os.Getpid() {
+		t.Fatalf("peer: want: %s (uid %s, pid %d), have: %v", me.Username, me.Uid, os.Getpid(), st.Peer)
+	}
+
+	stop()
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("load config error: want: nil, have: %v", err)
+	}
+	config.PeerRules = []*PeerRule{{Effect: "deny", Actions: []action{actionEnable}, Interactive: new(bool)}}
+	if err = config.Save(configPath); err != nil {
+		t.Fatalf("save config error: want: nil, have: %v", err)
+	}
+	stop = startTestServer(t, backend)
+
+	if err = setStatus(client, &request{Password: "password"}); err != nil {
+		t.Fatalf("disable error: want: nil, have: %v", err)
+	}
+	if err = setStatus(client, &request{Password: "password", Enabled: true}); err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Errorf("non-interactive enable error: want: not allowed, have: %v", err)
+	}
+	if st, _ := client.Status(); !st.Locked {
+		t.Errorf("locked: want: true, have: false")
+	}
+
+	stop()
+	config.PeerRules = []*PeerRule{
+		{Effect: "allow", User: "nobody"},
+		{Effect: "deny", User: me.Username},
+	}
+	if err = config.Save(configPath); err != nil {
+		t.Fatalf("save config error: want: nil, have: %v", err)
+	}
+	stop = startTestServer(t, backend)
+
+	if err = setStatus(client, &request{Password: "password", Enabled: true}); err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Errorf("denied user error: want: not allowed, have: %v", err)
+	}
+	if _, err = client.Login(credentials{Password: "password"}); err == nil {
+		t.Errorf("denied user login error: want: not allowed, have: nil")
+	}
+
+	stop()
+	config.PeerRules = []*PeerRule{{Effect: "block"}}
+	if err = config.Save(configPath); err != nil {
+		t.Fatalf("save config error: want: nil, have: %v", err)
+	}
+	if _, err = LoadConfig(configPath); !errors.Is(err, errInvalidPeerRule) {
+		t.Errorf("invalid rule error: want: %v, have: %v", errInvalidPeerRule, err)
+	}
+}
+
+func TestServerAudit(t *testing.T) {
+	backend := NewSimBackend(testAdapters()...)
+	client, stop := newTestServer(t, backend)
+	defer stop()
+
+	if err := setStatus(client, &request{Password: "bad"}); !errors.Is(err, errUnauthorized) {
+		t.Fatalf("bad password error: want: %v, have: %v", errUnauthorized, err)
+	}
+	if err := setStatus(client, &request{Password: "password", Reason: "exam started"}); err != nil {
+		t.Fatalf("disable error: want: nil, have: %v", err)
+	}
+	if err := backend.Enable("Ethernet"); err != nil {
+		t.Fatalf("enable error: want: nil, have: %v", err)
+	}
+	waitFor(t, "reconcile to be audited", func() bool {
+		buf, _ := os.ReadFile(auditPath)
+		return bytes.Contains(buf, []byte(`"event":"reconcile"`))
+	})
+	stop()
+
+	summary, err := VerifyAudit(auditPath, testAuditKey(t))
+	if err != nil {
+		t.Fatalf("verify error: want: nil, have: %v", err)
+	}
+
+	buf, err := os.ReadFile(auditPath)
+	if err != nil {
+		t.Fatalf("read audit error: want: nil, have: %v", err)
+	}
+	lines := strings.SplitAfter(string(buf), "\n")
+	lines = lines[:len(lines)-1]
+	if uint64(len(lines)) != summary.Records {
+		t.Fatalf("records: want: %d, have: %d", len(lines), summary.Records)
+	}
+
+	var failed, disabled, reconciled bool
+	for _, line := range lines {
+		rec := new(AuditRecord)
+		if err = json.Unmarshal([]byte(line), rec); err != nil {
+			t.Fatalf("decode record error: want: nil, have: %v", err)
+		}
+		if rec.Event == auditAuth && rec.Outcome == auditFailure && rec.User == sharedPasswordUser && rec.Method == "password" {
+			failed = true
+		}
+		if rec.Event == auditChange && rec.Action == "disable" && rec.Outcome == auditSuccess && rec.Change != nil && rec.Change.Reason == "exam started" {
+			disabled = true
+		}
+		if rec.Event == auditReconcile && rec.Outcome == auditSuccess && len(rec.Adapters) == 1 && rec.Adapters[0] == "Ethernet" {
+			reconciled = true
+		}
+	}
+	if !failed || !disabled || !reconciled {
+		t.Errorf("records: want: failed auth, disable, and reconcile, have: failed: %v, disabled: %v, reconciled: %v", failed, disabled, reconciled)
+	}
+
+	tests := []struct {
+		name  string
+		lines func() []string
+	}{
+		{"edit", func() []string {
+			edited := append([]string(nil), lines...)
+			edited[1] = strings.Replace(edited[1], `"outcome":"failure"`, `"outcome":"success"`, 1)
+			return edited
+		}},
+		{"edit last", func() []string {
+			edited := append([]string(nil), lines...)
+			edited[len(edited)-1] = strings.Replace(edited[len(edited)-1], `"stop"`, `"start"`, 1)
+			return edited
+		}},
+		{"truncate", func() []string { return lines[:len(lines)-1] }},
+		{"reorder", func() []string {
+			reordered := append([]string(nil), lines...)
+			reordered[1], reordered[2] = reordered[2], reordered[1]
+			return reordered
+		}},
+		{"remove first", func() []string { return lines[1:] }},
+	}
+	for _, test := range tests {
+		if err = os.WriteFile(auditPath, []byte(strings.Join(test.lines(), "")), 0600); err != nil {
+			t.Fatalf("write audit error: want: nil, have: %v", err)
+		}
+		if _, err = VerifyAudit(auditPath, testAuditKey(t)); !errors.Is(err, errAuditTampered) {
+			t.Errorf("%s verify error: want: %v, have: %v", test.name, errAuditTampered, err)
+		}
+	}
+}
+
+func TestServerAuditStateError(t *testing.T) {
+	backend := NewSimBackend(testAdapters()...)
+	client, stop := newTestServer(t, backend)
+	defer stop()
+
+	// the state can't be saved over a directory, but the adapters still change
+	if err := os.RemoveAll(statePath); err != nil {
+		t.Fatalf("remove state error: want: nil, have: %v", err)
+	}
+	if err := os.Mkdir(statePath, 0755); err != nil {
+		t.Fatalf("mkdir error: want: nil, have: %v", err)
+	}
+	if err := setStatus(client, &request{Password: "password", Reason: "exam started"}); err == nil {
+		t.Fatalf("disable error: want: error, have: nil")
+	}
+	stop()
+
+	var rec *AuditRecord
+	if _, err := readAudit(auditPath, keyedChain(testAuditKey(t)), func(r *AuditRecord) error {
+		if r.Event == auditChange {
+			rec = r
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("read audit error: want: nil, have: %v", err)
+	}
+	if rec == nil || rec.Outcome != auditPartial || rec.Change == nil || rec.Change.Reason != "exam started" || len(rec.Change.Changed) == 0 {
+		t.Errorf("change record: want: partial with change, have: %+v", rec)
+	}
+}
+
+func TestServerAuditChain(t *testing.T) {
+	backend := NewSimBackend(testAdapters()...)
+	client, stop := newTestServer(t, backend)
+	if err := setStatus(client, &request{Password: "password", Reason: "exam started"}); err != nil {
+		t.Fatalf("disable error: want: nil, have: %v", err)
+	}
+	stop()
+
+	if _, err := VerifyAudit(auditPath, testAuditKey(t)); err != nil {
+		t.Fatalf("verify error: want: nil, have: %v", err)
+	}
+	// the chain can't be checked, or recomputed, without the key
+	if _, err := VerifyAudit(auditPath, make([]byte, auditKeyLen)); !errors.Is(err, errAuditTampered) {
+		t.Errorf("other key verify error: want: %v, have: %v", errAuditTampered, err)
+	}
+
+	// a log that doesn't match its head isn't appended to
+	buf, err := os.ReadFile(auditPath)
+	if err != nil {
+		t.Fatalf("read audit error: want: nil, have: %v", err)
+	}
+	lines := strings.SplitAfter(string(buf), "\n")
+	tampered := []byte(strings.Join(lines[1:], ""))
+	if err = os.WriteFile(auditPath, tampered, 0600); err != nil {
+		t.Fatalf("write audit error: want: nil, have: %v", err)
+	}
+	stop = startTestServer(t, backend)
+	defer stop()
+	if err = setStatus(client, &request{Password: "password", Enabled: true}); err != nil {
+		t.Fatalf("enable error: want: nil, have: %v", err)
+	}
+	if buf, err = os.ReadFile(auditPath); err != nil || !bytes.Equal(buf, tampered) {
+		t.Errorf("tampered log: want: unchanged, have: %d bytes, %v", len(buf), err)
+	}
+}
+
+func TestServerAttest(t *testing.T) {
+	backend := NewSimBackend(testAdapters()...)
+	client, stop := newTestServer(t, backend)
+	defer stop()
+
+	// the service start is audited before it serves requests
+	if _, err := client.Status(); err != nil {
+		t.Fatalf("status error: want: nil, have: %v", err)
+	}
+	from := time.Now()
+	if err := setStatus(client, &request{Password: "password", Reason: "exam started"}); err != nil {
+		t.Fatalf("disable error: want: nil, have: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	// an adapter enabled while locked unlocks the network
+	if err := setStatus(client, &request{Password: "password", Enabled: true, Adapters: []string{"Ethernet"}, Reason: "download"}); err != nil {
+		t.Fatalf("enable adapter error: want: nil, have: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := setStatus(client, &request{Password: "password", Adapters: []string{"ethernet"}}); err != nil {
+		t.Fatalf("disable adapter error: want: nil, have: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := setStatus(client, &request{Password: "password", Enabled: true}); err != nil {
+		t.Fatalf("enable error: want: nil, have: %v", err)
+	}
+	stop()
+	to := time.Now()
+
+	a, err := newAttestation(auditPath, testAuditKey(t), from, to)
+	if err != nil {
+		t.Fatalf("attestation error: want: nil, have: %v", err)
+	}
+	if len(a.Periods) != 5 || a.Periods[0].Locked || !a.Periods[1].Locked || a.Periods[1].Reason != "exam started" ||
+		a.Periods[2].Locked || a.Periods[2].Reason != "download" || !a.Periods[3].Locked || a.Periods[4].Locked {
+		t.Fatalf("periods: want: unlocked, locked, unlocked, locked, unlocked, have: %d periods", len(a.Periods))
+	}
+	if unlocked := to.Sub(from) - a.Periods[1].Duration() - a.Periods[3].Duration(); time.Duration(a.UnlockedSeconds)*time.Second != unlocked.Truncate(time.Second) {
+		t.Errorf("unlocked: want: %v, have: %ds", unlocked, a.UnlockedSeconds)
+	}
+	// four changes and service stop
+	if len(a.Events) != 5 {
+		t.Errorf("events: want: 5, have: %d", len(a.Events))
+	}
+
+	dir := t.TempDir()
+	if _, err = newAttestKey(filepath.Join(dir, "attest.key"), filepath.Join(dir, "attest.pub")); err != nil {
+		t.Fatalf("create key error: want: nil, have: %v", err)
+	}
+	key, err := loadAttestKey(filepath.Join(dir, "attest.key"))
+	if err != nil {
+		t.Fatalf("load key error: want: nil, have: %v", err)
+	}
+	pub, err := readAttestPublicKey(filepath.Join(dir, "attest.pub"))
+	if err != nil {
+		t.Fatalf("read public key error: want: nil, have: %v", err)
+	}
+
+	signed, err := signAttestation(a, key)
+	if err != nil {
+		t.Fatalf("sign error: want: nil, have: %v", err)
+	}
+	buf, err := json.MarshalIndent(signed, "", "    ")
+	if err != nil {
+		t.Fatalf("encode error: want: nil, have: %v", err)
+	}
+
+	verified, err := VerifyAttestation(buf, pub)
+	if err != nil {
+		t.Fatalf("verify error: want: nil, have: %v", err)
+	}
+	if verified.UnlockedSeconds != a.UnlockedSeconds || len(verified.Periods) != 5 {
+		t.Errorf("verified statement: want: %d periods, have: %d", len(a.Periods), len(verified.Periods))
+	}
+
+	tampered := bytes.Replace(buf, []byte(`"locked": true`), []byte(`"locked": false`), 1)
+	if _, err = VerifyAttestation(tampered, pub); !errors.Is(err, errInvalidAttestation) {
+		t.Errorf("tampered verify error: want: %v, have: %v", errInvalidAttestation, err)
+	}
+
+	other, _, _ := ed25519.GenerateKey(nil)
+	if _, err = VerifyAttestation(buf, other); !errors.Is(err, errInvalidAttestation) {
+		t.Errorf("other key verify error: want: %v, have: %v", errInvalidAttestation, err)
+	}
+}
+
+func TestAuditLogRead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := openAudit(path, []byte("key"))
+	if err != nil {
+		t.Fatalf("open error: want: nil, have: %v", err)
+	}
+	defer l.Close()
+
+	n := 3 * auditIndexInterval
+	for i := 0; i < n; i++ {
+		if err = l.Append(&AuditRecord{Event: auditService, Action: "test", Outcome: auditSuccess}); err != nil {
+			t.Fatalf("append error: want: nil, have: %v", err)
+		}
+	}
+	if len(l.index) != 2 {
+		t.Errorf("index: want: 2 marks, have: %d", len(l.index))
+	}
+
+	// a page is read from the nearest mark
+	var seqs []uint64
+	if err = l.Read(uint64(n-100), func(rec *AuditRecord) error {
+		seqs = append(seqs, rec.Seq)
+		return nil
+	}); err != nil {
+		t.Fatalf("read error: want: nil, have: %v", err)
+	}
+	if len(seqs) != 100 || seqs[0] != uint64(n-99) || seqs[99] != uint64(n) {
+		t.Errorf("records: want: %d to %d, have: %d records", n-99, n, len(seqs))
+	}
+
+	// appends don't wait for reading
+	if err = l.Read(0, func(rec *AuditRecord) error {
+		if err := l.Append(&AuditRecord{Event: auditService, Action: "test", Outcome: auditSuccess}); err != nil {
+			t.Errorf("append while reading error: want: nil, have: %v", err)
+		}
+		return errStopAudit
+	}); err != nil {
+		t.Fatalf("read error: want: nil, have: %v", err)
+	}
+
+	var count int
+	if err = l.Read(0, func(rec *AuditRecord) error {
+		count++
+		return nil
+	}); err != nil {
+		t.Fatalf("read error: want: nil, have: %v", err)
+	}
+	if count != n+1 {
+		t.Errorf("records: want: %d, have: %d", n+1, count)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat error: want: nil, have: %v", err)
+	}
+	if err = os.Truncate(path, info.Size()-10); err != nil {
+		t.Fatalf("truncate error: want: nil, have: %v", err)
+	}
+	if err = l.Read(uint64(n-10), func(rec *AuditRecord) error { return nil }); !errors.Is(err, errAuditTampered) {
+		t.Errorf("truncated read error: want: %v, have: %v", errAuditTampered, err)
+	}
+}
+
+func TestServerAuditList(t *testing.T) {
+	backend := NewSimBackend(testAdapters()...)
+	client, stop := newTestServerConfig(t, backend, &Config{SharedPasswordRole: RoleAdmin})
+	defer stop()
+
+	if _, err := client.ManageUsers(&userRequest{Password: "password", Action: userActionAdd, Name: "coach", Role: RoleCoach, NewPassword: "coachpass"}); err != nil {
+		t.Fatalf("add coach error: want: nil, have: %v", err)
+	}
+	if err := setStatus(client, &request{Username: "coach", Password: "bad"}); !errors.Is(err, errUnauthorized) {
+		t.Fatalf("bad password error: want: %v, have: %v", errUnauthorized, err)
+	}
+	for _, enabled := range []bool{false, true, false} {
+		if err := setStatus(client, &request{Username: "coach", Password: "coachpass", Enabled: enabled}); err != nil {
+			t.Fatalf("set status error: want: nil, have: %v", err)
+		}
+	}
+
+	admin := credentials{Password: "password"}
+	if _, err := client.Audit(credentials{Username: "coach", Password: "coachpass"}, &auditFilter{}); !errors.Is(err, errForbidden) {
+		t.Errorf("coach audit error: want: %v, have: %v", errForbidden, err)
+	}
+	if _, err := client.Audit(credentials{Password: "bad"}, &auditFilter{}); !errors.Is(err, errUnauthorized) {
+		t.Errorf("bad password audit error: want: %v, have: %v", errUnauthorized, err)
+	}
+	if _, err := client.Audit(admin, &auditFilter{Limit: maxAuditLimit + 1}); err == nil || !strings.Contains(err.Error(), "invalid limit") {
+		t.Errorf("invalid limit error: want: invalid limit, have: %v", err)
+	}
+
+	page, err := client.Audit(admin, &auditFilter{Event: auditChange, User: "COACH"})
+	if err != nil {
+		t.Fatalf("audit error: want: nil, have: %v", err)
+	}
+	if len(page.Records) != 3 || page.Records[1].Action != "enable" || page.Next != 0 {
+		t.Fatalf("changes: want: 3, have: %d", len(page.Records))
+	}
+
+	page, err = client.Audit(admin, &auditFilter{Event: auditAuth, User: "coach", Outcome: auditFailure})
+	if err != nil {
+		t.Fatalf("audit error: want: nil, have: %v", err)
+	}
+	if len(page.Records) != 1 || page.Records[0].Action != "disable" {
+		t.Errorf("failed auth: want: 1, have: %d", len(page.Records))
+	}
+
+	// page through the changes two at a time
+	var seqs []uint64
+	f := &auditFilter{Event: auditChange, Limit: 2}
+	for {
+		page, err = client.Audit(admin, f)
+		if err != nil {
+			t.Fatalf("audit error: want: nil, have: %v", err)
+		}
+		for _, rec := range page.Records {
+			seqs = append(seqs, rec.Seq)
+		}
+		if page.Next == 0 {
+			break
+		}
+		f.After = page.Next
+	}
+	if len(seqs) != 3 || seqs[0] >= seqs[1] || seqs[1] >= seqs[2] {
+		t.Errorf("paged changes: want: 3 in order, have: %v", seqs)
+	}
+
+	page, err = client.Audit(admin, &auditFilter{Event: auditChange, From: time.Now().Add(time.Minute)})
+	if err != nil || len(page.Records) != 0 {
+		t.Errorf("future changes: want: 0, have: %v, %v", page, err)
+	}
+
+	if _, err = client.Login(admin); err != nil {
+		t.Fatalf("login error: want: nil, have: %v", err)
+	}
+	page, err = client.Audit(credentials{}, &auditFilter{Event: auditChange})
+	if err != nil {
+		t.Fatalf("session audit error: want: nil, have: %v", err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err = writeAuditRecords(buf, auditFormatCSV, page.Records); err != nil {
+		t.Fatalf("write csv error: want: nil, have: %v", err)
+	}
+	if lines := strings.Split(strings.TrimSpace(buf.String()), "\n"); len(lines) != 4 || !strings.HasPrefix(lines[0], "seq,time,event") {
+		t.Errorf("csv: want: header and 3 records, have: %q", buf.String())
+	}
+}
+
+func TestServerReport(t *testing.T) {
+	backend := NewSimBackend(testAdapters()...)
+	client, stop := newTestServer(t, backend)
+	defer stop()
+
+	from := time.Now()
+	if err := setStatus(client, &request{Password: "password", Reason: "exam started"}); err != nil {
+		t.Fatalf("disable error: want: nil, have: %v", err)
+	}
+	if err := setStatus(client, &request{Password: "bad", Enabled: true}); !errors.Is(err, errUnauthorized) {
+		t.Fatalf("bad password error: want: %v, have: %v", errUnauthorized, err)
+	}
+	if err := backend.Enable("Ethernet"); err != nil {
+		t.Fatalf("enable error: want: nil, have: %v", err)
+	}
+	waitFor(t, "reconcile to be audited", func() bool {
+		buf, _ := os.ReadFile(auditPath)
+		return bytes.Contains(buf, []byte(`"event":"reconcile"`))
+	})
+	if err := setStatus(client, &request{Password: "password", Enabled: true, Reason: "printer <driver> update"}); err != nil {
+		t.Fatalf("enable error: want: nil, have: %v", err)
+	}
+	to := time.Now()
+
+	status, err := client.Status()
+	if err != nil {
+		t.Fatalf("status error: want: nil, have: %v", err)
+	}
+	records, err := fetchAudit(client, credentials{Password: "password"}, &auditFilter{To: to}, 0)
+	if err != nil {
+		t.Fatalf("fetch audit error: want: nil, have: %v", err)
+	}
+	if client.Session() != nil {
+		t.Errorf("session: want: signed out, have: %v", client.Session())
+	}
+
+	r := newReport(records, status, from, to)
+	if len(r.Periods) != 3 || len(r.Unlocks) != 1 || len(r.FailedAuth) != 1 || len(r.Enforcements) != 1 {
+		t.Fatalf("report: want: 3 periods, 1 unlock, 1 failed, 1 enforcement, have: %d, %d, %d, %d",
+			len(r.Periods), len(r.Unlocks), len(r.FailedAuth), len(r.Enforcements))
+	}
+
+	buf := new(bytes.Buffer)
+	if err = writeReport(buf, reportFormatText, "", r); err != nil {
+		t.Fatalf("text report error: want: nil, have: %v", err)
+	}
+	for _, want := range []string{"Total time online:", "Failed Sign In Attempts (1)", "Enforcement Actions (1)", ": printer <driver> update"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("text report: want: %q, have: %q", want, buf.String())
+		}
+	}
+
+	buf.Reset()
+	if err = writeReport(buf, reportFormatHTML, "", r); err != nil {
+		t.Fatalf("html report error: want: nil, have: %v", err)
+	}
+	if !strings.Contains(buf.String(), "printer &lt;driver&gt; update") {
+		t.Errorf("html report: want: escaped reason, have: %q", buf.String())
+	}
+
+	// the current status is described from the adapters, so adapters enabled while locked aren't hidden
+	r.Status = &statusResponse{Locked: true, Adapters: status.Adapters}
+	for _, format := range []string{reportFormatText, reportFormatHTML} {
+		buf.Reset()
+		if err = writeReport(buf, format, "", r); err != nil {
+			t.Fatalf("%s report error: want: nil, have: %v", format, err)
+		}
+		if want := "Network: " + r.Status.Network(); !strings.Contains(buf.String(), want) || r.Status.Network() == "Disabled (locked)" {
+			t.Errorf("%s report status: want: %q, have: %q", format, want, buf.String())
+		}
+	}
+
+	tmpl := filepath.Join(t.TempDir(), "report.tmpl")
+	if err = os.WriteFile(tmpl, []byte(`{{.Machine}} online {{.Unlocked | duration}}`), 0644); err != nil {
+		t.Fatalf("write template error: want: nil, have: %v", err)
+	}
+	buf.Reset()
+	if err = writeReport(buf, reportFormatText, tmpl, r); err != nil {
+		t.Fatalf("custom report error: want: nil, have: %v", err)
+	}
+	if want := machineID() + " online " + r.Unlocked.Round(time.Second).String(); buf.String() != want {
+		t.Errorf("custom report: want: %q, have: %q", want, buf.String())
+	}
+}
+
+func TestServerExam(t *testing.T) {
+	clk := useFakeClock(t)
+	backend := NewSimBackend(testAdapters()...)
+	client, stop := newTestServer(t, backend)
+	defer stop()
+
+	ethernetEnabled := func() bool {
+		adapters, _ := backend.List()
+		return adapters[0].Enabled()
+	}
+
+	now := clk.Now()
+	if _, err := client.Exam(&examRequest{Password: "password", Action: examActionStart, Name: "Regional Math 2026", End: now.Add(-time.Minute)}); err == nil || !strings.Contains(err.Error(), "invalid exam") {
+		t.Errorf("end in past error: want: invalid exam, have: %v", err)
+	}
+
+	resp, err := client.Exam(&examRequest{
+		Password: "password", Action: examActionStart, Name: "Regional Math 2026", Notes: "room 4",
+		Start: now.Add(time.Hour), End: now.Add(3 * time.Hour),
+	})
+	if err != nil {
+		t.Fatalf("schedule error: want: nil, have: %v", err)
+	}
+	exam := resp.Exam
+	if exam == nil || exam.ID == "" || exam.Owner != sharedPasswordUser || exam.Started != nil {
+		t.Fatalf("scheduled exam: want: scheduled exam, have: %v", exam)
+	}
+	if !ethernetEnabled() {
+		t.Errorf("status before exam: want: Ethernet enabled, have: disabled")
+	}
+
+	if _, err = client.Exam(&examRequest{Password: "password", Action: examActionStart, Name: "Science", End: now.Add(time.Hour)}); err == nil || !strings.Contains(err.Error(), "already scheduled") {
+		t.Errorf("second exam error: want: already scheduled, have: %v", err)
+	}
+
+	// the exam should survive a restart
+	stop()
+	stop = startTestServer(t, backend)
+
+	// the exam is resumed before requests are served
+	if _, err = client.Status(); err != nil {
+		t.Fatalf("status error: want: nil, have: %v", err)
+	}
+	clk.Advance(time.Hour)
+	if ethernetEnabled() {
+		t.Errorf("status during exam: want: Ethernet disabled, have: enabled")
+	}
+	st, err := client.Status()
+	if err != nil {
+		t.Fatalf("status error: want: nil, have: %v", err)
+	}
+	if st.Exam == nil || st.Exam.ID != exam.ID || st.Exam.Started == nil {
+		t.Errorf("status during exam: want: %s started, have: %v", exam.ID, st.Exam)
+	}
+
+	clk.Advance(2 * time.Hour)
+	if !ethernetEnabled() {
+		t.Errorf("status after exam: want: Ethernet enabled, have: disabled")
+	}
+	if st, _ := LoadState(statePath); st.Exam != nil || st.Locked {
+		t.Errorf("state after exam: want: no exam and unlocked, have: %v, %v", st.Exam, st.Locked)
+	}
+
+	var actions []string
+	if _, err = readAudit(auditPath, keyedChain(testAuditKey(t)), func(rec *AuditRecord) error {
+		if rec.Event == auditExam {
+			actions = append(actions, rec.Action)
+		}
+		if (rec.Event == auditChange || rec.Event == auditExam) && rec.Exam != exam.ID {
+			t.Errorf("%s %s record exam: want: %s, have: %q", rec.Event, rec.Action, exam.ID, rec.Exam)
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("read audit error: want: nil, have: %v", err)
+	}
+	if have := strings.Join(actions, ","); have != "create,start,end" {
+		t.Errorf("exam records: want: create,start,end, have: %s", have)
+	}
+
+	// end an exam early
+	resp, err = client.Exam(&examRequest{Password: "password", Action: examActionStart, Name: "Science", End: clk.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("start error: want: nil, have: %v", err)
+	}
+	if ethernetEnabled() || resp.Exam.Started == nil {
+		t.Errorf("status after start: want: Ethernet disabled and exam started, have: %v, %v", ethernetEnabled(), resp.Exam)
+	}
+	if _, err = client.Exam(&examRequest{Password: "password", Action: examActionEnd, ID: exam.ID}); err == nil || !strings.Contains(err.Error(), "isn't scheduled") {
+		t.Errorf("end other exam error: want: isn't scheduled, have: %v", err)
+	}
+	if _, err = client.Exam(&examRequest{Password: "password", Action: examActionEnd, ID: resp.Exam.ID}); err != nil {
+		t.Fatalf("end error: want: nil, have: %v", err)
+	}
+	if !ethernetEnabled() {
+		t.Errorf("status after end: want: Ethernet enabled, have: disabled")
+	}
+	if st, err = client.Status(); err != nil {
+		t.Fatalf("status error: want: nil, have: %v", err)
+	}
+	if st.Exam != nil {
+		t.Errorf("status after end: want: no exam, have: %v", st.Exam)
+	}
+
+	// an exam started while the network is locked leaves it locked when it ends
+	if err = setStatus(client, &request{Password: "password", Reason: "lunch"}); err != nil {
+		t.Fatalf("disable error: want: nil, have: %v", err)
+	}
+	if resp, err = client.Exam(&examRequest{Password: "password", Action: examActionStart, Name: "Chemistry", End: clk.Now().Add(time.Hour)}); err != nil {
+		t.Fatalf("start error: want: nil, have: %v", err)
+	}
+	if !resp.Exam.WasLocked {
+		t.Errorf("exam started while locked: want: was locked, have: %v", resp.Exam)
+	}
+	clk.Advance(time.Hour)
+	if st, err = client.Status(); err != nil {
+		t.Fatalf("status error: want: nil, have: %v", err)
+	}
+	if st.Exam != nil || !st.Locked || ethernetEnabled() {
+		t.Errorf("status after exam: want: no exam and locked, have: %v, locked: %v, Ethernet enabled: %v", st.Exam, st.Locked, ethernetEnabled())
+	}
+
+	// an exam that can't be started isn't kept
+	if err = setStatus(client, &request{Password: "password", Enabled: true}); err != nil {
+		t.Fatalf("enable error: want: nil, have: %v", err)
+	}
+	backend.SetFault(func(op, name string) error {
+		if op != "list" {
+			return errors.New("access denied")
+		}
+		return nil
+	})
+	if _, err = client.Exam(&examRequest{Password: "password", Action: examActionStart, Name: "Physics", End: clk.Now().Add(time.Hour)}); err == nil {
+		t.Errorf("failed start error: want: error, have: nil")
+	}
+	if st, _ := LoadState(statePath); st.Exam != nil || st.Locked {
+		t.Errorf("state after failed start: want: no exam and unlocked, have: %v, %v", st.Exam, st.Locked)
+	}
+
+	// an exam that can't restore the network when it ends is kept and tried again
+	backend.SetFault(nil)
+	if resp, err = client.Exam(&examRequest{Password: "password", Action: examActionStart, Name: "Physics", End: clk.Now().Add(time.Hour)}); err != nil {
+		t.Fatalf("start error: want: nil, have: %v", err)
+	}
+	backend.SetFault(func(op, name string) error {
+		if op == "enable" {
+			return errors.New("access denied")
+		}
+		return nil
+	})
+	clk.Advance(time.Hour)
+	if st, _ := LoadState(statePath); st.Exam == nil || st.Exam.ID != resp.Exam.ID || ethernetEnabled() {
+		t.Errorf("state after failed end: want: %s kept and Ethernet disabled, have: %v, Ethernet enabled: %v", resp.Exam.ID, st.Exam, ethernetEnabled())
+	}
+	backend.SetFault(nil)
+	clk.Advance(examRetryInterval)
+	if st, _ := LoadState(statePath); st.Exam != nil || !ethernetEnabled() {
+		t.Errorf("state after retried end: want: no exam and Ethernet enabled, have: %v, Ethernet enabled: %v", st.Exam, ethernetEnabled())
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// lockout defaults
+const (
+	DefaultLockoutThreshold = 5
+	DefaultLockoutDuration  = 5 * time.Minute
+)
+
+var errLockedOut = errors.New("too many failed attempts")
+
+// Lockout is the failed authentication state of a peer signing in as a user
+type Lockout struct {
+	// Peer is the UID of the peer making the attempts, or "unknown" if its identity couldn't be read
+	Peer string `json:"peer"`
+	// User is the peer's account name, if known
+	User string `json:"user,omitempty"`
+	// Name is the user the peer is signing in as, or empty for user names that don't exist
+	Name     string `json:"name,omitempty"`
+	Failures int    `json:"failures"`
+	// Locked is true if the threshold has been reached, rather than just delayed
+	Locked bool `json:"locked"`
+	// Until is when the next attempt is allowed
+	Until time.Time `json:"until"`
+}
+
+// Remaining returns the time remaining until the next attempt is allowed
+func (l *Lockout) Remaining() time.Duration {
+	if r := until(l.Until); r > 0 {
+		return r
+	}
+	return 0
+}
+
+// String returns a human readable description of the lockout
+func (l *Lockout) String() string {
+	state := "delayed"
+	if l.Locked {
+		state = "locked"
+	}
+	peer := l.User
+	if peer == "" {
+		peer = l.Peer
+	}
+	if l.Name == "" {
+		return fmt.Sprintf("Sign in from %s %s for %s", peer, state, formatRemaining(l.Remaining()))
+	}
+	return fmt.Sprintf("Sign in as %s from %s %s for %s", l.Name, peer, state, formatRemaining(l.Remaining()))
+}
+
+// maxLimiterPeers is the maximum number of peers and user names whose attempts are tracked. When full, the least
+// recently used one that isn't delayed is forgotten
+const maxLimiterPeers = 1024
+
+// unknownPeer is the limiter key for peers whose identity couldn't be read
+const unknownPeer = "unknown"
+
+// attemptKey is the key attempts are tracked by
+type attemptKey struct {
+	peer string
+	name string
+}
+
+type attempts struct {
+	// user is the peer's account name, if known
+	user     string
+	failures int
+	last     time.Time
+	until    time.Time
+	inFlight bool
+}
+
+// limiter delays authentication attempts after repeated failures, with delays doubling from a second after the
+// second failure until threshold failures, when attempts are locked out for duration. Attempts are tracked per peer
+// and user name, so a peer guessing a user's password can't lock that user out everywhere, and a peer locked out of
+// one user can still sign in as another, e.g. an admin clearing the lockout. Names are given by attemptName, so
+// guessing names that don't exist, unlock codes, or remote unlock responses each count against one name per peer
+type limiter struct {
+	threshold int
+	duration  time.Duration
+
+	mu       sync.Mutex
+	attempts map[attemptKey]*attempts
+}
+
+func newLimiter(threshold int, duration time.Duration) *limiter {
+	return &limiter{threshold: threshold, duration: duration, attempts: make(map[attemptKey]*attempts)}
+}
+
+// limiterKey returns the key p is tracked by
+func limiterKey(p *Peer) string {
+	if p == nil {
+		return unknownPeer
+	}
+	return strings.ToLower(p.UID)
+}
+
+// prune removes attempts that are no longer delayed and whose failures are older than the lockout duration. l.mu
+// must be held
+func (l *limiter) prune(now time.Time) {
+	for key, a := range l.attempts {
+		if !a.inFlight && now.After(a.until) && now.Sub(a.last) > l.duration {
+			delete(l.attempts, key)
+		}
+	}
+}
+
+// evict makes room for a new peer or name by removing the least recently failed one that isn't delayed or in
+// flight, or the least recently failed one that isn't in flight if they're all delayed. l.mu must be held
+func (l *limiter) evict(now time.Time) {
+	var oldest attemptKey
+	var found, oldestDelayed bool
+	for key, a := range l.attempts {
+		if a.inFlight {
+			continue
+		}
+		delayed := now.Before(a.until)
+		if !found || (oldestDelayed && !delayed) || (oldestDelayed == delayed && a.last.Before(l.attempts[oldest].last)) {
+			oldest, found, oldestDelayed = key, true, delayed
+		}
+	}
+	if found {
+		delete(l.attempts, oldest)
+	}
+}
+
+// begin starts an attempt from p to sign in as name. If the attempt isn't allowed yet, the time it will be allowed is
+// returned with false. Otherwise the attempt must be finished with end. Only one attempt per peer and name can be in
+// flight at once
+func (l *limiter) begin(p *Peer, name string) (time.Time, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := serviceClock.Now()
+	l.prune(now)
+
+	key := attemptKey{peer: limiterKey(p), name: name}
+	a := l.attempts[key]
+	if a == nil {
+		if len(l.attempts) >= maxLimiterPeers {
+			l.evict(now)
+		}
+		a = new(attempts)
+		l.attempts[key] = a
+	}
+	if p != nil {
+		a.user = p.User
+	}
+	if a.inFlight {
+		return now.Add(time.Second), false
+	}
+	if now.Before(a.until) {
+		return a.until, false
+	}
+	a.inFlight = true
+	return time.Time{}, true
+}
+
+// end finishes an attempt from p to sign in as name, resetting its failures if ok is true, or delaying the next
+// attempt otherwise. The time the next attempt is allowed is returned
+func (l *limiter) end(p *Peer, name string, ok bool) time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := attemptKey{peer: limiterKey(p), name: name}
+	a := l.attempts[key]
+	if a == nil {
+		return time.Time{}
+	}
+	a.inFlight = false
+
+	if ok {
+		delete(l.attempts, key)
+		return time.Time{}
+	}
+
+	now := serviceClock.Now()
+	a.failures++
+	a.last = now
+	if a.failures >= l.threshold {
+		a.until = now.Add(l.duration)
+	} else if a.failures > 1 {
+		// allow a single typo without delay
+		a.until = now.Add(time.Second << (a.failures - 2))
+	}
+	return a.until
+}
+
+// cancel finishes an attempt from p to sign in as name that couldn't be checked, without changing its failures
+func (l *limiter) cancel(p *Peer, name string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if a := l.attempts[attemptKey{peer: limiterKey(p), name: name}]; a != nil {
+		a.inFlight = false
+	}
+}
+
+// clear removes the attempts for the peer with the UID or account name name, whatever user they sign in as, or all
+// attempts if name is empty. The number of cleared lockouts is returned
+func (l *limiter) clear(name string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if name == "" {
+		n := len(l.attempts)
+		l.attempts = make(map[attemptKey]*attempts)
+		return n
+	}
+
+	n := 0
+	for key, a := range l.attempts {
+		if strings.EqualFold(key.peer, name) || (a.user != "" && strings.EqualFold(a.user, name)) {
+			delete(l.attempts, key)
+			n++
+		}
+	}
+	return n
+}
+
+// lockouts returns the peers and names whose attempts are currently delayed or locked out
+func (l *limiter) lockouts() []*Lockout {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := serviceClock.Now()
+	lockouts := make([]*Lockout, 0)
+	for key, a := range l.attempts {
+		if now.Before(a.until) {
+			lockouts = append(lockouts, &Lockout{Peer: key.peer, User: a.user, Name: key.name, Failures: a.failures, Locked: a.failures >= l.threshold, Until: a.until})
+		}
+	}
+	sort.Slice(lockouts, func(i, j int) bool {
+		if lockouts[i].Peer != lockouts[j].Peer {
+			return lockouts[i].Peer < lockouts[j].Peer
+		}
+		return lockouts[i].Name < lockouts[j].Name
+	})
+	return lockouts
+}
+
+// attemptName returns the name attempts with cred are counted against: the user's name if they exist, or the kind of
+// credential otherwise. Names that don't exist all count against the empty name, so guessing names can't create
+// counts without limit
+func (s *Server) attemptName(cred credentials) string {
+	switch {
+	case cred.Remote != nil:
+		return remoteUnlockUser
+	case cred.UnlockCode != "":
+		return unlockCodeUser
+	case cred.Username == "":
+		return sharedPasswordUser
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u := findUser(s.Config.Users, cred.Username); u != nil {
+		return u.Name
+	}
+	return ""
+}
+
+// lockoutError returns an error describing how long until the next attempt is allowed
+func lockoutError(remaining time.Duration) error {
+	return fmt.Errorf("%w: locked for %s", errLockedOut, formatRemaining(remaining))
+}
+
+// writeLockout writes a Too Many Requests response for an attempt that isn't allowed until t
+func (s *Server) writeLockout(w http.ResponseWriter, t time.Time) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(until(t).Round(time.Second).Seconds())))
+	s.writeResponse(w, http.StatusTooManyRequests, &response{Error: lockoutError(until(t)).Error()})
+}
+
+// clientLockoutError returns the lockout error from a Too Many Requests response
+func clientLockoutError(resp *http.Response) error {
+	secs, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil {
+		return errLockedOut
+	}
+	return lockoutError(time.Duration(secs) * time.Second)
+}
+
+type lockoutRequest struct {
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Code     string `json:"code,omitempty"`
+	// Name is the UID or account name of the peer whose lockout is cleared, or "unknown" for peers whose identity
+	// couldn't be read. If empty, all lockouts are cleared
+	Name string `json:"name,omitempty"`
+}
+
+// ClearLockout is an HTTP handler that clears failed authentication attempts. It requires the admin role
+func (s *Server) ClearLockout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		s.Logger.Warn().Err(fmt.Errorf("invalid method: %s", r.Method)).Send()
+		return
+	}
+
+	req := new(lockoutRequest)
+	body, ok := s.readRequest(w, r, req)
+	if !ok {
+		return
+	}
+
+	acct := s.authorize(w, r, body, credentials{Username: req.Username, Password: req.Password, Code: req.Code}, actionManage)
+	if acct == nil {
+		return
+	}
+
+	n := s.limiter.clear(req.Name)
+	s.audit(&AuditRecord{Event: auditConfig, Action: "lockout clear", Outcome: auditSuccess, User: acct.Name, Target: req.Name, Peer: requestPeer(r)})
+	s.Logger.Info().Str("user", acct.Name).Str("name", req.Name).Int("cleared", n).Msg("lockout cleared")
+	s.writeResponse(w, http.StatusOK, &response{})
+}
+
+// ClearLockout requests to clear failed authentication attempts for the peer with the UID or account name name, or
+// all attempts if name is empty
+func (c *Client) ClearLockout(cred credentials, name string) error {
+	resp, err := c.post("/lockout", cred, &lockoutRequest{Username: cred.Username, Name: name})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusUnauthorized:
+		return errUnauthorized
+	case http.StatusTooManyRequests:
+		return clientLockoutError(resp)
+	case http.StatusServiceUnavailable:
+		return errBusy
+	case http.StatusForbidden:
+		r := new(response)
+		if err := json.NewDecoder(resp.Body).Decode(r); err != nil {
+			return fmt.Errorf("could not decode response: %w", err)
+		}
+		return fmt.Errorf("%w: %s", errForbidden, r.Error)
+	default:
+		return fmt.Errorf("unexpected status: %d %s", resp.StatusCode, resp.Status)
+	}
+}
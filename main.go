@@ -7,12 +7,15 @@ import (
 	"github.com/alecthomas/kong"
 )
 
+// version is set at build time with `go build -ldflags "-X main.version=<version>"`
+var version = "dev"
+
 func main() {
 	if len(os.Args) > 1 {
 		ctx := kong.Parse(&CLI, kong.ConfigureHelp(kong.HelpOptions{NoExpandSubcommands: true}))
 		if err := ctx.Run(); err != nil {
-			fmt.Println("Error:", err)
-			os.Exit(1)
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(exitCode(err))
 		}
 	} else {
 		runUI()
@@ -0,0 +1,20 @@
+//go:build !windows
+
+package main
+
+// simBackend is shared so that changes persist between connections
+var simBackend = NewSimBackend(
+	&Adapter{
+		Name: "Ethernet", InterfaceDescription: "Simulated Ethernet Adapter", MAC: "00-00-5E-00-53-01",
+		InterfaceAdminStatus: interfaceAdminStatusUp, MediaConnectState: mediaConnectStateConnected, InterfaceIndex: 1,
+	},
+	&Adapter{
+		Name: "Wi-Fi", InterfaceDescription: "Simulated Wireless Adapter", MAC: "00-00-5E-00-53-02", NdisMedium: ndisMediumNative80211,
+		InterfaceAdminStatus: interfaceAdminStatusUp, MediaConnectState: mediaConnectStateConnected, InterfaceIndex: 2,
+	},
+)
+
+// defaultBackend returns an in-memory simulator, since WMI is only available on Windows
+func defaultBackend() (Backend, error) {
+	return simBackend, nil
+}
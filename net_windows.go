@@ -1,26 +1,25 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"strings"
+	"time"
 
+	"github.com/go-ole/go-ole"
 	"github.com/korylprince/go-win-netcontrol/wmi"
 )
 
 const netAdapterNamespace = `root\StandardCimv2`
 
-const (
-	ndisMedium8023        = 0
-	ndisMediumNative80211 = 16
-)
-
-const (
-	interfaceAdminStatusUp   = 1
-	interfaceAdminStatusDown = 2
-)
+// netAdapterQuery selects all adapters. Adapters are filtered with a Selection
+const netAdapterQuery = "SELECT Name, InterfaceDescription, MacAddress, NdisMedium, Virtual, InterfaceAdminStatus, MediaConnectState, InterfaceIndex FROM MSFT_NetAdapter"
 
-const netAdapterQuery = "SELECT Name, InterfaceAdminStatus FROM MSFT_NetAdapter WHERE (NdisMedium = 0 OR NdisMedium = 16) AND Virtual = 0"
+// netAdapterEventQuery notifies when adapters are added, removed, or changed
+const netAdapterEventQuery = "SELECT * FROM __InstanceOperationEvent WITHIN 2 WHERE TargetInstance ISA 'MSFT_NetAdapter'"
 
-// Conn is a WMI conn to query the MSFT_NetAdapter class
+// Conn is a WMI conn to query the MSFT_NetAdapter class. Conn implements Backend
 type Conn struct {
 	conn *wmi.Conn
 }
@@ -34,97 +33,182 @@ func NewConn() (*Conn, error) {
 	return &Conn{conn: conn}, nil
 }
 
+// defaultBackend returns a new Conn
+func defaultBackend() (Backend, error) {
+	conn, err := NewConn()
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
 // Close closes the conn
 func (conn *Conn) Close() error {
 	return conn.conn.Close()
 }
 
-// Count returns the number of all and enabled network interfaces
-func (conn *Conn) Count() (all, enabled int, err error) {
+// property returns the value of the named property of item
+func property(item *ole.IDispatch, name string) (interface{}, error) {
+	prop, err := item.GetProperty(name)
+	if err != nil {
+		return nil, fmt.Errorf("could not get %s property: %w", name, err)
+	}
+	val := prop.Value()
+	if err = prop.Clear(); err != nil {
+		return nil, fmt.Errorf("could not clear %s property: %w", name, err)
+	}
+	return val, nil
+}
+
+// toInt converts an integer property value to an int
+func toInt(val interface{}) int {
+	switch v := val.(type) {
+	case int8:
+		return int(v)
+	case uint8:
+		return int(v)
+	case int16:
+		return int(v)
+	case uint16:
+		return int(v)
+	case int32:
+		return int(v)
+	case uint32:
+		return int(v)
+	case int64:
+		return int(v)
+	case uint64:
+		return int(v)
+	}
+	return 0
+}
+
+// adapter returns a new Adapter from a MSFT_NetAdapter row
+func adapter(item *ole.IDispatch) (*Adapter, error) {
+	vals := make(map[string]interface{})
+	for _, name := range []string{"Name", "InterfaceDescription", "MacAddress", "NdisMedium", "Virtual", "InterfaceAdminStatus", "MediaConnectState", "InterfaceIndex"} {
+		val, err := property(item, name)
+		if err != nil {
+			return nil, err
+		}
+		vals[name] = val
+	}
+
+	a := &Adapter{
+		NdisMedium:           toInt(vals["NdisMedium"]),
+		InterfaceAdminStatus: toInt(vals["InterfaceAdminStatus"]),
+		MediaConnectState:    toInt(vals["MediaConnectState"]),
+		InterfaceIndex:       toInt(vals["InterfaceIndex"]),
+	}
+	a.Name, _ = vals["Name"].(string)
+	a.InterfaceDescription, _ = vals["InterfaceDescription"].(string)
+	a.MAC, _ = vals["MacAddress"].(string)
+	a.Virtual, _ = vals["Virtual"].(bool)
+
+	return a, nil
+}
+
+// List returns all network interfaces
+func (conn *Conn) List() ([]*Adapter, error) {
 	rows, err := conn.conn.Query(netAdapterQuery)
 	if err != nil {
-		return 0, 0, fmt.Errorf("could not query net adapters: %w", err)
+		return nil, fmt.Errorf("could not query net adapters: %w", err)
 	}
 	defer rows.Close()
 
-	all = int(rows.Count)
-	count := 0
+	adapters := make([]*Adapter, 0, rows.Count)
 
 	for item, err := rows.Next(); err == nil; item, err = rows.Next() {
-		name := ""
-		nameProp, err := item.GetProperty("Name")
-		if err == nil {
-			name = nameProp.ToString()
-			if err = nameProp.Clear(); err != nil {
-				fmt.Println("WARN: could not clear name property:", err)
-			}
-		}
-
-		statusProp, err := item.GetProperty("InterfaceAdminStatus")
+		a, err := adapter(item)
 		if err != nil {
-			return 0, 0, fmt.Errorf("could not get (%s).InterfaceAdminStatus property: %w", name, err)
-		}
-		status := statusProp.Value().(int32)
-		if err = statusProp.Clear(); err != nil {
-			return 0, 0, fmt.Errorf("could not clear (%s).InterfaceAdminStatus property: %w", name, err)
-		}
-
-		if status == interfaceAdminStatusUp {
-			count += 1
+			return nil, fmt.Errorf("could not read net adapter: %w", err)
 		}
+		adapters = append(adapters, a)
 	}
 	if err = rows.Err(); err != nil {
-		return 0, 0, fmt.Errorf("could not finish iterating rows: %w", err)
+		return nil, fmt.Errorf("could not finish iterating rows: %w", err)
 	}
 
-	return all, count, nil
+	return adapters, nil
 }
 
-// SetStatus sets all network interfaces to enabled or disabled
-func (conn *Conn) SetStatus(enabled bool) error {
-	rows, err := conn.conn.Query(netAdapterQuery)
+// quote returns s as a quoted WQL string
+func quote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+}
+
+// call calls method on the named network interface
+func (conn *Conn) call(name, method string) error {
+	rows, err := conn.conn.Query(fmt.Sprintf("SELECT Name FROM MSFT_NetAdapter WHERE Name = %s", quote(name)))
 	if err != nil {
-		return fmt.Errorf("could not query net adapters: %w", err)
+		return fmt.Errorf("could not query net adapter %s: %w", name, err)
 	}
 	defer rows.Close()
 
-	for item, err := rows.Next(); err == nil; item, err = rows.Next() {
-		name := ""
-		nameProp, err := item.GetProperty("Name")
-		if err == nil {
-			name = nameProp.ToString()
-			if err = nameProp.Clear(); err != nil {
-				fmt.Println("WARN: could not clear name property:", err)
-			}
-		}
+	item, err := rows.Next()
+	if err != nil {
+		return fmt.Errorf("could not find %s: %w", name, err)
+	}
+
+	if _, err = item.CallMethod(method); err != nil {
+		return fmt.Errorf("could not %s %s: %w", strings.ToLower(method), name, err)
+	}
+
+	return nil
+}
+
+// Enable enables the named network interface
+func (conn *Conn) Enable(name string) error {
+	return conn.call(name, "Enable")
+}
 
-		statusProp, err := item.GetProperty("InterfaceAdminStatus")
+// Disable disables the named network interface
+func (conn *Conn) Disable(name string) error {
+	return conn.call(name, "Disable")
+}
+
+// Watch implements Watcher. Since a WMI conn can only be used by a single thread, a separate conn is used
+func (conn *Conn) Watch(ctx context.Context) (<-chan struct{}, error) {
+	ch := make(chan struct{}, 1)
+	errCh := make(chan error, 1)
+
+	go func() {
+		defer close(ch)
+
+		wconn, err := wmi.Dial(netAdapterNamespace)
 		if err != nil {
-			return fmt.Errorf("could not get %s InterfaceAdminStatus property: %w", name, err)
-		}
-		status := statusProp.Value().(int32)
-		if err = statusProp.Clear(); err != nil {
-			return fmt.Errorf("could not clear %s InterfaceAdminStatus property: %w", name, err)
+			errCh <- fmt.Errorf("could not create WMI conn: %w", err)
+			return
 		}
+		defer wconn.Close()
 
-		if status != interfaceAdminStatusUp && enabled {
-			_, err := item.CallMethod("Enable")
-			if err != nil {
-				return fmt.Errorf("could not enable %s: %w", name, err)
+		events, err := wconn.Notify(netAdapterEventQuery)
+		if err != nil {
+			errCh <- fmt.Errorf("could not subscribe to net adapter events: %w", err)
+			return
+		}
+		defer events.Close()
+		errCh <- nil
+
+		for ctx.Err() == nil {
+			event, err := events.Next(time.Second)
+			if errors.Is(err, wmi.ErrTimeout) {
+				continue
+			} else if err != nil {
+				return
 			}
-		} else if status == interfaceAdminStatusUp && !enabled {
-			_, err := item.CallMethod("Disable")
-			if err != nil {
-				return fmt.Errorf("could not disable %s: %w", name, err)
+			event.Release()
+
+			select {
+			case ch <- struct{}{}:
+			default:
 			}
 		}
-	}
-	if err = rows.Err(); err != nil {
-		return fmt.Errorf("could not finish iterating rows: %w", err)
-	}
-	if err = rows.Close(); err != nil {
-		return fmt.Errorf("could not close rows: %w", err)
+	}()
+
+	if err := <-errCh; err != nil {
+		return nil, err
 	}
 
-	return nil
+	return ch, nil
 }
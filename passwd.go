@@ -2,7 +2,10 @@ package main
 
 import (
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
 
 	"github.com/korylprince/go-win-netcontrol/hash"
 )
@@ -10,23 +13,216 @@ import (
 // default password is "password"
 // generate new hash with `HASHPASSWORD="<password>" go test ./hash -v`
 // override at build time with `go build -ldflags "-X main.passhashstr=<hash>"`
-var passhashstr = "+qhTwm04Dpw5pQooSWds+gAAAAIAAQAAAdOE2CPYWHU5vcTz5fgGTd3dSQiNKW5OA5U+QtsV/ukG"
+// the password can be changed at runtime with `netcontrol password change`, which overrides the embedded hash
+var passhashstr = "AfqoU8JtOA6cOaUKKElnbPoAAAACAAEAAAFKDg/DimWnKo20leRvGwNIv+pbZ+CPU2jAL7IrJqcSVg=="
 
 var passhash = mustParseHash(passhashstr)
 
-func mustParseHash(s string) *hash.Hash {
+// Argon2id parameters for new hashes
+const (
+	hashTime    = 2
+	hashMemory  = 64 * 1024
+	hashThreads = 1
+)
+
+var (
+	errEmptyPassword = errors.New("password cannot be empty")
+	errInvalidHash   = errors.New("invalid password hash")
+)
+
+func parseHash(s string) (*hash.Hash, error) {
 	buf, err := base64.StdEncoding.DecodeString(s)
 	if err != nil {
-		panic(fmt.Errorf("could not decode hash: %w", err))
+		return nil, fmt.Errorf("could not decode hash: %w", err)
 	}
 	h := new(hash.Hash)
 	if err := h.UnmarshalBinary(buf); err != nil {
-		panic(fmt.Errorf("could not unmarshal hash: %w", err))
+		return nil, fmt.Errorf("could not unmarshal hash: %w", err)
+	}
+	return h, nil
+}
+
+func mustParseHash(s string) *hash.Hash {
+	h, err := parseHash(s)
+	if err != nil {
+		panic(err)
 	}
 	return h
 }
 
-// Validate validates the password against the embedded hash
-func Validate(pass string) bool {
-	return passhash.Validate([]byte(pass)) == nil
+// encodeHash returns the base64 encoded form of h
+func encodeHash(h *hash.Hash) (string, error) {
+	buf, err := h.MarshalBinary()
+	if err != nil {
+		return "", fmt.Errorf("could not marshal hash: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(buf), nil
+}
+
+// migrateHash replaces the legacy hash *s, which stores the key itself, with a hash that stores only its verifier,
+// returning true if it was replaced
+func migrateHash(s *string) (bool, error) {
+	h, err := parseHash(*s)
+	if err != nil || !h.Legacy() {
+		return false, err
+	}
+	if *s, err = encodeHash(h); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// newHash returns a new base64 encoded hash of pass
+func newHash(pass string) (string, error) {
+	if pass == "" {
+		return "", errEmptyPassword
+	}
+	h, err := hash.New([]byte(pass), hashTime, hashMemory, hashThreads)
+	if err != nil {
+		return "", fmt.Errorf("could not create hash: %w", err)
+	}
+	return encodeHash(h)
+}
+
+// newHash returns a new base64 encoded hash of pass, waiting for the verifier to limit memory usage
+func (s *Server) newHash(pass string) (hashstr string, err error) {
+	if busyErr := s.verifier.do(func() { hashstr, err = newHash(pass) }); busyErr != nil {
+		return "", busyErr
+	}
+	return hashstr, err
+}
+
+// requestHash returns the new password hash from a request. If hashstr is set, it's validated and returned. Otherwise
+// newPasswd is hashed
+func (s *Server) requestHash(hashstr, newPasswd string) (string, error) {
+	if hashstr == "" {
+		return s.newHash(newPasswd)
+	}
+
+	h, err := parseHash(hashstr)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errInvalidHash, err)
+	}
+	if p := h.Params(); p.Time != hashTime || p.Memory != hashMemory || p.Threads != hashThreads {
+		return "", fmt.Errorf("%w: unexpected parameters", errInvalidHash)
+	}
+	// re-encode legacy hashes from older clients
+	return encodeHash(h)
+}
+
+type passwordRequest struct {
+	// Username is the user whose password is changed. If empty, the shared password is changed
+	Username    string `json:"username,omitempty"`
+	Password    string `json:"password,omitempty"`
+	Code        string `json:"code,omitempty"`
+	NewPassword string `json:"new_password,omitempty"`
+	// NewHash is the base64 encoded hash of the new password, used instead of NewPassword so the password isn't sent
+	NewHash string `json:"new_hash,omitempty"`
+}
+
+// ChangePassword is an HTTP handler that verifies a password and changes it. Users can change their own password
+func (s *Server) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		s.Logger.Warn().Err(fmt.Errorf("invalid method: %s", r.Method)).Send()
+		return
+	}
+
+	req := new(passwordRequest)
+	body, ok := s.readRequest(w, r, req)
+	if !ok {
+		return
+	}
+
+	acct := s.authorize(w, r, body, credentials{Username: req.Username, Password: req.Password, Code: req.Code})
+	if acct == nil {
+		return
+	}
+
+	hashstr, err := s.requestHash(req.NewHash, req.NewPassword)
+	if errors.Is(err, errBusy) {
+		s.writeBusy(w)
+		return
+	} else if err != nil {
+		s.Logger.Warn().Err(err).Send()
+		s.writeResponse(w, http.StatusBadRequest, &response{Error: err.Error()})
+		return
+	}
+	h, err := parseHash(hashstr)
+	if err != nil {
+		s.Logger.Error().Err(err).Send()
+		s.writeResponse(w, http.StatusInternalServerError, &response{Error: "Error (hash): Please try again later"})
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if req.Username == "" {
+		old := s.Config.PasswordHash
+		s.Config.PasswordHash = hashstr
+		if err = s.Config.Save(configPath); err != nil {
+			s.Config.PasswordHash = old
+			s.Logger.Error().Err(err).Send()
+			s.writeResponse(w, http.StatusInternalServerError, &response{Error: "Error (config): Please try again later"})
+			return
+		}
+		s.passhash = h
+	} else {
+		u := findUser(s.Config.Users, acct.Name)
+		if u == nil {
+			// the user was removed while hashing
+			w.WriteHeader(http.StatusUnauthorized)
+			s.Logger.Warn().Str("user", acct.Name).Msg("invalid password")
+			return
+		}
+		old := u.PasswordHash
+		u.PasswordHash = hashstr
+		if err = s.Config.Save(configPath); err != nil {
+			u.PasswordHash = old
+			s.Logger.Error().Err(err).Send()
+			s.writeResponse(w, http.StatusInternalServerError, &response{Error: "Error (config): Please try again later"})
+			return
+		}
+	}
+
+	s.sessions.revokeUser(acct.Name)
+
+	w.WriteHeader(http.StatusOK)
+	s.audit(&AuditRecord{Event: auditConfig, Action: "password change", Outcome: auditSuccess, User: acct.Name, Target: acct.Name, Peer: requestPeer(r)})
+	s.Logger.Info().Str("user", acct.Name).Msg("password changed")
+}
+
+// ChangePassword requests to change the password of cred's user, or the shared password if cred.Username is empty.
+// The new password is hashed locally, so neither password is sent
+func (c *Client) ChangePassword(cred credentials, newPasswd string) error {
+	hashstr, err := newHash(newPasswd)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.post("/password", cred, &passwordRequest{Username: cred.Username, NewHash: hashstr})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusUnauthorized:
+		return errUnauthorized
+	case http.StatusTooManyRequests:
+		return clientLockoutError(resp)
+	case http.StatusServiceUnavailable:
+		return errBusy
+	case http.StatusBadRequest, http.StatusInternalServerError:
+		r := new(response)
+		if err := json.NewDecoder(resp.Body).Decode(r); err != nil {
+			return fmt.Errorf("could not decode response: %w", err)
+		}
+		return errors.New(r.Error)
+	default:
+		return fmt.Errorf("unexpected status: %d %s", resp.StatusCode, resp.Status)
+	}
 }
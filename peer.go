@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+)
+
+var errInvalidPeerRule = errors.New("invalid peer rule")
+
+// Peer is the identity of the process on the other end of a socket connection
+type Peer struct {
+	PID int `json:"pid"`
+	// UID is the numeric user ID on unix, or the user SID on Windows
+	UID string `json:"uid"`
+	// User is the account name, e.g. "alice" or "LAB\alice"
+	User string `json:"user,omitempty"`
+	// Interactive is true if the peer is running in the active console session. It's always false on platforms
+	// other than Windows
+	Interactive bool `json:"interactive"`
+}
+
+// String returns a human readable description of the peer
+func (p *Peer) String() string {
+	if p == nil {
+		return "unknown"
+	}
+	user := p.User
+	if user == "" {
+		user = p.UID
+	}
+	s := fmt.Sprintf("%s (uid %s, pid %d)", user, p.UID, p.PID)
+	if p.Interactive {
+		s += " on console"
+	}
+	return s
+}
+
+// peer rule effects
+const (
+	peerAllow = "allow"
+	peerDeny  = "deny"
+)
+
+// PeerRule allows or denies requests from matching peers. Empty fields match any peer
+type PeerRule struct {
+	// Effect is "allow" or "deny"
+	Effect string `json:"effect"`
+	// Actions limits the rule to requests for the given actions ("disable", "enable", "grant", or "manage")
+	Actions []action `json:"actions,omitempty"`
+	// User is a case-insensitive glob matched against the peer's account name, e.g. "LAB\student*"
+	User string `json:"user,omitempty"`
+	// UID is matched against the peer's numeric user ID or SID
+	UID string `json:"uid,omitempty"`
+	// Interactive matches peers in or out of the active console session
+	Interactive *bool `json:"interactive,omitempty"`
+	// Unknown only matches peers whose identity couldn't be read, e.g. to deny them
+	Unknown bool `json:"unknown,omitempty"`
+}
+
+// peerGlob matches an account name against a glob. Backslashes are treated as separators instead of escapes so
+// DOMAIN\user patterns work as expected
+func peerGlob(pattern, name string) bool {
+	return glob(strings.ReplaceAll(pattern, `\`, "/"), strings.ReplaceAll(name, `\`, "/"))
+}
+
+// Match returns true if the rule matches a request from p for actions. An unknown peer (nil) only matches rules that
+// don't match on User or UID, and is never interactive
+func (r *PeerRule) Match(p *Peer, actions []action) bool {
+	if r.Unknown && p != nil {
+		return false
+	}
+	if len(r.Actions) > 0 {
+		found := false
+		for _, a := range actions {
+			for _, ra := range r.Actions {
+				if a == ra {
+					found = true
+				}
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if r.User != "" && (p == nil || !peerGlob(r.User, p.User)) {
+		return false
+	}
+	if r.UID != "" && (p == nil || !strings.EqualFold(r.UID, p.UID)) {
+		return false
+	}
+	if r.Interactive != nil && *r.Interactive != (p != nil && p.Interactive) {
+		return false
+	}
+	return true
+}
+
+// Validate returns an error if the rule's effect, actions, or glob are invalid
+func (r *PeerRule) Validate() error {
+	if r.Effect != peerAllow && r.Effect != peerDeny {
+		return fmt.Errorf("%w: effect must be %s or %s", errInvalidPeerRule, peerAllow, peerDeny)
+	}
+	for _, a := range r.Actions {
+		if !RoleAdmin.Allows(a) {
+			return fmt.Errorf("%w: unknown action %q", errInvalidPeerRule, a)
+		}
+	}
+	if _, err := path.Match(strings.ReplaceAll(r.User, `\`, "/"), ""); err != nil {
+		return fmt.Errorf("%w: invalid pattern %q: %v", errInvalidPeerRule, r.User, err)
+	}
+	return nil
+}
+
+// peerRule returns the first rule matching a request from p for actions, or nil if none match
+func (c *Config) peerRule(p *Peer, actions []action) *PeerRule {
+	for _, r := range c.PeerRules {
+		if r.Match(p, actions) {
+			return r
+		}
+	}
+	return nil
+}
+
+// peerKey is the context key for the Peer of the connection a request was received on
+type peerKey struct{}
+
+// connContext adds a connection ID and the peer's identity to the context of each connection
+func (s *Server) connContext(ctx context.Context, conn net.Conn) context.Context {
+	ctx = connContext(ctx, conn)
+	p, err := peerCred(conn)
+	if err != nil {
+		s.Logger.Warn().Err(err).Uint64("conn", ctx.Value(connIDKey{}).(uint64)).Msg("could not read peer credentials")
+	}
+	return context.WithValue(ctx, peerKey{}, p)
+}
+
+// requestPeer returns the Peer r was received from, or nil if it's unknown
+func requestPeer(r *http.Request) *Peer {
+	p, _ := r.Context().Value(peerKey{}).(*Peer)
+	return p
+}
+
+// logRequests logs each request with the identity of the peer that sent it
+func (s *Server) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		event := s.Logger.Info()
+		if r.Method == http.MethodGet {
+			// the GUI polls status, so keep it out of the log unless debugging
+			event = s.Logger.Debug()
+		}
+		event.Uint64("conn", connID(r)).Str("method", r.Method).Str("path", r.URL.Path).Stringer("peer", requestPeer(r)).Msg("request")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowPeer checks the peer r was received from against the configured peer rules for actions, returning false and
+// writing a response if the request isn't allowed
+func (s *Server) allowPeer(w http.ResponseWriter, r *http.Request, actions ...action) bool {
+	p := requestPeer(r)
+
+	s.mu.Lock()
+	rule := s.Config.peerRule(p, actions)
+	s.mu.Unlock()
+
+	if rule == nil || rule.Effect == peerAllow {
+		return true
+	}
+
+	s.Logger.Warn().Stringer("peer", p).Interface("actions", actions).Msg("request denied by peer rule")
+	s.writeResponse(w, http.StatusForbidden, &response{Error: fmt.Sprintf("requests from %s are not allowed", p)})
+	return false
+}
@@ -0,0 +1,44 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os/user"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// peerCred returns the identity of the process on the other end of conn using SO_PEERCRED
+func peerCred(conn net.Conn) (*Peer, error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, errors.New("not a unix socket connection")
+	}
+
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return nil, fmt.Errorf("could not get raw connection: %w", err)
+	}
+
+	var cred *unix.Ucred
+	var credErr error
+	if err = raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	}); err != nil {
+		return nil, fmt.Errorf("could not control connection: %w", err)
+	}
+	if credErr != nil {
+		return nil, fmt.Errorf("could not get peer credentials: %w", credErr)
+	}
+
+	p := &Peer{PID: int(cred.Pid), UID: strconv.FormatUint(uint64(cred.Uid), 10)}
+	if u, err := user.LookupId(p.UID); err == nil {
+		p.User = u.Username
+	}
+
+	return p, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !windows
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// peerCred isn't supported on this platform, so the peer is always unknown
+func peerCred(_ net.Conn) (*Peer, error) {
+	return nil, errors.New("peer credentials are not supported on this platform")
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// sioAFUnixGetPeerPID is the SIO_AF_UNIX_GETPEERPID ioctl, which returns the process ID of the peer of an AF_UNIX
+// socket. Windows doesn't support SO_PEERCRED, so the rest of the identity is read from the process
+const sioAFUnixGetPeerPID = 0x58000100
+
+// peerCred returns the identity of the process on the other end of conn, from the process's token and session
+func peerCred(conn net.Conn) (*Peer, error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, errors.New("not a unix socket connection")
+	}
+
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return nil, fmt.Errorf("could not get raw connection: %w", err)
+	}
+
+	var pid, n uint32
+	var pidErr error
+	if err = raw.Control(func(fd uintptr) {
+		pidErr = windows.WSAIoctl(windows.Handle(fd), sioAFUnixGetPeerPID, nil, 0,
+			(*byte)(unsafe.Pointer(&pid)), uint32(unsafe.Sizeof(pid)), &n, nil, 0)
+	}); err != nil {
+		return nil, fmt.Errorf("could not control connection: %w", err)
+	}
+	if pidErr != nil {
+		return nil, fmt.Errorf("could not get peer process ID: %w", pidErr)
+	}
+
+	p := &Peer{PID: int(pid)}
+
+	var session uint32
+	if err = windows.ProcessIdToSessionId(pid, &session); err != nil {
+		return nil, fmt.Errorf("could not get peer session: %w", err)
+	}
+	// WTSGetActiveConsoleSessionId returns 0xFFFFFFFF if no session is attached to the console
+	if console := windows.WTSGetActiveConsoleSessionId(); console != 0xFFFFFFFF && session == console {
+		p.Interactive = true
+	}
+
+	proc, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, pid)
+	if err != nil {
+		return nil, fmt.Errorf("could not open peer process: %w", err)
+	}
+	defer windows.CloseHandle(proc)
+
+	var token windows.Token
+	if err = windows.OpenProcessToken(proc, windows.TOKEN_QUERY, &token); err != nil {
+		return nil, fmt.Errorf("could not open peer process token: %w", err)
+	}
+	defer token.Close()
+
+	tu, err := token.GetTokenUser()
+	if err != nil {
+		return nil, fmt.Errorf("could not get peer user: %w", err)
+	}
+	p.UID = tu.User.Sid.String()
+	if account, domain, _, err := tu.User.Sid.LookupAccount(""); err == nil {
+		p.User = account
+		if domain != "" {
+			p.User = domain + `\` + account
+		}
+	}
+
+	return p, nil
+}
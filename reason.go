@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxReasonLen is the maximum length of a reason in characters
+const maxReasonLen = 500
+
+var errInvalidReason = errors.New("invalid reason")
+
+// validateReason returns reason with surrounding space trimmed and category matched to the configured categories, or
+// an error if they don't meet the configured policy
+func (c *Config) validateReason(reason, category string) (string, string, error) {
+	reason = strings.TrimSpace(reason)
+	if utf8.RuneCountInString(reason) > maxReasonLen {
+		return "", "", fmt.Errorf("%w: must be at most %d characters", errInvalidReason, maxReasonLen)
+	}
+	if c.RequireReason && reason == "" {
+		return "", "", fmt.Errorf("%w: a reason is required", errInvalidReason)
+	}
+
+	category = strings.TrimSpace(category)
+	if len(c.ReasonCategories) == 0 {
+		if category != "" {
+			return "", "", fmt.Errorf("%w: no categories are configured", errInvalidReason)
+		}
+		return reason, "", nil
+	}
+	if category == "" {
+		if c.RequireReason {
+			return "", "", fmt.Errorf("%w: a category is required (%s)", errInvalidReason, strings.Join(c.ReasonCategories, ", "))
+		}
+		return reason, "", nil
+	}
+	for _, cat := range c.ReasonCategories {
+		if strings.EqualFold(cat, category) {
+			return reason, cat, nil
+		}
+	}
+	return "", "", fmt.Errorf("%w: unknown category %q (%s)", errInvalidReason, category, strings.Join(c.ReasonCategories, ", "))
+}
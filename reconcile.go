@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// reconcile disables any selected adapter that is enabled while the network is locked, returning the adapters that
+// were disabled
+func (s *Server) reconcile() (disabled []*Adapter, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.State.Locked {
+		return nil, nil
+	}
+
+	// recover panics, because WMI seems to be pretty buggy
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	conn, err := s.NewBackend()
+	if err != nil {
+		return nil, fmt.Errorf("could not create backend: %w", err)
+	}
+	defer conn.Close()
+
+	adapters, err := s.Config.Adapters.List(conn)
+	if err != nil {
+		return nil, fmt.Errorf("could not list adapters: %w", err)
+	}
+
+	for _, a := range adapters {
+		if !a.Enabled() || s.State.IsAllowed(a.Name) {
+			continue
+		}
+
+		event := s.Logger.Warn().Str("adapter", a.Name).Str("description", a.InterfaceDescription).Str("mac", a.MAC).
+			Int("ndis_medium", a.NdisMedium).Bool("virtual", a.Virtual).Int("interface_index", a.InterfaceIndex)
+		rec := &AuditRecord{Event: auditReconcile, Action: string(actionDisable), Outcome: auditSuccess, User: systemUser, Adapters: []string{a.Name}}
+		if err = conn.Disable(a.Name); err != nil {
+			rec.Outcome, rec.Error = auditFailure, err.Error()
+			s.audit(rec)
+			event.Err(err).Msg("could not enforce lockdown")
+			continue
+		}
+		s.audit(rec)
+		event.Msg("enforced lockdown")
+		disabled = append(disabled, a)
+	}
+
+	return disabled, nil
+}
+
+// watch returns a channel that receives adapter change events, or nil if the backend doesn't support watching
+func (s *Server) watch(ctx context.Context) <-chan struct{} {
+	conn, err := s.NewBackend()
+	if err != nil {
+		s.Logger.Warn().Err(err).Msg("could not create backend to watch adapters")
+		return nil
+	}
+	defer conn.Close()
+
+	w, ok := conn.(Watcher)
+	if !ok {
+		return nil
+	}
+
+	events, err := w.Watch(ctx)
+	if err != nil {
+		s.Logger.Warn().Err(err).Msg("could not watch adapters")
+		return nil
+	}
+
+	return events
+}
+
+// reconcileLoop reconciles when adapters change and every ReconcileInterval until ctx is canceled
+func (s *Server) reconcileLoop(ctx context.Context) {
+	ticker := time.NewTicker(s.Config.reconcileInterval())
+	defer ticker.Stop()
+
+	events := s.watch(ctx)
+	if events == nil {
+		s.Logger.Info().Dur("interval", s.Config.reconcileInterval()).Msg("watching adapters by polling")
+	}
+
+	for {
+		if _, err := s.reconcile(); err != nil {
+			s.Logger.Error().Err(err).Msg("could not reconcile")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// retry watching after failures
+			if events == nil {
+				events = s.watch(ctx)
+			}
+		case _, ok := <-events:
+			if !ok {
+				events = nil
+				if ctx.Err() == nil {
+					s.Logger.Warn().Msg("adapter watch failed, falling back to polling")
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// remote unlock limits
+const (
+	// remoteUnlockUser is the name remote unlock attempts are logged and audited as
+	remoteUnlockUser      = "remote-unlock"
+	remoteUnlockTTL       = 10 * time.Minute
+	maxRemoteChallenges   = 16
+	remoteNonceLen        = 6
+	remoteResponseLen     = 8
+	remoteUnlockKeyLen    = 32
+	remoteMasterSecretLen = 32
+	// remoteChallengeInterval is how often each peer can be issued a challenge
+	remoteChallengeInterval = 10 * time.Second
+)
+
+var (
+	errRemoteUnlockDisabled = errors.New("remote unlock isn't set up")
+	errChallengeRate        = errors.New("a remote unlock challenge was just issued, try again in a few seconds")
+)
+
+// machineID returns the ID remote unlock keys are derived for: the upper case host name
+func machineID() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		return "UNKNOWN"
+	}
+	return strings.ToUpper(strings.Split(host, ".")[0])
+}
+
+// normalizeCode returns code in upper case without spaces or dashes, so codes read over the phone can be entered in
+// any grouping
+func normalizeCode(code string) string {
+	return strings.ToUpper(strings.NewReplacer(" ", "", "-", "", "\t", "").Replace(code))
+}
+
+// deriveMachineKey returns the remote unlock key for machine. Only the derived key is stored on the machine, so the
+// master secret can't be recovered from it
+func deriveMachineKey(master []byte, machine string) []byte {
+	mac := hmac.New(sha256.New, master)
+	mac.Write([]byte("netcontrol machine key\n" + strings.ToUpper(machine)))
+	return mac.Sum(nil)
+}
+
+// remoteResponse returns the response to challenge for a machine's key
+func remoteResponse(key []byte, challenge string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("netcontrol remote unlock\n" + normalizeCode(challenge)))
+	sum := mac.Sum(nil)
+	buf := make([]byte, remoteResponseLen)
+	for i := range buf {
+		buf[i] = unlockAlphabet[int(sum[i])%len(unlockAlphabet)]
+	}
+	return string(buf[:remoteResponseLen/2]) + "-" + string(buf[remoteResponseLen/2:])
+}
+
+// splitChallenge returns the machine ID and nonce of challenge. The nonce is after the last dash, since host names
+// can contain dashes
+func splitChallenge(challenge string) (machine, nonce string, ok bool) {
+	challenge = strings.ToUpper(strings.TrimSpace(challenge))
+	i := strings.LastIndex(challenge, "-")
+	if i < 1 {
+		return "", "", false
+	}
+	return challenge[:i], challenge[i+1:], true
+}
+
+// remoteChallenges are the outstanding remote unlock challenges. Each can be used once before it expires. Each peer
+// can be issued one challenge per remoteChallengeInterval, and when there are too many outstanding challenges, the
+// oldest is dropped to make room
+type remoteChallenges struct {
+	mu      sync.Mutex
+	pending map[string]time.Time
+	// issued maps the limiter key of each peer to when it was last issued a challenge
+	issued map[string]time.Time
+}
+
+func newRemoteChallenges() *remoteChallenges {
+	return &remoteChallenges{pending: make(map[string]time.Time), issued: make(map[string]time.Time)}
+}
+
+// issue returns a new challenge for machine, requested by p. errChallengeRate is returned if p was issued a challenge
+// too recently
+func (c *remoteChallenges) issue(machine string, p *Peer) (string, error) {
+	nonce, err := randomString(remoteNonceLen)
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := serviceClock.Now()
+	for key, issued := range c.issued {
+		if now.Sub(issued) >= remoteChallengeInterval {
+			delete(c.issued, key)
+		}
+	}
+	peer := limiterKey(p)
+	if _, ok := c.issued[peer]; ok {
+		return "", errChallengeRate
+	}
+
+	var oldest string
+	for key, expires := range c.pending {
+		if now.After(expires) {
+			delete(c.pending, key)
+		} else if oldest == "" || expires.Before(c.pending[oldest]) {
+			oldest = key
+		}
+	}
+	if len(c.pending) >= maxRemoteChallenges {
+		delete(c.pending, oldest)
+	}
+
+	c.issued[peer] = now
+	c.pending[nonce] = now.Add(remoteUnlockTTL)
+	return machine + "-" + nonce, nil
+}
+
+// consume removes nonce, returning true if it was issued and hasn't expired
+func (c *remoteChallenges) consume(nonce string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expires, ok := c.pending[nonce]
+	delete(c.pending, nonce)
+	return ok && serviceClock.Now().Before(expires)
+}
+
+// remoteUnlock is a remote unlock challenge and the response read back by IT
+type remoteUnlock struct {
+	Challenge string `json:"challenge"`
+	Response  string `json:"response"`
+}
+
+// remoteUnlockKey returns the configured remote unlock key, or nil if it isn't set up
+func (s *Server) remoteUnlockKey() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Config.RemoteUnlockKey == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(s.Config.RemoteUnlockKey)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode remote unlock key: %w", err)
+	}
+	return key, nil
+}
+
+// authenticateRemoteUnlock returns a coach account if ru's response matches its challenge. The challenge is used up
+// even if the response is wrong, so responses can't be guessed
+func (s *Server) authenticateRemoteUnlock(ru *remoteUnlock) (*account, error) {
+	key, err := s.remoteUnlockKey()
+	if err != nil {
+		s.Logger.Error().Err(err).Send()
+		return nil, errUnauthorized
+	}
+	machine, nonce, ok := splitChallenge(ru.Challenge)
+	if key == nil || !ok || machine != machineID() || !s.remoteChallenges.consume(nonce) {
+		return nil, errUnauthorized
+	}
+	if !hmac.Equal([]byte(normalizeCode(remoteResponse(key, ru.Challenge))), []byte(normalizeCode(ru.Response))) {
+		return nil, errUnauthorized
+	}
+
+	s.Logger.Info().Str("challenge", ru.Challenge).Msg("remote unlock used")
+	return &account{Name: "remote unlock " + nonce, Role: RoleCoach}, nil
+}
+
+type remoteChallengeResponse struct {
+	Error     string `json:"error,omitempty"`
+	Challenge string `json:"challenge,omitempty"`
+	// Expires is when the challenge can no longer be used
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+// RemoteChallenge is an HTTP handler that issues a remote unlock challenge. It doesn't require authentication, since
+// the challenge is only useful with a response from IT
+func (s *Server) RemoteChallenge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		s.Logger.Warn().Err(fmt.Errorf("invalid method: %s", r.Method)).Send()
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	key, err := s.remoteUnlockKey()
+	if err != nil {
+		s.Logger.Error().Err(err).Send()
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if key == nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(&remoteChallengeResponse{Error: errRemoteUnlockDisabled.Error()})
+		return
+	}
+
+	challenge, err := s.remoteChallenges.issue(machineID(), requestPeer(r))
+	if errors.Is(err, errChallengeRate) {
+		s.Logger.Warn().Stringer("peer", requestPeer(r)).Msg("remote unlock challenge rate limited")
+		w.Header().Set("Retry-After", strconv.Itoa(int(remoteChallengeInterval.Seconds())))
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(&remoteChallengeResponse{Error: err.Error()})
+		return
+	} else if err != nil {
+		s.Logger.Error().Err(err).Send()
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	s.Logger.Info().Str("challenge", challenge).Msg("remote unlock challenge issued")
+	if err = json.NewEncoder(w).Encode(&remoteChallengeResponse{Challenge: challenge, Expires: serviceClock.Now().Add(remoteUnlockTTL)}); err != nil {
+		s.Logger.Error().Err(fmt.Errorf("could not encode response: %w", err)).Send()
+	}
+}
+
+type remoteSetupRequest struct {
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Code     string `json:"code,omitempty"`
+	// Key is the base64 encoded key derived for this machine. If empty, remote unlock is disabled
+	Key string `json:"key,omitempty"`
+}
+
+// SetupRemoteUnlock is an HTTP handler that sets or removes the remote unlock key. It requires the admin role
+func (s *Server) SetupRemoteUnlock(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		s.Logger.Warn().Err(fmt.Errorf("invalid method: %s", r.Method)).Send()
+		return
+	}
+
+	req := new(remoteSetupRequest)
+	body, ok := s.readRequest(w, r, req)
+	if !ok {
+		return
+	}
+
+	acct := s.authorize(w, r, body, credentials{Username: req.Username, Password: req.Password, Code: req.Code}, actionManage)
+	if acct == nil {
+		return
+	}
+
+	if err := validateRemoteUnlockKey(req.Key); err != nil {
+		s.Logger.Warn().Err(err).Send()
+		s.writeResponse(w, http.StatusBadRequest, &response{Error: err.Error()})
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old := s.Config.RemoteUnlockKey
+	s.Config.RemoteUnlockKey = req.Key
+	if err := s.Config.Save(configPath); err != nil {
+		s.Config.RemoteUnlockKey = old
+		s.Logger.Error().Err(err).Send()
+		s.writeResponse(w, http.StatusInternalServerError, &response{Error: "Error (config): Please try again later"})
+		return
+	}
+
+	action := "remote-unlock setup"
+	if req.Key == "" {
+		action = "remote-unlock disable"
+	}
+	s.audit(&AuditRecord{Event: auditConfig, Action: action, Outcome: auditSuccess, User: acct.Name, Peer: requestPeer(r)})
+	s.Logger.Info().Str("user", acct.Name).Bool("enabled", req.Key != "").Msg("remote unlock changed")
+	s.writeResponse(w, http.StatusOK, &response{})
+}
+
+// validateRemoteUnlockKey returns an error if key is set and isn't a base64 encoded key
+func validateRemoteUnlockKey(key string) error {
+	if key == "" {
+		return nil
+	}
+	buf, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(buf) != remoteUnlockKeyLen {
+		return errors.New("invalid remote unlock key")
+	}
+	return nil
+}
+
+// RemoteChallenge requests a remote unlock challenge, returning it and when it expires
+func (c *Client) RemoteChallenge() (string, time.Time, error) {
+	resp, err := c.client.Post("http://unix/remote-unlock/challenge", "application/json", nil)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("could not post request: %w", requestError(err))
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		r := new(remoteChallengeResponse)
+		if err = json.NewDecoder(resp.Body).Decode(r); err != nil {
+			return "", time.Time{}, fmt.Errorf("could not decode response: %w", err)
+		}
+		return r.Challenge, r.Expires, nil
+	case http.StatusNotFound:
+		return "", time.Time{}, errRemoteUnlockDisabled
+	case http.StatusTooManyRequests:
+		return "", time.Time{}, errChallengeRate
+	default:
+		return "", time.Time{}, fmt.Errorf("unexpected status: %d %s", resp.StatusCode, resp.Status)
+	}
+}
+
+// SetupRemoteUnlock requests to set this machine's remote unlock key, derived from master, or to disable remote
+// unlock if master is nil. The master secret isn't sent
+func (c *Client) SetupRemoteUnlock(cred credentials, master []byte) error {
+	req := &remoteSetupRequest{Username: cred.Username}
+	if master != nil {
+		req.Key = base64.StdEncoding.EncodeToString(deriveMachineKey(master, machineID()))
+	}
+
+	resp, err := c.post("/remote-unlock", cred, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusBadRequest, http.StatusForbidden, http.StatusInternalServerError:
+		r := new(response)
+		if err := json.NewDecoder(resp.Body).Decode(r); err != nil {
+			return fmt.Errorf("could not decode response: %w", err)
+		}
+		if resp.StatusCode == http.StatusForbidden {
+			return fmt.Errorf("%w: %s", errForbidden, r.Error)
+		}
+		return errors.New(r.Error)
+	case http.StatusUnauthorized:
+		return errUnauthorized
+	case http.StatusTooManyRequests:
+		return clientLockoutError(resp)
+	case http.StatusServiceUnavailable:
+		return errBusy
+	default:
+		return fmt.Errorf("unexpected status: %d %s", resp.StatusCode, resp.Status)
+	}
+}
+
+// newMasterSecret returns a new base64 encoded remote unlock master secret
+func newMasterSecret() (string, error) {
+	buf := make([]byte, remoteMasterSecretLen)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("could not generate secret: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(buf), nil
+}
+
+// readMasterSecret reads a base64 encoded master secret from path
+func readMasterSecret(path string) ([]byte, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read secret: %w", err)
+	}
+	secret, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(buf)))
+	if err != nil || len(secret) != remoteMasterSecretLen {
+		return nil, errors.New("invalid secret")
+	}
+	return secret, nil
+}
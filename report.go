@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"text/template"
+	"time"
+)
+
+// report formats
+const (
+	reportFormatHTML = "html"
+	reportFormatText = "text"
+)
+
+// reportTemplatePath returns the path of the template that overrides the built-in template for format
+func reportTemplatePath(format string) string {
+	ext := "txt"
+	if format == reportFormatHTML {
+		ext = "html"
+	}
+	return filepath.Join(installPath, fmt.Sprintf("report.%s.tmpl", ext))
+}
+
+// Report is the data a report template is executed with
+type Report struct {
+	Machine   string
+	From      time.Time
+	To        time.Time
+	Generated time.Time
+	Version   string
+	// Periods are the times the network was locked and unlocked during the window
+	Periods []*AttestPeriod
+	// Unlocked is the total time the network was unlocked during the window
+	Unlocked time.Duration
+	// Unlocks are the changes that enabled any adapters during the window
+	Unlocks []*AuditRecord
+	// FailedAuth are the failed, denied, and locked out authentication attempts during the window
+	FailedAuth []*AuditRecord
+	// Enforcements are the adapters disabled by the reconciler during the window
+	Enforcements []*AuditRecord
+	// Events are all audit records during the window
+	Events []*AuditRecord
+	// Status is the status of the service when the report was made
+	Status *statusResponse
+}
+
+// newReport returns a Report for the window from to to, made from records, which must be in order, and status
+func newReport(records []*AuditRecord, status *statusResponse, from, to time.Time) *Report {
+	r := &Report{Machine: machineID(), From: from, To: to, Generated: time.Now(), Version: version, Status: status,
+		Periods: lockTimeline(records, from, to)}
+	r.Unlocked = unlockedTime(r.Periods)
+
+	for _, rec := range records {
+		if rec.Time.Before(from) || rec.Time.After(to) {
+			continue
+		}
+		r.Events = append(r.Events, rec)
+		switch rec.Event {
+		case auditChange:
+			if rec.Change != nil && rec.Change.Enabled {
+				r.Unlocks = append(r.Unlocks, rec)
+			}
+		case auditAuth:
+			if rec.Outcome != auditSuccess {
+				r.FailedAuth = append(r.FailedAuth, rec)
+			}
+		case auditReconcile:
+			r.Enforcements = append(r.Enforcements, rec)
+		}
+	}
+
+	return r
+}
+
+// reportFuncs are the functions available to report templates
+var reportFuncs = map[string]interface{}{
+	"time": func(t time.Time) string {
+		return t.Local().Format("2006-01-02 15:04:05")
+	},
+	"duration": func(d time.Duration) string {
+		return d.Round(time.Second).String()
+	},
+}
+
+const textReportTemplate = `Network Report: {{.Machine}}
+{{.From | time}} to {{.To | time}}
+Generated {{.Generated | time}} (version {{.Version}})
+
+Total time online: {{.Unlocked | duration}}
+
+Timeline
+{{range .Periods}}  {{.Start | time}} to {{.End | time}}  {{if .Locked}}Locked  {{else}}Unlocked{{end}}  {{.Duration | duration}}{{with .User}}  by {{.}}{{end}}{{with .Reason}} ({{.}}){{end}}
+{{end}}
+Unlocks ({{len .Unlocks}})
+{{range .Unlocks}}  {{.Time | time}}  {{.Change}}
+{{else}}  None
+{{end}}
+Failed Sign In Attempts ({{len .FailedAuth}})
+{{range .FailedAuth}}  {{.Time | time}}  {{.User}}  {{.Outcome}}  {{.Details}}
+{{else}}  None
+{{end}}
+Enforcement Actions ({{len .Enforcements}})
+{{range .Enforcements}}  {{.Time | time}}  {{.Outcome}}  {{.Details}}
+{{else}}  None
+{{end}}{{with .Status}}
+Current Status
+  Network: {{.Network}}
+{{range .Adapters}}  {{.}}
+{{end}}{{end}}`
+
+const htmlReportTemplate = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Network Report: {{.Machine}}</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #999; padding: 0.3em 0.6em; text-align: left; }
+.locked { background: #dfd; }
+.unlocked { background: #fdd; }
+</style>
+</head>
+<body>
+<h1>Network Report: {{.Machine}}</h1>
+<p>{{.From | time}} to {{.To | time}}. Generated {{.Generated | time}} (version {{.Version}}).</p>
+<p><strong>Total time online: {{.Unlocked | duration}}</strong></p>
+
+<h2>Timeline</h2>
+<table>
+<tr><th>Start</th><th>End</th><th>Network</th><th>Duration</th><th>By</th><th>Reason</th></tr>
+{{range .Periods}}<tr class="{{if .Locked}}locked{{else}}unlocked{{end}}"><td>{{.Start | time}}</td><td>{{.End | time}}</td><td>{{if .Locked}}Locked{{else}}Unlocked{{end}}</td><td>{{.Duration | duration}}</td><td>{{.User}}</td><td>{{.Reason}}</td></tr>
+{{end}}</table>
+
+<h2>Unlocks ({{len .Unlocks}})</h2>
+{{if .Unlocks}}<table>
+<tr><th>Time</th><th>Change</th></tr>
+{{range .Unlocks}}<tr><td>{{.Time | time}}</td><td>{{.Change}}</td></tr>
+{{end}}</table>{{else}}<p>None</p>{{end}}
+
+<h2>Failed Sign In Attempts ({{len .FailedAuth}})</h2>
+{{if .FailedAuth}}<table>
+<tr><th>Time</th><th>User</th><th>Outcome</th><th>Details</th></tr>
+{{range .FailedAuth}}<tr><td>{{.Time | time}}</td><td>{{.User}}</td><td>{{.Outcome}}</td><td>{{.Details}}</td></tr>
+{{end}}</table>{{else}}<p>None</p>{{end}}
+
+<h2>Enforcement Actions ({{len .Enforcements}})</h2>
+{{if .Enforcements}}<table>
+<tr><th>Time</th><th>Outcome</th><th>Details</th></tr>
+{{range .Enforcements}}<tr><td>{{.Time | time}}</td><td>{{.Outcome}}</td><td>{{.Details}}</td></tr>
+{{end}}</table>{{else}}<p>None</p>{{end}}
+{{with .Status}}
+<h2>Current Status</h2>
+<p>Network: {{.Network}}</p>
+<ul>
+{{range .Adapters}}<li>{{.}}</li>
+{{end}}</ul>
+{{end}}</body>
+</html>
+`
+
+// writeReport executes the template for format with r, writing it to w. If tmplPath is empty, the template at
+// reportTemplatePath is used if it exists, or the built-in template otherwise
+func writeReport(w io.Writer, format, tmplPath string, r *Report) error {
+	if format != reportFormatHTML && format != reportFormatText {
+		return fmt.Errorf("invalid format: %q", format)
+	}
+
+	text := textReportTemplate
+	if format == reportFormatHTML {
+		text = htmlReportTemplate
+	}
+
+	path := tmplPath
+	if path == "" {
+		path = reportTemplatePath(format)
+	}
+	buf, err := os.ReadFile(path)
+	if err == nil {
+		text = string(buf)
+	} else if tmplPath != "" || !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("could not read template: %w", err)
+	}
+
+	if format == reportFormatHTML {
+		tmpl, err := htmltemplate.New("report").Funcs(reportFuncs).Parse(text)
+		if err != nil {
+			return fmt.Errorf("could not parse template: %w", err)
+		}
+		if err = tmpl.Execute(w, r); err != nil {
+			return fmt.Errorf("could not execute template: %w", err)
+		}
+		return nil
+	}
+
+	tmpl, err := template.New("report").Funcs(reportFuncs).Parse(text)
+	if err != nil {
+		return fmt.Errorf("could not parse template: %w", err)
+	}
+	if err = tmpl.Execute(w, r); err != nil {
+		return fmt.Errorf("could not execute template: %w", err)
+	}
+	return nil
+}
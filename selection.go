@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Rule matches network adapters. Empty fields match any adapter
+type Rule struct {
+	// Name is a case-insensitive glob matched against the adapter name, e.g. "Ethernet*"
+	Name string `json:"name,omitempty"`
+	// Description is a case-insensitive glob matched against the adapter description, e.g. "*Bluetooth*"
+	Description string `json:"description,omitempty"`
+	// MAC is matched against the adapter MAC address, ignoring case and separators
+	MAC string `json:"mac,omitempty"`
+	// NdisMedium matches any of the given NDIS media types, e.g. 0 (802.3), 9 (WWAN), or 16 (802.11)
+	NdisMedium []int `json:"ndis_medium,omitempty"`
+	// Virtual matches virtual or physical adapters
+	Virtual *bool `json:"virtual,omitempty"`
+}
+
+func glob(pattern, s string) bool {
+	ok, err := path.Match(strings.ToLower(pattern), strings.ToLower(s))
+	return ok && err == nil
+}
+
+func normalizeMAC(mac string) string {
+	return strings.NewReplacer("-", "", ":", "", ".", "").Replace(strings.ToLower(mac))
+}
+
+// Match returns true if the rule matches a
+func (r *Rule) Match(a *Adapter) bool {
+	if r.Name != "" && !glob(r.Name, a.Name) {
+		return false
+	}
+	if r.Description != "" && !glob(r.Description, a.InterfaceDescription) {
+		return false
+	}
+	if r.MAC != "" && normalizeMAC(r.MAC) != normalizeMAC(a.MAC) {
+		return false
+	}
+	if len(r.NdisMedium) > 0 {
+		found := false
+		for _, m := range r.NdisMedium {
+			if m == a.NdisMedium {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if r.Virtual != nil && *r.Virtual != a.Virtual {
+		return false
+	}
+	return true
+}
+
+// Validate returns an error if any of the rule's globs are invalid
+func (r *Rule) Validate() error {
+	for _, pattern := range []string{r.Name, r.Description} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// Selection selects the network adapters that are controlled. An adapter is selected if it matches any Include rule
+// and no Exclude rule
+type Selection struct {
+	Include []*Rule `json:"include"`
+	Exclude []*Rule `json:"exclude,omitempty"`
+}
+
+// DefaultSelection selects physical Ethernet and Wi-Fi adapters
+var DefaultSelection = &Selection{
+	Include: []*Rule{{NdisMedium: []int{ndisMedium8023, ndisMediumNative80211}, Virtual: new(bool)}},
+}
+
+// Match returns true if a is selected
+func (s *Selection) Match(a *Adapter) bool {
+	for _, r := range s.Exclude {
+		if r.Match(a) {
+			return false
+		}
+	}
+	for _, r := range s.Include {
+		if r.Match(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate returns an error if any rule is invalid
+func (s *Selection) Validate() error {
+	for _, r := range append(append([]*Rule{}, s.Include...), s.Exclude...) {
+		if err := r.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// List returns the selected adapters from b
+func (s *Selection) List(b Backend) ([]*Adapter, error) {
+	adapters, err := b.List()
+	if err != nil {
+		return nil, err
+	}
+
+	selected := make([]*Adapter, 0, len(adapters))
+	for _, a := range adapters {
+		if s.Match(a) {
+			selected = append(selected, a)
+		}
+	}
+	return selected, nil
+}
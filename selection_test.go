@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestSelection(t *testing.T) {
+	physical := false
+	sel := &Selection{
+		Include: []*Rule{
+			{NdisMedium: []int{ndisMedium8023, ndisMediumNative80211}, Virtual: &physical},
+			{NdisMedium: []int{9}},
+			{Description: "*bluetooth*"},
+		},
+		Exclude: []*Rule{{MAC: "00:00:5e:00:53:ff"}, {Name: "Management*"}},
+	}
+	if err := sel.Validate(); err != nil {
+		t.Fatalf("validate error: want: nil, have: %v", err)
+	}
+
+	for _, test := range []struct {
+		adapter *Adapter
+		match   bool
+	}{
+		{&Adapter{Name: "Ethernet", MAC: "00-00-5E-00-53-01"}, true},
+		{&Adapter{Name: "Wi-Fi", NdisMedium: ndisMediumNative80211}, true},
+		{&Adapter{Name: "Cellular", NdisMedium: 9, Virtual: true}, true},
+		{&Adapter{Name: "Bluetooth Network Connection", InterfaceDescription: "Bluetooth Device (Personal Area Network)", Virtual: true}, true},
+		{&Adapter{Name: "vEthernet", Virtual: true}, false},
+		{&Adapter{Name: "Ethernet 2", MAC: "00-00-5E-00-53-FF"}, false},
+		{&Adapter{Name: "Management NIC"}, false},
+	} {
+		if match := sel.Match(test.adapter); match != test.match {
+			t.Errorf("match %s: want: %v, have: %v", test.adapter.Name, test.match, match)
+		}
+	}
+
+	if err := (&Selection{Include: []*Rule{{Name: "["}}}).Validate(); err == nil {
+		t.Errorf("invalid pattern error: want: error, have: nil")
+	}
+}
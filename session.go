@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// session limits
+const (
+	DefaultSessionDuration = 15 * time.Minute
+	maxSessions            = 64
+	tokenLen               = 32
+)
+
+var errSessionExpired = errors.New("session expired, please sign in again")
+
+// connIDKey is the context key for the ID of the connection a request was received on
+type connIDKey struct{}
+
+var lastConnID uint64
+
+// connContext adds a unique connection ID to the context of each connection, so sessions can be bound to the
+// connection they were created on
+func connContext(ctx context.Context, _ net.Conn) context.Context {
+	return context.WithValue(ctx, connIDKey{}, atomic.AddUint64(&lastConnID, 1))
+}
+
+// connID returns the ID of the connection r was received on
+func connID(r *http.Request) uint64 {
+	id, _ := r.Context().Value(connIDKey{}).(uint64)
+	return id
+}
+
+// Session is a signed in user
+type Session struct {
+	// Token authenticates requests on the connection the session was created on
+	Token   string    `json:"token"`
+	User    string    `json:"user"`
+	Role    Role      `json:"role"`
+	Expires time.Time `json:"expires"`
+}
+
+// Remaining returns the time remaining until the session expires
+func (s *Session) Remaining() time.Duration {
+	if r := until(s.Expires); r > 0 {
+		return r
+	}
+	return 0
+}
+
+type session struct {
+	account *account
+	conn    uint64
+	expires time.Time
+}
+
+// sessions are the active sessions, keyed by the SHA-256 hash of their tokens
+type sessions struct {
+	duration time.Duration
+
+	mu     sync.Mutex
+	active map[string]*session
+}
+
+func newSessions(duration time.Duration) *sessions {
+	return &sessions{duration: duration, active: make(map[string]*session)}
+}
+
+func tokenKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return string(sum[:])
+}
+
+// create returns a new Session for acct, bound to the connection with the given ID
+func (s *sessions) create(acct *account, conn uint64) (*Session, error) {
+	buf := make([]byte, tokenLen)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, fmt.Errorf("could not generate token: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := serviceClock.Now()
+	if len(s.active) >= maxSessions {
+		for key, sess := range s.active {
+			if now.After(sess.expires) {
+				delete(s.active, key)
+			}
+		}
+		if len(s.active) >= maxSessions {
+			return nil, errBusy
+		}
+	}
+
+	sess := &session{account: acct, conn: conn, expires: now.Add(s.duration)}
+	s.active[tokenKey(token)] = sess
+	return &Session{Token: token, User: acct.Name, Role: acct.Role, Expires: sess.expires}, nil
+}
+
+// lookup returns the account for token if it hasn't expired and was created on the connection with the given ID
+func (s *sessions) lookup(token string, conn uint64) (*account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := tokenKey(token)
+	sess, ok := s.active[key]
+	if !ok || sess.conn != conn {
+		return nil, errUnauthorized
+	}
+	if serviceClock.Now().After(sess.expires) {
+		delete(s.active, key)
+		return nil, errSessionExpired
+	}
+	return sess.account, nil
+}
+
+// revoke removes the session for token
+func (s *sessions) revoke(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.active, tokenKey(token))
+}
+
+// revokeUser removes all sessions for the named user, returning the number of sessions removed
+func (s *sessions) revokeUser(name string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for key, sess := range s.active {
+		if strings.EqualFold(sess.account.Name, name) {
+			delete(s.active, key)
+			n++
+		}
+	}
+	return n
+}
+
+// bearerToken returns the session token from r's Authorization header, or an empty string if there isn't one
+func bearerToken(r *http.Request) string {
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, prefix) {
+		return ""
+	}
+	return strings.TrimPrefix(auth, prefix)
+}
+
+type loginRequest struct {
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Code     string `json:"code,omitempty"`
+}
+
+type loginResponse struct {
+	Error   string   `json:"error,omitempty"`
+	Session *Session `json:"session,omitempty"`
+}
+
+// Login is an HTTP handler that authenticates a user and creates a session bound to the client's connection
+func (s *Server) Login(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		s.Logger.Warn().Err(fmt.Errorf("invalid method: %s", r.Method)).Send()
+		return
+	}
+
+	req := new(loginRequest)
+	body, ok := s.readRequest(w, r, req)
+	if !ok {
+		return
+	}
+
+	// sessions can't be created from other sessions, so they can't be extended without the password
+	if bearerToken(r) != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		s.Logger.Warn().Msg("login with session token")
+		return
+	}
+
+	acct := s.authorize(w, r, body, credentials{Username: req.Username, Password: req.Password, Code: req.Code})
+	if acct == nil {
+		return
+	}
+
+	sess, err := s.sessions.create(acct, connID(r))
+	if errors.Is(err, errBusy) {
+		s.Logger.Warn().Str("user", acct.Name).Msg("too many sessions")
+		s.writeBusy(w)
+		return
+	} else if err != nil {
+		s.Logger.Error().Err(err).Send()
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	s.Logger.Info().Str("user", acct.Name).Time("expires", sess.Expires).Msg("signed in")
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(&loginResponse{Session: sess}); err != nil {
+		s.Logger.Error().Err(fmt.Errorf("could not encode response: %w", err)).Send()
+	}
+}
+
+// Logout is an HTTP handler that revokes the session in the request's Authorization header
+func (s *Server) Logout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		s.Logger.Warn().Err(fmt.Errorf("invalid method: %s", r.Method)).Send()
+		return
+	}
+
+	token := bearerToken(r)
+	acct, err := s.sessions.lookup(token, connID(r))
+	s.sessions.revoke(token)
+	if err == nil {
+		s.Logger.Info().Str("user", acct.Name).Msg("signed out")
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Login authenticates and creates a session bound to c's connection. Requests without a password or code use the
+// session until it expires or Logout is called
+func (c *Client) Login(cred credentials) (*Session, error) {
+	if cred.Password == "" && cred.Code == "" {
+		return nil, errUnauthorized
+	}
+	resp, err := c.post("/login", cred, &loginRequest{Username: cred.Username})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		r := new(loginResponse)
+		if err = json.NewDecoder(resp.Body).Decode(r); err != nil {
+			return nil, fmt.Errorf("could not decode response: %w", err)
+		}
+		c.mu.Lock()
+		c.session = r.Session
+		c.mu.Unlock()
+		return r.Session, nil
+	case http.StatusUnauthorized:
+		return nil, errUnauthorized
+	case http.StatusTooManyRequests:
+		return nil, clientLockoutError(resp)
+	case http.StatusServiceUnavailable:
+		return nil, errBusy
+	default:
+		return nil, fmt.Errorf("unexpected status: %d %s", resp.StatusCode, resp.Status)
+	}
+}
+
+// Session returns c's session, or nil if c isn't signed in or the session expired
+func (c *Client) Session() *Session {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.session != nil && c.session.Remaining() == 0 {
+		c.session = nil
+	}
+	return c.session
+}
+
+// Logout revokes c's session
+func (c *Client) Logout() error {
+	c.mu.Lock()
+	sess := c.session
+	c.session = nil
+	c.mu.Unlock()
+	if sess == nil {
+		return nil
+	}
+
+	req, err := http.NewRequest(http.MethodPost, "http://unix/logout", nil)
+	if err != nil {
+		return fmt.Errorf("could not create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+sess.Token)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not post request: %w", requestError(err))
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %d %s", resp.StatusCode, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// SimBackend is an in-memory Backend used to exercise the server, client, and GUI without WMI
+type SimBackend struct {
+	mu       sync.Mutex
+	latency  time.Duration
+	fault    func(op, name string) error
+	adapters []*Adapter
+	watchers []chan struct{}
+}
+
+// NewSimBackend returns a new SimBackend with copies of the given adapters
+func NewSimBackend(adapters ...*Adapter) *SimBackend {
+	b := &SimBackend{}
+	for _, a := range adapters {
+		adapter := *a
+		b.adapters = append(b.adapters, &adapter)
+	}
+	return b
+}
+
+// SetLatency sets the latency added to every operation
+func (b *SimBackend) SetLatency(latency time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.latency = latency
+}
+
+// SetFault sets a function that's called before every operation with the operation ("list", "enable", or "disable")
+// and adapter name, if any. A returned error fails the operation. fault may panic to simulate a WMI crash. A nil fault
+// clears it
+func (b *SimBackend) SetFault(fault func(op, name string) error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.fault = fault
+}
+
+func (b *SimBackend) do(op, name string) error {
+	b.mu.Lock()
+	latency, fault := b.latency, b.fault
+	b.mu.Unlock()
+
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+	if fault != nil {
+		return fault(op, name)
+	}
+	return nil
+}
+
+// List implements Backend
+func (b *SimBackend) List() ([]*Adapter, error) {
+	if err := b.do("list", ""); err != nil {
+		return nil, fmt.Errorf("could not query net adapters: %w", err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	adapters := make([]*Adapter, 0, len(b.adapters))
+	for _, a := range b.adapters {
+		adapter := *a
+		adapters = append(adapters, &adapter)
+	}
+	return adapters, nil
+}
+
+// notify notifies watchers of a change. b.mu must be held
+func (b *SimBackend) notify() {
+	for _, ch := range b.watchers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (b *SimBackend) set(name string, enabled bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, a := range b.adapters {
+		if a.Name == name {
+			a.InterfaceAdminStatus, a.MediaConnectState = interfaceAdminStatusDown, mediaConnectStateDisconnected
+			if enabled {
+				a.InterfaceAdminStatus, a.MediaConnectState = interfaceAdminStatusUp, mediaConnectStateConnected
+			}
+			b.notify()
+			return nil
+		}
+	}
+	return fmt.Errorf("could not find %s", name)
+}
+
+// Add simulates a new adapter being plugged in
+func (b *SimBackend) Add(a *Adapter) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	adapter := *a
+	b.adapters = append(b.adapters, &adapter)
+	b.notify()
+}
+
+// Watch implements Watcher
+func (b *SimBackend) Watch(ctx context.Context) (<-chan struct{}, error) {
+	ch := make(chan struct{}, 1)
+
+	b.mu.Lock()
+	b.watchers = append(b.watchers, ch)
+	b.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		for i, w := range b.watchers {
+			if w == ch {
+				b.watchers = append(b.watchers[:i], b.watchers[i+1:]...)
+				break
+			}
+		}
+		close(ch)
+	}()
+
+	return ch, nil
+}
+
+// Enable implements Backend
+func (b *SimBackend) Enable(name string) error {
+	if err := b.do("enable", name); err != nil {
+		return fmt.Errorf("could not enable %s: %w", name, err)
+	}
+	return b.set(name, true)
+}
+
+// Disable implements Backend
+func (b *SimBackend) Disable(name string) error {
+	if err := b.do("disable", name); err != nil {
+		return fmt.Errorf("could not disable %s: %w", name, err)
+	}
+	return b.set(name, false)
+}
+
+// Close implements Backend. The SimBackend remains usable after Close
+func (b *SimBackend) Close() error {
+	return nil
+}
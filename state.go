@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var statePath = filepath.Join(installPath, "state.json")
+
+// Snapshot is the set of adapters that were enabled before the network was disabled
+type Snapshot struct {
+	Time     time.Time `json:"time"`
+	Adapters []string  `json:"adapters"`
+}
+
+// Contains returns true if the named adapter is in the snapshot
+func (s *Snapshot) Contains(name string) bool {
+	for _, n := range s.Adapters {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Grant temporarily enables the network until it expires
+type Grant struct {
+	Start   time.Time `json:"start"`
+	Expires time.Time `json:"expires"`
+	// Adapters are the adapters enabled by the grant. If empty, all selected adapters were enabled
+	Adapters []string `json:"adapters,omitempty"`
+}
+
+// Remaining returns the time remaining until the grant expires
+func (g *Grant) Remaining() time.Duration {
+	if r := until(g.Expires); r > 0 {
+		return r
+	}
+	return 0
+}
+
+// Change is a change to the network status
+type Change struct {
+	Time time.Time `json:"time"`
+	User string    `json:"user"`
+	// Approvers are the other users that approved the change, if it required more than one person
+	Approvers []string `json:"approvers,omitempty"`
+	// Reason and Category explain why the change was made
+	Reason   string `json:"reason,omitempty"`
+	Category string `json:"category,omitempty"`
+	Enabled  bool   `json:"enabled"`
+	// Adapters are the adapters that were requested to change. If empty, all selected adapters were requested
+	Adapters []string `json:"adapters,omitempty"`
+	// Changed are the adapters that were changed
+	Changed []string `json:"changed"`
+	Force   bool     `json:"force,omitempty"`
+	// Expires is set if the change created a Grant
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// String returns a human readable description of the change
+func (c *Change) String() string {
+	method := "Disabled"
+	if c.Enabled {
+		method = "Enabled"
+	}
+	user := c.User
+	if len(c.Approvers) > 0 {
+		user = fmt.Sprintf("%s and %s", strings.Join(c.Approvers, ", "), c.User)
+	}
+	s := fmt.Sprintf("%s by %s at %s", method, user, c.Time.Local().Format("Jan 2 15:04"))
+	if c.Category != "" {
+		s += fmt.Sprintf(" [%s]", c.Category)
+	}
+	if c.Reason != "" {
+		s += ": " + c.Reason
+	}
+	return s
+}
+
+// State is the service state that persists across service restarts
+type State struct {
+	// Locked is the desired state of the network. While locked, the reconciler disables any selected adapter that is
+	// enabled, except for adapters in Allowed
+	Locked bool `json:"locked"`
+	// Allowed are adapters that were individually enabled while locked
+	Allowed []string `json:"allowed,omitempty"`
+	// Snapshot is nil unless the network has been disabled
+	Snapshot *Snapshot `json:"snapshot,omitempty"`
+	// Grant is nil unless the network has been temporarily enabled
+	Grant *Grant `json:"grant,omitempty"`
+	// LastChange is the last change made to the network status
+	LastChange *Change `json:"last_change,omitempty"`
+	// Exam is nil unless an exam is scheduled or in progress
+	Exam *Exam `json:"exam,omitempty"`
+}
+
+// IsAllowed returns true if the named adapter was individually enabled while locked
+func (st *State) IsAllowed(name string) bool {
+	for _, n := range st.Allowed {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// allow adds or removes the adapters from Allowed
+func (st *State) allow(adapters []*Adapter, allowed bool) {
+	for _, a := range adapters {
+		if allowed && !st.IsAllowed(a.Name) {
+			st.Allowed = append(st.Allowed, a.Name)
+		} else if !allowed {
+			for i, name := range st.Allowed {
+				if name == a.Name {
+					st.Allowed = append(st.Allowed[:i], st.Allowed[i+1:]...)
+					break
+				}
+			}
+		}
+	}
+}
+
+// LoadState reads the State at path. If path doesn't exist, an empty State is returned
+func LoadState(path string) (*State, error) {
+	st := new(State)
+
+	buf, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return st, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not read state: %w", err)
+	}
+
+	if err = json.Unmarshal(buf, st); err != nil {
+		return nil, fmt.Errorf("could not decode state: %w", err)
+	}
+
+	return st, nil
+}
+
+// Save writes the State to path
+func (st *State) Save(path string) error {
+	buf, err := json.MarshalIndent(st, "", "    ")
+	if err != nil {
+		return fmt.Errorf("could not encode state: %w", err)
+	}
+
+	if err = writeFileAtomic(path, buf, false); err != nil {
+		return fmt.Errorf("could not write state: %w", err)
+	}
+
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file and renames it to path, so path is never partially written. If
+// protect is true, access to the file is restricted with protectFile
+func writeFileAtomic(path string, data []byte, protect bool) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("could not create temporary file: %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("could not write temporary file: %w", err)
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("could not sync temporary file: %w", err)
+	}
+	if err = f.Close(); err != nil {
+		return fmt.Errorf("could not close temporary file: %w", err)
+	}
+	if protect {
+		if err = protectFile(f.Name()); err != nil {
+			return err
+		}
+	} else if err = os.Chmod(f.Name(), 0644); err != nil {
+		return fmt.Errorf("could not set permissions: %w", err)
+	}
+
+	if err = os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("could not rename temporary file: %w", err)
+	}
+
+	return nil
+}
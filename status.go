@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// statusResponse is the current status of the service
+type statusResponse struct {
+	Adapters []*Adapter `json:"adapters"`
+	// Error is set if the adapters couldn't be listed
+	Error string `json:"error,omitempty"`
+	// Locked is the desired state of the network
+	Locked     bool     `json:"locked"`
+	Allowed    []string `json:"allowed,omitempty"`
+	Grant      *Grant   `json:"grant,omitempty"`
+	LastChange *Change  `json:"last_change,omitempty"`
+	// Approval is the enable request waiting for a second user, if any
+	Approval *Approval `json:"approval,omitempty"`
+	// Exam is the scheduled or in progress exam, if any
+	Exam *Exam `json:"exam,omitempty"`
+	// ReasonRequired is true if changes require a reason
+	ReasonRequired bool `json:"reason_required,omitempty"`
+	// ReasonCategories are the categories a reason can be given
+	ReasonCategories []string `json:"reason_categories,omitempty"`
+	// Lockouts are the peers whose authentication attempts are currently delayed or locked out
+	Lockouts []*Lockout `json:"lockouts,omitempty"`
+	// Peer is the identity the service sees for the caller, if it could be read
+	Peer *Peer `json:"peer,omitempty"`
+	// Verify are the password hash verifier metrics
+	Verify  *verifyMetrics `json:"verify,omitempty"`
+	Version string         `json:"version"`
+}
+
+// Network returns a description of the network state from the adapters, e.g. "Disabled (locked)" or "Partially
+// enabled (1 of 2 adapters)"
+func (st *statusResponse) Network() string {
+	if st.Error != "" && len(st.Adapters) == 0 {
+		return "Unknown"
+	}
+
+	enabled := countEnabled(st.Adapters)
+	var state string
+	switch {
+	case len(st.Adapters) == 0:
+		state = "No adapters"
+	case enabled == 0:
+		state = "Disabled"
+	case enabled == len(st.Adapters):
+		state = "Enabled"
+	default:
+		state = fmt.Sprintf("Partially enabled (%d of %d adapters)", enabled, len(st.Adapters))
+	}
+	if st.Locked {
+		state += " (locked)"
+	}
+	return state
+}
+
+// listAdapters returns the selected adapters
+func (s *Server) listAdapters() (adapters []*Adapter, err error) {
+	// recover panics, because WMI seems to be pretty buggy
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	conn, err := s.NewBackend()
+	if err != nil {
+		return nil, fmt.Errorf("could not create backend: %w", err)
+	}
+	defer conn.Close()
+
+	adapters, err = s.Config.Adapters.List(conn)
+	if err != nil {
+		return nil, fmt.Errorf("could not list adapters: %w", err)
+	}
+
+	return adapters, nil
+}
+
+// Status is an HTTP handler that returns the current status of the service
+func (s *Server) Status(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		s.Logger.Warn().Err(fmt.Errorf("invalid method: %s", r.Method)).Send()
+		return
+	}
+
+	resp := &statusResponse{Version: version}
+
+	adapters, err := s.listAdapters()
+	if err != nil {
+		s.Logger.Error().Err(err).Send()
+		resp.Error = "Error (List): Please try again later"
+	}
+	resp.Adapters = adapters
+
+	s.mu.Lock()
+	resp.Locked = s.State.Locked
+	resp.Allowed = append([]string(nil), s.State.Allowed...)
+	resp.Grant = s.State.Grant
+	resp.LastChange = s.State.LastChange
+	resp.Approval = s.pendingApproval()
+	if e := s.State.Exam; e != nil {
+		exam := *e
+		resp.Exam = &exam
+	}
+	resp.ReasonRequired = s.Config.RequireReason
+	resp.ReasonCategories = s.Config.ReasonCategories
+	s.mu.Unlock()
+	resp.Lockouts = s.limiter.lockouts()
+	resp.Verify = s.verifier.stats()
+	resp.Peer = requestPeer(r)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(resp); err != nil {
+		s.Logger.Error().Err(fmt.Errorf("could not encode response: %w", err)).Send()
+	}
+}
+
+// Status returns the current status of the service
+func (c *Client) Status() (*statusResponse, error) {
+	resp, err := c.client.Get("http://unix/status")
+	if err != nil {
+		return nil, fmt.Errorf("could not get status: %w", requestError(err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %d %s", resp.StatusCode, resp.Status)
+	}
+
+	status := new(statusResponse)
+	if err = json.NewDecoder(resp.Body).Decode(status); err != nil {
+		return nil, fmt.Errorf("could not decode status: %w", err)
+	}
+
+	return status, nil
+}
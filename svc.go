@@ -26,6 +26,8 @@ var ServiceConfig = &svc.ServiceConfig{
 	AutoRecovery:     true,
 }
 
+var installPath = ServiceConfig.InstallPath
+
 type RunServiceCmd struct {
 	FG bool `help:"run service in foreground"`
 }
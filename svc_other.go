@@ -0,0 +1,13 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// ServiceCLI is empty because the service commands are only available on Windows
+type ServiceCLI struct{}
+
+var installPath = filepath.Join(os.TempDir(), "go-win-netcontrol")
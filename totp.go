@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/korylprince/go-win-netcontrol/hash"
+)
+
+// DefaultTOTPSkew is the default number of time steps before and after the current time that TOTP codes are accepted
+const DefaultTOTPSkew = 1
+
+// totpIssuer is shown for the secret in authenticator apps
+const totpIssuer = "Network Control"
+
+// totpInfo is a user's new TOTP secret, returned once so it can be added to an authenticator app
+type totpInfo struct {
+	Secret string `json:"secret"`
+	// URI is the otpauth:// provisioning URI
+	URI string `json:"uri"`
+}
+
+// lookupTOTP returns the account and TOTP secret for name. If name doesn't exist or has no TOTP secret, a nil account
+// and a random TOTP are returned
+func (s *Server) lookupTOTP(name string) (*account, *hash.TOTP, error) {
+	s.mu.Lock()
+	u := findUser(s.Config.Users, name)
+	s.mu.Unlock()
+
+	if u == nil || u.TOTPSecret == "" {
+		t, err := hash.NewTOTP()
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not generate TOTP secret: %w", err)
+		}
+		return nil, t, nil
+	}
+
+	t, err := hash.ParseTOTP(u.TOTPSecret)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not parse TOTP secret of user %s: %w", u.Name, err)
+	}
+	return &account{Name: u.Name, Role: u.Role, named: true}, t, nil
+}
+
+// useTOTP records counter as used for name, returning false if it, or a later counter, was already used
+func (s *Server) useTOTP(name string, counter uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := strings.ToLower(name)
+	if last, ok := s.totpUsed[key]; ok && counter <= last {
+		return false
+	}
+	s.totpUsed[key] = counter
+	return true
+}
+
+// totpParams returns the parameters used to derive the key for a TOTP challenge's proof from the code. The salt is
+// taken from the challenge's nonce, so both sides derive the same key without sending the parameters
+func totpParams(nonce []byte) *hash.Params {
+	return &hash.Params{Salt: nonce[:hash.SaltLen], Time: hashTime, Memory: hashMemory, Threads: hashThreads}
+}
+
+// authenticateCodeProof returns the account for a challenge-response proof of msg, created with the key derived from
+// name's TOTP code for the challenge with nonce
+func (s *Server) authenticateCodeProof(name string, nonce, proof, msg []byte) (*account, error) {
+	acct, t, err := s.lookupTOTP(name)
+	if err != nil {
+		s.Logger.Error().Err(err).Send()
+		return nil, errUnauthorized
+	}
+	counter, err := t.ValidateProof(msg, proof, totpParams(nonce), serviceClock.Now(), s.Config.totpSkew())
+	if err != nil || acct == nil || !s.useTOTP(acct.Name, counter) {
+		return nil, errUnauthorized
+	}
+	return acct, nil
+}
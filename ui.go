@@ -3,6 +3,9 @@ package main
 import (
 	"errors"
 	"fmt"
+	"strings"
+	"sync"
+	"time"
 
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/app"
@@ -15,6 +18,21 @@ import (
 
 var errInvalidPassword = errors.New("invalid password")
 
+// grantDurations are the durations the network can be enabled for in the GUI
+var grantDurations = []struct {
+	Label    string
+	Duration time.Duration
+}{
+	{"Until disabled", 0},
+	{"5 minutes", 5 * time.Minute},
+	{"15 minutes", 15 * time.Minute},
+	{"30 minutes", 30 * time.Minute},
+	{"1 hour", time.Hour},
+}
+
+// statusRefreshInterval is the number of seconds between status refreshes
+const statusRefreshInterval = 5
+
 func popup(a fyne.App, msg string) {
 	win := a.NewWindow("Message")
 	win.SetContent(container.NewVBox(
@@ -25,46 +43,387 @@ func popup(a fyne.App, msg string) {
 	win.Show()
 }
 
-func updateStatusText(conn *Conn, status binding.String) error {
-	all, enabled, err := conn.Count()
+// formatRemaining formats d as minutes and seconds, e.g. 4:32
+func formatRemaining(d time.Duration) string {
+	d = d.Round(time.Second)
+	return fmt.Sprintf("%d:%02d", int(d.Minutes()), int(d.Seconds())%60)
+}
+
+// gui holds the GUI state
+type gui struct {
+	client   *Client
+	status   binding.String
+	details  binding.String
+	grant    binding.String
+	signedIn binding.String
+	user     binding.String
+	passwd   binding.String
+	// code is true if passwd is a TOTP code
+	code     binding.Bool
+	force    binding.Bool
+	reason   binding.String
+	category *widget.Select
+	duration *widget.Select
+
+	mu      sync.Mutex
+	expires time.Time
+}
+
+func (g *gui) updateStatusText() error {
+	st, err := g.client.Status()
 	if err != nil {
 		return fmt.Errorf("could not get status: %w", err)
 	}
+	if st.Error != "" {
+		return errors.New(st.Error)
+	}
+	g.setGrant(st.Grant)
 
+	adapters := st.Adapters
+	enabled := countEnabled(adapters)
 	if enabled == 0 {
-		err = status.Set("Network Disabled")
-	} else if all == enabled {
-		err = status.Set("Network Enabled")
+		err = g.status.Set("Network Disabled")
+	} else if len(adapters) == enabled {
+		err = g.status.Set("Network Enabled")
 	} else {
-		err = status.Set("Network Partially Enabled")
+		err = g.status.Set("Network Partially Enabled")
 	}
 
 	if err != nil {
 		return fmt.Errorf("could not update status: %w", err)
 	}
 
+	// categories are only shown if they're configured
+	if len(st.ReasonCategories) > 0 {
+		g.category.Options = st.ReasonCategories
+		g.category.Refresh()
+		g.category.Show()
+	} else {
+		g.category.Hide()
+	}
+
+	lines := make([]string, 0, len(adapters)+1)
+	for _, a := range adapters {
+		lines = append(lines, a.String())
+	}
+	if st.LastChange != nil {
+		lines = append(lines, fmt.Sprintf("Last change: %s", st.LastChange))
+	}
+	if st.Approval != nil {
+		lines = append(lines, st.Approval.String())
+	}
+	if st.Exam != nil {
+		lines = append(lines, fmt.Sprintf("Exam: %s", st.Exam))
+	}
+	for _, l := range st.Lockouts {
+		lines = append(lines, l.String())
+	}
+	if err = g.details.Set(strings.Join(lines, "\n")); err != nil {
+		return fmt.Errorf("could not update adapter details: %w", err)
+	}
+
 	return nil
 }
 
-func setStatus(conn *Conn, enabled bool, passwd, status binding.String) error {
-	p, err := passwd.Get()
+// updateGrantText updates the grant countdown, returning true if the grant expired since the last update
+func (g *gui) updateGrantText() (bool, error) {
+	g.mu.Lock()
+	expires := g.expires
+	expired := !expires.IsZero() && time.Until(expires) <= 0
+	if expired {
+		g.expires = time.Time{}
+	}
+	g.mu.Unlock()
+
+	text := ""
+	if !expires.IsZero() && !expired {
+		text = fmt.Sprintf("Network enabled for %s", formatRemaining(time.Until(expires)))
+	}
+	if err := g.grant.Set(text); err != nil {
+		return expired, fmt.Errorf("could not update grant: %w", err)
+	}
+	return expired, nil
+}
+
+func (g *gui) setGrant(grant *Grant) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.expires = time.Time{}
+	if grant != nil {
+		g.expires = grant.Expires
+	}
+}
+
+// credentials returns the entered user and password, or code if the one-time code box is checked. Codes without a
+// user are unlock codes from a printed sheet
+func (g *gui) credentials() (credentials, error) {
+	u, err := g.user.Get()
 	if err != nil {
-		return fmt.Errorf("could not get password: %w", err)
+		return credentials{}, fmt.Errorf("could not get user: %w", err)
 	}
 
-	if !Validate(p) {
-		return errInvalidPassword
+	p, err := g.passwd.Get()
+	if err != nil {
+		return credentials{}, fmt.Errorf("could not get password: %w", err)
 	}
 
-	if err = NewClient().SetStatus(p, enabled); err != nil {
-		return fmt.Errorf("could not set status: %w", err)
+	code, err := g.code.Get()
+	if err != nil {
+		return credentials{}, fmt.Errorf("could not get code: %w", err)
 	}
 
-	if err = passwd.Set(""); err != nil {
+	if code && strings.TrimSpace(u) == "" {
+		return credentials{UnlockCode: strings.TrimSpace(p)}, nil
+	}
+	if code {
+		return credentials{Username: strings.TrimSpace(u), Code: strings.TrimSpace(p)}, nil
+	}
+	return credentials{Username: strings.TrimSpace(u), Password: p}, nil
+}
+
+// setStatus enables or disables the network, authenticating with remote if set or the entered credentials otherwise.
+// If the request needs a second person to approve it, the pending Approval is returned
+func (g *gui) setStatus(enabled bool, remote *remoteUnlock) (*Approval, error) {
+	cred, err := g.credentials()
+	if err != nil {
+		return nil, err
+	}
+	if remote != nil {
+		cred = credentials{Remote: remote}
+	}
+
+	f, err := g.force.Get()
+	if err != nil {
+		return nil, fmt.Errorf("could not get force: %w", err)
+	}
+
+	reason, err := g.reason.Get()
+	if err != nil {
+		return nil, fmt.Errorf("could not get reason: %w", err)
+	}
+
+	req := &request{
+		Username: cred.Username, Password: cred.Password, Code: cred.Code, UnlockCode: cred.UnlockCode, RemoteUnlock: cred.Remote,
+		Enabled: enabled, Force: f && enabled, Reason: reason, Category: g.category.Selected,
+	}
+	if enabled {
+		for _, d := range grantDurations {
+			if d.Label == g.duration.Selected {
+				req.Duration = int(d.Duration.Seconds())
+			}
+		}
+	}
+
+	resp, err := g.client.SetStatus(req)
+	if errors.Is(err, errUnauthorized) {
+		return nil, errInvalidPassword
+	} else if errors.Is(err, errForbidden) || errors.Is(err, errLockedOut) || errors.Is(err, errSessionExpired) {
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("could not set status: %w", err)
+	}
+
+	// the second person enters their own credentials
+	if err = g.passwd.Set(""); err != nil {
+		return nil, fmt.Errorf("could not clear password: %w", err)
+	}
+
+	if resp.Pending != nil {
+		if err = g.user.Set(""); err != nil {
+			return nil, fmt.Errorf("could not clear user: %w", err)
+		}
+		return resp.Pending, g.updateStatusText()
+	}
+	g.setGrant(resp.Grant)
+
+	if err = g.force.Set(false); err != nil {
+		return nil, fmt.Errorf("could not clear force: %w", err)
+	}
+
+	if err = g.reason.Set(""); err != nil {
+		return nil, fmt.Errorf("could not clear reason: %w", err)
+	}
+	g.category.ClearSelected()
+
+	if _, err = g.updateGrantText(); err != nil {
+		return nil, err
+	}
+
+	return nil, g.updateStatusText()
+}
+
+// enabledMessage returns the message shown after an enable request
+func enabledMessage(pending *Approval) string {
+	if pending == nil {
+		return "Network Enabled"
+	}
+	return fmt.Sprintf("Approved by %s. A second person must enter their credentials and click Enable within %s", pending.User, formatRemaining(pending.Remaining()))
+}
+
+// updateSessionText updates the sign in countdown
+func (g *gui) updateSessionText() error {
+	text := ""
+	if sess := g.client.Session(); sess != nil {
+		text = fmt.Sprintf("Signed in as %s, expires in %d min", sess.User, int(sess.Remaining().Round(time.Minute).Minutes()))
+	}
+	if err := g.signedIn.Set(text); err != nil {
+		return fmt.Errorf("could not update sign in: %w", err)
+	}
+	return nil
+}
+
+// signIn creates a session, so actions don't require the password until it expires or the GUI is locked
+func (g *gui) signIn() error {
+	cred, err := g.credentials()
+	if err != nil {
+		return err
+	}
+
+	if _, err = g.client.Login(cred); errors.Is(err, errUnauthorized) {
+		return errInvalidPassword
+	} else if errors.Is(err, errLockedOut) {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("could not sign in: %w", err)
+	}
+
+	if err = g.passwd.Set(""); err != nil {
 		return fmt.Errorf("could not clear password: %w", err)
 	}
 
-	return updateStatusText(conn, status)
+	return g.updateSessionText()
+}
+
+// lock ends the session
+func (g *gui) lock() error {
+	err := g.client.Logout()
+	if textErr := g.updateSessionText(); textErr != nil {
+		return textErr
+	}
+	if err != nil {
+		return fmt.Errorf("could not sign out: %w", err)
+	}
+	return nil
+}
+
+// remoteUnlock shows a remote unlock challenge to read to IT, and enables the network with their response
+func (g *gui) remoteUnlock(a fyne.App) {
+	challenge, expires, err := g.client.RemoteChallenge()
+	if err != nil {
+		popup(a, err.Error())
+		return
+	}
+
+	win := a.NewWindow("Remote Unlock")
+	respEtr := widget.NewEntry()
+	respEtr.SetPlaceHolder("Response")
+	unlockBtn := widget.NewButton("Unlock", func() {
+		pending, err := g.setStatus(true, &remoteUnlock{Challenge: challenge, Response: respEtr.Text})
+		win.Close()
+		if err == nil {
+			popup(a, enabledMessage(pending))
+		} else {
+			popup(a, err.Error())
+		}
+	})
+	win.SetContent(container.NewVBox(
+		widget.NewLabel("Read this challenge to IT:"),
+		widget.NewLabelWithStyle(challenge, fyne.TextAlignCenter, fyne.TextStyle{Monospace: true, Bold: true}),
+		widget.NewLabel(fmt.Sprintf("Expires at %s", expires.Local().Format("15:04"))),
+		respEtr,
+		container.NewHBox(layout.NewSpacer(), unlockBtn, widget.NewButton("Cancel", func() { win.Close() }), layout.NewSpacer()),
+	))
+	win.Show()
+}
+
+// exam starts or ends an exam with the entered credentials. If ending the exam needs a second person to approve it,
+// the response's Pending is set
+func (g *gui) exam(req *examRequest) (*response, error) {
+	cred, err := g.credentials()
+	if err != nil {
+		return nil, err
+	}
+	req.Username, req.Password, req.Code = cred.Username, cred.Password, cred.Code
+	req.Category = g.category.Selected
+
+	resp, err := g.client.Exam(req)
+	if errors.Is(err, errUnauthorized) {
+		return nil, errInvalidPassword
+	} else if errors.Is(err, errForbidden) || errors.Is(err, errLockedOut) || errors.Is(err, errSessionExpired) {
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("could not %s exam: %w", req.Action, err)
+	}
+
+	if err = g.passwd.Set(""); err != nil {
+		return nil, fmt.Errorf("could not clear password: %w", err)
+	}
+	if resp.Pending != nil {
+		if err = g.user.Set(""); err != nil {
+			return nil, fmt.Errorf("could not clear user: %w", err)
+		}
+	}
+
+	return resp, g.updateStatusText()
+}
+
+// examWindow shows a window to start or end an exam with the credentials entered in the main window
+func (g *gui) examWindow(a fyne.App) {
+	win := a.NewWindow("Exam")
+	nameEtr := widget.NewEntry()
+	nameEtr.SetPlaceHolder("Name, e.g. Regional Math 2026")
+	startEtr := widget.NewEntry()
+	startEtr.SetPlaceHolder("Start, e.g. 9:00 (default: now)")
+	endEtr := widget.NewEntry()
+	endEtr.SetPlaceHolder("End, e.g. 12:00")
+	notesEtr := widget.NewMultiLineEntry()
+	notesEtr.SetPlaceHolder("Notes")
+
+	startBtn := widget.NewButton("Start Exam", func() {
+		now := time.Now()
+		req := &examRequest{Action: examActionStart, Name: nameEtr.Text, Notes: notesEtr.Text}
+		var err error
+		if strings.TrimSpace(startEtr.Text) != "" {
+			if req.Start, err = parseExamTime(strings.TrimSpace(startEtr.Text), now); err != nil {
+				popup(a, err.Error())
+				return
+			}
+		}
+		if req.End, err = parseExamTime(strings.TrimSpace(endEtr.Text), now); err != nil {
+			popup(a, err.Error())
+			return
+		}
+
+		resp, err := g.exam(req)
+		if err != nil {
+			popup(a, err.Error())
+			return
+		}
+		win.Close()
+		popup(a, fmt.Sprintf("Exam scheduled: %s", resp.Exam))
+	})
+
+	endBtn := widget.NewButton("End Exam", func() {
+		resp, err := g.exam(&examRequest{Action: examActionEnd})
+		if err != nil {
+			popup(a, err.Error())
+			return
+		}
+		win.Close()
+		if resp.Pending != nil {
+			popup(a, fmt.Sprintf("Approved by %s. A second person must enter their credentials and click End Exam within %s", resp.Pending.User, formatRemaining(resp.Pending.Remaining())))
+			return
+		}
+		popup(a, "Exam Ended")
+	})
+
+	win.SetContent(container.NewVBox(
+		widget.NewLabel("Enter your credentials in the main window first"),
+		nameEtr, startEtr, endEtr, notesEtr,
+		container.NewHBox(layout.NewSpacer(), startBtn, endBtn, widget.NewButton("Cancel", func() { win.Close() }), layout.NewSpacer()),
+	))
+	win.Resize(fyne.NewSize(350, 250))
+	win.Show()
 }
 
 func runUI() {
@@ -72,34 +431,56 @@ func runUI() {
 	myapp.Settings().SetTheme(theme.DarkTheme())
 	win := myapp.NewWindow("Internet Control")
 
-	conn, err := NewConn()
-	if err != nil {
-		err = fmt.Errorf("could not create WMI conn: %w", err)
-		popup(myapp, err.Error())
-		win.ShowAndRun()
-		return
+	g := &gui{
+		client:   NewClient(),
+		status:   binding.NewString(),
+		details:  binding.NewString(),
+		grant:    binding.NewString(),
+		signedIn: binding.NewString(),
+		user:     binding.NewString(),
+		passwd:   binding.NewString(),
+		code:     binding.NewBool(),
+		force:    binding.NewBool(),
+		reason:   binding.NewString(),
 	}
-	defer conn.Close()
 
-	status := binding.NewString()
-	statusLbl := widget.NewLabelWithData(status)
-	passwd := binding.NewString()
+	statusLbl := widget.NewLabelWithData(g.status)
+	detailsLbl := widget.NewLabelWithData(g.details)
+	grantLbl := widget.NewLabelWithData(g.grant)
+	userEtr := widget.NewEntryWithData(g.user)
+	userEtr.SetPlaceHolder("User (optional)")
 	passwdEtr := widget.NewEntry()
 	passwdEtr.Password = true
 	passwdEtr.Wrapping = fyne.TextTruncate
-	passwdEtr.Bind(passwd)
+	passwdEtr.Bind(g.passwd)
+	codeChk := widget.NewCheckWithData("One-time code", g.code)
+
+	forceChk := widget.NewCheckWithData("Enable all adapters", g.force)
+
+	reasonEtr := widget.NewEntryWithData(g.reason)
+	reasonEtr.SetPlaceHolder("Reason")
+	g.category = widget.NewSelect(nil, nil)
+	g.category.PlaceHolder = "Category"
+	g.category.Hide()
+
+	durations := make([]string, 0, len(grantDurations))
+	for _, d := range grantDurations {
+		durations = append(durations, d.Label)
+	}
+	g.duration = widget.NewSelect(durations, nil)
+	g.duration.SetSelected(durations[0])
 
 	enBtn := widget.NewButton("Enable", func() {
-		err := setStatus(conn, true, passwd, status)
+		pending, err := g.setStatus(true, nil)
 		if err == nil {
-			popup(myapp, "Network Enabled")
+			popup(myapp, enabledMessage(pending))
 		} else {
 			popup(myapp, err.Error())
 		}
 	})
 
 	disBtn := widget.NewButton("Disable", func() {
-		err := setStatus(conn, false, passwd, status)
+		_, err := g.setStatus(false, nil)
 		if err == nil {
 			popup(myapp, "Network Disabled")
 		} else {
@@ -107,16 +488,55 @@ func runUI() {
 		}
 	})
 
+	signInBtn := widget.NewButton("Sign In", func() {
+		if err := g.signIn(); err != nil {
+			popup(myapp, err.Error())
+		}
+	})
+
+	lockBtn := widget.NewButton("Lock", func() {
+		if err := g.lock(); err != nil {
+			popup(myapp, err.Error())
+		}
+	})
+
+	remoteBtn := widget.NewButton("Remote Unlock", func() { g.remoteUnlock(myapp) })
+
+	examBtn := widget.NewButton("Exam", func() { g.examWindow(myapp) })
+
 	lblBox := container.NewHBox(layout.NewSpacer(), statusLbl, layout.NewSpacer())
-	btnBox := container.NewHBox(layout.NewSpacer(), enBtn, disBtn, layout.NewSpacer())
-	vbox := container.NewVBox(lblBox, passwdEtr, btnBox)
+	grantBox := container.NewHBox(layout.NewSpacer(), grantLbl, layout.NewSpacer())
+	durationBox := container.NewHBox(widget.NewLabel("Enable for:"), g.duration)
+	btnBox := container.NewHBox(layout.NewSpacer(), enBtn, disBtn, remoteBtn, layout.NewSpacer())
+	signInBox := container.NewHBox(widget.NewLabelWithData(g.signedIn), layout.NewSpacer(), signInBtn, lockBtn, examBtn)
+	vbox := container.NewVBox(lblBox, grantBox, detailsLbl, userEtr, passwdEtr, codeChk, signInBox, durationBox, forceChk, reasonEtr, g.category, btnBox)
 
 	win.SetContent(vbox)
 
-	if err = updateStatusText(conn, status); err != nil {
+	if err := g.updateStatusText(); err != nil {
 		popup(myapp, err.Error())
 	}
 
+	// update grant countdown and refresh status periodically
+	go func() {
+		tick := 0
+		for range time.Tick(time.Second) {
+			tick++
+			g.updateSessionText()
+			expired, err := g.updateGrantText()
+			if err != nil {
+				continue
+			}
+			if expired {
+				// give the service time to disable the network
+				time.Sleep(2 * time.Second)
+			}
+			if expired || tick%statusRefreshInterval == 0 {
+				g.updateStatusText()
+			}
+		}
+	}()
+
 	win.Resize(fyne.NewSize(300, 200))
 	win.ShowAndRun()
 }
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// unlock code limits
+const (
+	// unlockCodeUser is the name unlock code attempts are logged and audited as
+	unlockCodeUser   = "unlock-code"
+	maxUnlockCodes   = 99
+	unlockBatchLen   = 4
+	unlockSecretLen  = 8
+	unlockCodeFormat = "%s-%02d-%s-%s"
+)
+
+// unlockAlphabet leaves out characters that are easily confused when read from paper
+const unlockAlphabet = "23456789ABCDEFGHJKLMNPQRSTUVWXYZ"
+
+var errInvalidBatch = errors.New("invalid unlock code batch")
+
+// UnlockCode is a single-use unlock code
+type UnlockCode struct {
+	// Hash is the base64 encoded hash of the code
+	Hash string `json:"hash"`
+	// Used is when the code was used, or nil if it hasn't been
+	Used *time.Time `json:"used,omitempty"`
+}
+
+// UnlockBatch is a batch of single-use unlock codes, printed on a sheet and handed out at an event. Each code is
+// numbered by its position in the batch, starting at 1, so it can be found without checking every hash
+type UnlockBatch struct {
+	ID      string        `json:"id"`
+	Role    Role          `json:"role"`
+	Created time.Time     `json:"created"`
+	Codes   []*UnlockCode `json:"codes"`
+}
+
+// validateBatchID returns an error if id isn't made of characters from unlockAlphabet
+func validateBatchID(id string) error {
+	if len(id) != unlockBatchLen {
+		return fmt.Errorf("%w: id must be %d characters", errInvalidBatch, unlockBatchLen)
+	}
+	for _, c := range id {
+		if !strings.ContainsRune(unlockAlphabet, c) {
+			return fmt.Errorf("%w: invalid id: %s", errInvalidBatch, id)
+		}
+	}
+	return nil
+}
+
+// Validate returns an error if the batch's id, role, or hashes are invalid
+func (b *UnlockBatch) Validate() error {
+	if err := validateBatchID(b.ID); err != nil {
+		return err
+	}
+	if err := b.Role.Validate(); err != nil {
+		return fmt.Errorf("batch %s: %w", b.ID, err)
+	}
+	if b.Role == RoleAdmin {
+		return fmt.Errorf("%w: batch %s: unlock codes can't have the admin role", errInvalidBatch, b.ID)
+	}
+	if len(b.Codes) == 0 || len(b.Codes) > maxUnlockCodes {
+		return fmt.Errorf("%w: batch %s: must have 1 to %d codes", errInvalidBatch, b.ID, maxUnlockCodes)
+	}
+	for i, c := range b.Codes {
+		if _, err := parseHash(c.Hash); err != nil {
+			return fmt.Errorf("batch %s: could not parse hash of code %d: %w", b.ID, i+1, err)
+		}
+	}
+	return nil
+}
+
+// findBatch returns the batch with the given id, ignoring case, or nil if it isn't found
+func findBatch(batches []*UnlockBatch, id string) *UnlockBatch {
+	for _, b := range batches {
+		if strings.EqualFold(b.ID, id) {
+			return b
+		}
+	}
+	return nil
+}
+
+// randomString returns n random characters from unlockAlphabet
+func randomString(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("could not generate code: %w", err)
+	}
+	for i, b := range buf {
+		// len(unlockAlphabet) divides 256, so this isn't biased
+		buf[i] = unlockAlphabet[int(b)%len(unlockAlphabet)]
+	}
+	return string(buf), nil
+}
+
+// generateUnlockCodes returns a new random batch id and count codes for it
+func generateUnlockCodes(count int) (string, []string, error) {
+	if count < 1 || count > maxUnlockCodes {
+		return "", nil, fmt.Errorf("%w: must have 1 to %d codes", errInvalidBatch, maxUnlockCodes)
+	}
+	id, err := randomString(unlockBatchLen)
+	if err != nil {
+		return "", nil, err
+	}
+	codes := make([]string, count)
+	for i := range codes {
+		secret, err := randomString(unlockSecretLen)
+		if err != nil {
+			return "", nil, err
+		}
+		codes[i] = fmt.Sprintf(unlockCodeFormat, id, i+1, secret[:unlockSecretLen/2], secret[unlockSecretLen/2:])
+	}
+	return id, codes, nil
+}
+
+// parseUnlockCode returns the batch id and number of code, and code normalized to the form it was hashed in
+func parseUnlockCode(code string) (id string, n int, normalized string, ok bool) {
+	normalized = strings.ToUpper(strings.Join(strings.Fields(code), ""))
+	parts := strings.SplitN(normalized, "-", 3)
+	if len(parts) != 3 || validateBatchID(parts[0]) != nil {
+		return "", 0, "", false
+	}
+	n, err := strconv.Atoi(parts[1])
+	if err != nil || n < 1 || n > maxUnlockCodes {
+		return "", 0, "", false
+	}
+	return parts[0], n, normalized, true
+}
+
+// unlockCodeName is the name recorded for changes made with code n of batch id
+func unlockCodeName(id string, n int) string {
+	return fmt.Sprintf("unlock code %s-%02d", id, n)
+}
+
+// unlockCodeRef identifies code n of batch id
+type unlockCodeRef struct {
+	id string
+	n  int
+}
+
+// authenticateUnlockCode returns the account for an unused unlock code that isn't in use by another request. The code
+// isn't marked used until the request finishes with finishUnlockCode. errBusy is returned if the verifier's queue is
+// full
+func (s *Server) authenticateUnlockCode(code string) (*account, error) {
+	id, n, code, ok := parseUnlockCode(code)
+
+	h := getDummyHash()
+	s.mu.Lock()
+	if b := findBatch(s.Config.UnlockBatches, id); ok && b != nil && n <= len(b.Codes) && b.Codes[n-1].Used == nil {
+		h = mustParseHash(b.Codes[n-1].Hash)
+	} else {
+		ok = false
+	}
+	s.mu.Unlock()
+
+	var err error
+	if busyErr := s.verifier.do(func() { err = h.Validate([]byte(code)) }); busyErr != nil {
+		return nil, busyErr
+	}
+	if err != nil || !ok {
+		return nil, errUnauthorized
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the batch may have been revoked or the code used while validating
+	b := findBatch(s.Config.UnlockBatches, id)
+	if b == nil || n > len(b.Codes) || b.Codes[n-1].Used != nil || s.unlockCodesInUse[unlockCodeName(b.ID, n)] {
+		return nil, errUnauthorized
+	}
+	name := unlockCodeName(b.ID, n)
+	s.unlockCodesInUse[name] = true
+
+	return &account{Name: name, Role: b.Role, unlockCode: &unlockCodeRef{id: b.ID, n: n}}, nil
+}
+
+// finishUnlockCode finishes a request by acct if it was authenticated with an unlock code, marking the code used if
+// used is true, or allowing it to be used again otherwise
+func (s *Server) finishUnlockCode(acct *account, used bool) {
+	if acct.unlockCode == nil {
+		return
+	}
+	ref := acct.unlockCode
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.unlockCodesInUse, unlockCodeName(ref.id, ref.n))
+	if !used {
+		return
+	}
+
+	// the batch may have been revoked during the request
+	b := findBatch(s.Config.UnlockBatches, ref.id)
+	if b == nil || ref.n > len(b.Codes) {
+		return
+	}
+	now := serviceClock.Now()
+	b.Codes[ref.n-1].Used = &now
+	// the code stays used even if it can't be saved, so it can't be used again until the service restarts
+	if err := s.Config.Save(configPath); err != nil {
+		s.Logger.Error().Err(fmt.Errorf("could not save used unlock code: %w", err)).Send()
+	}
+
+	s.Logger.Info().Str("batch", b.ID).Int("code", ref.n).Str("role", string(b.Role)).Msg("unlock code used")
+}
+
+// unlock code actions
+const (
+	unlockActionGenerate = "generate"
+	unlockActionList     = "list"
+	unlockActionRevoke   = "revoke"
+)
+
+type unlockCodesRequest struct {
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Code     string `json:"code,omitempty"`
+	// Action is "generate", "list", or "revoke"
+	Action string `json:"action"`
+	// Batch is the id of the batch to generate or revoke
+	Batch string `json:"batch,omitempty"`
+	Role  Role   `json:"role,omitempty"`
+	// Hashes are the base64 encoded hashes of the generated codes, in order. The codes themselves are never sent
+	Hashes []string `json:"hashes,omitempty"`
+}
+
+// unlockBatchInfo is an UnlockBatch without its hashes
+type unlockBatchInfo struct {
+	ID      string    `json:"id"`
+	Role    Role      `json:"role"`
+	Created time.Time `json:"created"`
+	Total   int       `json:"total"`
+	Used    int       `json:"used"`
+}
+
+type unlockCodesResponse struct {
+	Error   string             `json:"error,omitempty"`
+	Batches []*unlockBatchInfo `json:"batches,omitempty"`
+}
+
+// writeUnlockCodesResponse writes resp with the given status code
+func (s *Server) writeUnlockCodesResponse(w http.ResponseWriter, code int, resp *unlockCodesResponse) {
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		s.Logger.Error().Err(fmt.Errorf("could not encode response: %w", err)).Send()
+	}
+}
+
+// ManageUnlockCodes is an HTTP handler that generates, lists, or revokes batches of unlock codes. It requires the
+// admin role
+func (s *Server) ManageUnlockCodes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		s.Logger.Warn().Err(fmt.Errorf("invalid method: %s", r.Method)).Send()
+		return
+	}
+
+	req := new(unlockCodesRequest)
+	body, ok := s.readRequest(w, r, req)
+	if !ok {
+		return
+	}
+
+	acct := s.authorize(w, r, body, credentials{Username: req.Username, Password: req.Password, Code: req.Code}, actionManage)
+	if acct == nil {
+		return
+	}
+
+	var batch *UnlockBatch
+	if req.Action == unlockActionGenerate {
+		batch = &UnlockBatch{ID: strings.ToUpper(req.Batch), Role: req.Role, Created: serviceClock.Now(), Codes: make([]*UnlockCode, 0, len(req.Hashes))}
+		for _, h := range req.Hashes {
+			if _, err := s.requestHash(h, ""); err != nil {
+				s.writeUnlockCodesResponse(w, http.StatusBadRequest, &unlockCodesResponse{Error: err.Error()})
+				return
+			}
+			batch.Codes = append(batch.Codes, &UnlockCode{Hash: h})
+		}
+		if err := batch.Validate(); err != nil {
+			s.writeUnlockCodesResponse(w, http.StatusBadRequest, &unlockCodesResponse{Error: err.Error()})
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	batches := s.Config.UnlockBatches
+	switch req.Action {
+	case unlockActionList:
+		resp := &unlockCodesResponse{Batches: make([]*unlockBatchInfo, 0, len(batches))}
+		for _, b := range batches {
+			info := &unlockBatchInfo{ID: b.ID, Role: b.Role, Created: b.Created, Total: len(b.Codes)}
+			for _, c := range b.Codes {
+				if c.Used != nil {
+					info.Used++
+				}
+			}
+			resp.Batches = append(resp.Batches, info)
+		}
+		s.writeUnlockCodesResponse(w, http.StatusOK, resp)
+		return
+	case unlockActionGenerate:
+		if findBatch(batches, batch.ID) != nil {
+			s.writeUnlockCodesResponse(w, http.StatusBadRequest, &unlockCodesResponse{Error: fmt.Sprintf("%v: %s already exists", errInvalidBatch, batch.ID)})
+			return
+		}
+		s.Config.UnlockBatches = append(append([]*UnlockBatch(nil), batches...), batch)
+	case unlockActionRevoke:
+		b := findBatch(batches, req.Batch)
+		if b == nil {
+			s.writeUnlockCodesResponse(w, http.StatusBadRequest, &unlockCodesResponse{Error: fmt.Sprintf("%v: %s doesn't exist", errInvalidBatch, req.Batch)})
+			return
+		}
+		remaining := make([]*UnlockBatch, 0, len(batches))
+		for _, other := range batches {
+			if other != b {
+				remaining = append(remaining, other)
+			}
+		}
+		s.Config.UnlockBatches = remaining
+	default:
+		s.writeUnlockCodesResponse(w, http.StatusBadRequest, &unlockCodesResponse{Error: fmt.Sprintf("invalid action: %q", req.Action)})
+		return
+	}
+
+	if err := s.Config.Save(configPath); err != nil {
+		s.Config.UnlockBatches = batches
+		s.Logger.Error().Err(err).Send()
+		s.writeUnlockCodesResponse(w, http.StatusInternalServerError, &unlockCodesResponse{Error: "Error (config): Please try again later"})
+		return
+	}
+
+	s.audit(&AuditRecord{Event: auditConfig, Action: "unlock-codes " + req.Action, Outcome: auditSuccess, User: acct.Name, Target: req.Batch, Peer: requestPeer(r)})
+	s.Logger.Info().Str("user", acct.Name).Str("batch", req.Batch).Int("codes", len(req.Hashes)).Msg(fmt.Sprintf("unlock codes %s", req.Action))
+	s.writeUnlockCodesResponse(w, http.StatusOK, &unlockCodesResponse{})
+}
+
+// ManageUnlockCodes sends an unlock code management request, authenticating with a challenge-response proof of
+// req.Password or req.Code
+func (c *Client) ManageUnlockCodes(req *unlockCodesRequest) (*unlockCodesResponse, error) {
+	body := *req
+	body.Password, body.Code = "", ""
+
+	resp, err := c.post("/unlock-codes", credentials{Username: req.Username, Password: req.Password, Code: req.Code}, &body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusBadRequest, http.StatusForbidden, http.StatusInternalServerError:
+		r := new(unlockCodesResponse)
+		if err := json.NewDecoder(resp.Body).Decode(r); err != nil {
+			return nil, fmt.Errorf("could not decode response: %w", err)
+		}
+		if resp.StatusCode == http.StatusForbidden {
+			return nil, fmt.Errorf("%w: %s", errForbidden, r.Error)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, errors.New(r.Error)
+		}
+		return r, nil
+	case http.StatusUnauthorized:
+		return nil, errUnauthorized
+	case http.StatusTooManyRequests:
+		return nil, clientLockoutError(resp)
+	case http.StatusServiceUnavailable:
+		return nil, errBusy
+	default:
+		return nil, fmt.Errorf("unexpected status: %d %s", resp.StatusCode, resp.Status)
+	}
+}
+
+// unlock code sheet formats
+const (
+	sheetFormatText = "text"
+	sheetFormatCSV  = "csv"
+	sheetFormatHTML = "html"
+)
+
+var sheetTemplate = template.Must(template.New("sheet").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Unlock Codes {{.ID}}</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+td { border: 1px dashed #999; padding: 1em 2em; font-family: monospace; font-size: 1.2em; }
+</style>
+</head>
+<body>
+<h1>Unlock Codes {{.ID}}</h1>
+<p>Role: {{.Role}}. Generated {{.Created.Format "2006-01-02 15:04"}}. Each code can be used once.</p>
+<table>
+{{range .Codes}}<tr><td>{{.}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// writeUnlockSheet writes a printable sheet of codes for batch in the given format
+func writeUnlockSheet(w io.Writer, format string, batch *UnlockBatch, codes []string) error {
+	switch format {
+	case sheetFormatText:
+		fmt.Fprintf(w, "Unlock codes %s (%s), generated %s. Each code can be used once.\n\n", batch.ID, batch.Role, batch.Created.Format("2006-01-02 15:04"))
+		for _, code := range codes {
+			fmt.Fprintln(w, code)
+		}
+		return nil
+	case sheetFormatCSV:
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"batch", "number", "role", "code"})
+		for i, code := range codes {
+			cw.Write([]string{batch.ID, strconv.Itoa(i + 1), string(batch.Role), code})
+		}
+		cw.Flush()
+		return cw.Error()
+	case sheetFormatHTML:
+		return sheetTemplate.Execute(w, struct {
+			*UnlockBatch
+			Codes []string
+		}{batch, codes})
+	default:
+		return fmt.Errorf("invalid format: %q", format)
+	}
+}
@@ -0,0 +1,537 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/korylprince/go-win-netcontrol/hash"
+)
+
+// Role determines the actions a user is allowed to perform
+type Role string
+
+// roles
+const (
+	// RoleProctor can only disable the network
+	RoleProctor Role = "proctor"
+	// RoleCoach can enable and disable the network and create grants
+	RoleCoach Role = "coach"
+	// RoleAdmin can perform any action, including managing users and configuration
+	RoleAdmin Role = "admin"
+)
+
+// action is an action that is authorized by Role
+type action string
+
+// actions
+const (
+	actionDisable action = "disable"
+	actionEnable  action = "enable"
+	actionGrant   action = "grant"
+	actionManage  action = "manage"
+)
+
+var roleActions = map[Role][]action{
+	RoleProctor: {actionDisable},
+	RoleCoach:   {actionDisable, actionEnable, actionGrant},
+	RoleAdmin:   {actionDisable, actionEnable, actionGrant, actionManage},
+}
+
+var (
+	errForbidden   = errors.New("forbidden")
+	errInvalidRole = errors.New("invalid role")
+	errInvalidUser = errors.New("invalid user")
+)
+
+// Validate returns an error if r isn't a known role
+func (r Role) Validate() error {
+	if _, ok := roleActions[r]; !ok {
+		return fmt.Errorf("%w: %q", errInvalidRole, r)
+	}
+	return nil
+}
+
+// Allows returns true if r is allowed to perform a
+func (r Role) Allows(a action) bool {
+	for _, allowed := range roleActions[r] {
+		if allowed == a {
+			return true
+		}
+	}
+	return false
+}
+
+// User is a named account with its own password
+type User struct {
+	Name string `json:"name"`
+	Role Role   `json:"role"`
+	// PasswordHash is the base64 encoded password hash
+	PasswordHash string `json:"password_hash"`
+	// TOTPSecret is the base32 encoded TOTP secret. If set, the user can authenticate with a code from an authenticator
+	// app instead of the password
+	TOTPSecret string `json:"totp_secret,omitempty"`
+}
+
+// Validate returns an error if the user's name, role, hash, or TOTP secret is invalid
+func (u *User) Validate() error {
+	if err := validateUserName(u.Name); err != nil {
+		return err
+	}
+	if err := u.Role.Validate(); err != nil {
+		return fmt.Errorf("user %s: %w", u.Name, err)
+	}
+	if _, err := parseHash(u.PasswordHash); err != nil {
+		return fmt.Errorf("user %s: could not parse password hash: %w", u.Name, err)
+	}
+	if u.TOTPSecret != "" {
+		if _, err := hash.ParseTOTP(u.TOTPSecret); err != nil {
+			return fmt.Errorf("user %s: could not parse TOTP secret: %w", u.Name, err)
+		}
+	}
+	return nil
+}
+
+// validateUserName returns an error if name is empty or reserved
+func validateUserName(name string) error {
+	if strings.TrimSpace(name) == "" {
+		return fmt.Errorf("%w: name cannot be empty", errInvalidUser)
+	}
+	if strings.EqualFold(name, sharedPasswordUser) || strings.EqualFold(name, systemUser) ||
+		strings.EqualFold(name, unlockCodeUser) || strings.EqualFold(name, remoteUnlockUser) {
+		return fmt.Errorf("%w: %s is reserved", errInvalidUser, name)
+	}
+	return nil
+}
+
+// findUser returns the user with the given name, ignoring case, or nil if it isn't found
+func findUser(users []*User, name string) *User {
+	for _, u := range users {
+		if strings.EqualFold(u.Name, name) {
+			return u
+		}
+	}
+	return nil
+}
+
+// account is an authenticated user
+type account struct {
+	Name string
+	Role Role
+	// named is true for the accounts of configured users, rather than the shared password or single-use credentials
+	named bool
+	// unlockCode is the unlock code the account was authenticated with, if any. It's only marked used by
+	// finishUnlockCode
+	unlockCode *unlockCodeRef
+}
+
+// dummyHash is validated against when a user doesn't exist, so unknown users take as long to reject as real ones
+var (
+	dummyHash     *hash.Hash
+	dummyHashOnce sync.Once
+)
+
+func getDummyHash() *hash.Hash {
+	dummyHashOnce.Do(func() {
+		h, err := hash.New([]byte("dummy"), hashTime, hashMemory, hashThreads)
+		if err != nil {
+			panic(err)
+		}
+		dummyHash = h
+	})
+	return dummyHash
+}
+
+// credentials authenticate a request with a password, a TOTP code, an unlock code, or a remote unlock
+type credentials struct {
+	// Username is the user to authenticate as. If empty, the shared password is used
+	Username string
+	Password string
+	// Code is a TOTP code, used instead of Password if set
+	Code string
+	// UnlockCode is a single-use unlock code, used instead of the other credentials if set
+	UnlockCode string
+	// Remote is a remote unlock challenge and response, used instead of the other credentials if set
+	Remote *remoteUnlock
+}
+
+// method returns the name of the credential used, for the audit log
+func (c credentials) method() string {
+	switch {
+	case c.Remote != nil:
+		return "remote-unlock"
+	case c.UnlockCode != "":
+		return "unlock-code"
+	case c.Code != "":
+		return "totp"
+	default:
+		return "password"
+	}
+}
+
+// lookup returns the account and hash for name, or the shared password if name is empty. If name doesn't exist or
+// the shared password is disabled, a nil account and a hash to verify against anyway are returned
+func (s *Server) lookup(name string) (*account, *hash.Hash) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if name == "" {
+		role := s.Config.sharedPasswordRole()
+		if role == "" {
+			return nil, s.passhash
+		}
+		return &account{Name: sharedPasswordUser, Role: role}, s.passhash
+	}
+	if u := findUser(s.Config.Users, name); u != nil {
+		return &account{Name: u.Name, Role: u.Role, named: true}, mustParseHash(u.PasswordHash)
+	}
+	return nil, getDummyHash()
+}
+
+// authenticateRequest returns the account for r, using cred's unlock code or remote unlock if set, or the
+// challenge-response proof in r's headers otherwise. Passwords and TOTP codes are only accepted as proofs, so they're
+// never sent. body is r's body
+func (s *Server) authenticateRequest(r *http.Request, body []byte, cred credentials) (*account, error) {
+	if cred.Remote != nil {
+		return s.authenticateRemoteUnlock(cred.Remote)
+	}
+	if cred.UnlockCode != "" {
+		return s.authenticateUnlockCode(cred.UnlockCode)
+	}
+
+	name := cred.Username
+	if r.Header.Get(proofHeader) == "" {
+		return nil, errUnauthorized
+	}
+
+	nonce, err := base64.StdEncoding.DecodeString(r.Header.Get(nonceHeader))
+	if err != nil {
+		return nil, errUnauthorized
+	}
+	proof, err := base64.StdEncoding.DecodeString(r.Header.Get(proofHeader))
+	if err != nil {
+		return nil, errUnauthorized
+	}
+	return s.authenticateProof(name, nonce, proof, proofMessage(nonce, r.Method, r.URL.Path, body))
+}
+
+// authorize checks the request's peer against the peer rules, authenticates the request with body by its session
+// token, or its credentials subject to the lockout limiter, and checks the account is allowed to perform each action,
+// writing an error response and returning nil if not
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request, body []byte, cred credentials, actions ...action) *account {
+	attempt := &AuditRecord{Event: auditAuth, Action: auditActions(actions), Method: cred.method(), Peer: requestPeer(r)}
+	defer s.audit(attempt)
+
+	name := cred.Username
+	if cred.Remote != nil {
+		name = remoteUnlockUser
+	} else if cred.UnlockCode != "" {
+		name = unlockCodeUser
+	}
+	attempt.User = name
+	if name == "" {
+		attempt.User = sharedPasswordUser
+	}
+
+	// check the peer first, so denied peers can't use up single-use credentials or trigger lockouts
+	if !s.allowPeer(w, r, actions...) {
+		attempt.Outcome, attempt.Error = auditDenied, "denied by peer rule"
+		return nil
+	}
+
+	if token := bearerToken(r); token != "" {
+		attempt.Method, attempt.User = auditMethodSession, ""
+		acct, err := s.sessions.lookup(token, connID(r))
+		if err != nil {
+			attempt.Outcome, attempt.Error = auditFailure, err.Error()
+			w.WriteHeader(http.StatusUnauthorized)
+			s.Logger.Warn().Err(err).Msg("invalid session")
+			return nil
+		}
+		return s.allowAttempt(w, attempt, acct, actions...)
+	}
+
+	peer, limitName := requestPeer(r), s.attemptName(cred)
+	if until, ok := s.limiter.begin(peer, limitName); !ok {
+		attempt.Outcome = auditLockedOut
+		s.Logger.Warn().Str("user", name).Stringer("peer", peer).Time("until", until).Msg("attempt rejected by lockout")
+		s.writeLockout(w, until)
+		return nil
+	}
+
+	acct, err := s.authenticateRequest(r, body, cred)
+	if errors.Is(err, errBusy) {
+		attempt.Outcome = auditBusy
+		s.limiter.cancel(peer, limitName)
+		s.Logger.Warn().Str("user", name).Msg("attempt rejected by verifier")
+		s.writeBusy(w)
+		return nil
+	}
+	if until := s.limiter.end(peer, limitName, err == nil); err != nil {
+		attempt.Outcome, attempt.Error = auditFailure, err.Error()
+		event := s.Logger.Warn().Str("user", name).Stringer("peer", peer)
+		if !until.IsZero() {
+			event = event.Time("until", until)
+		}
+		event.Msg("invalid password")
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil
+	}
+
+	if s.allowAttempt(w, attempt, acct, actions...) == nil {
+		// a single-use code is only used up by a request it's allowed to make
+		s.finishUnlockCode(acct, false)
+		return nil
+	}
+	return acct
+}
+
+// allowAttempt calls allow, recording the result in attempt
+func (s *Server) allowAttempt(w http.ResponseWriter, attempt *AuditRecord, acct *account, actions ...action) *account {
+	attempt.User = acct.Name
+	if s.allow(w, acct, actions...) == nil {
+		attempt.Outcome, attempt.Error = auditDenied, fmt.Sprintf("%s role is not allowed", acct.Role)
+		return nil
+	}
+	attempt.Outcome = auditSuccess
+	return acct
+}
+
+// allow checks acct is allowed to perform each action, writing an error response and returning nil if not
+func (s *Server) allow(w http.ResponseWriter, acct *account, actions ...action) *account {
+	for _, a := range actions {
+		if !acct.Role.Allows(a) {
+			s.Logger.Warn().Str("user", acct.Name).Str("role", string(acct.Role)).Str("action", string(a)).Msg("action not allowed")
+			s.writeResponse(w, http.StatusForbidden, &response{Error: fmt.Sprintf("%s is not allowed to %s", acct.Name, a)})
+			return nil
+		}
+	}
+
+	return acct
+}
+
+// user actions
+const (
+	userActionList   = "list"
+	userActionAdd    = "add"
+	userActionRemove = "remove"
+	// userActionTOTP generates a new TOTP secret for a user, replacing any existing secret
+	userActionTOTP = "totp"
+	// userActionRemoveTOTP removes a user's TOTP secret
+	userActionRemoveTOTP = "remove-totp"
+)
+
+type userRequest struct {
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Code     string `json:"code,omitempty"`
+	// Action is "list", "add", "remove", "totp", or "remove-totp"
+	Action string `json:"action"`
+	// Name is the user to add, remove, or change
+	Name string `json:"name,omitempty"`
+	Role Role   `json:"role,omitempty"`
+	// NewPassword is the password of the added user
+	NewPassword string `json:"new_password,omitempty"`
+	// NewHash is the base64 encoded hash of the added user's password, used instead of NewPassword so the password
+	// isn't sent
+	NewHash string `json:"new_hash,omitempty"`
+}
+
+// userInfo is a User without its password hash
+type userInfo struct {
+	Name string `json:"name"`
+	Role Role   `json:"role"`
+	// TOTP is true if the user has a TOTP secret
+	TOTP bool `json:"totp,omitempty"`
+}
+
+type userResponse struct {
+	Error string      `json:"error,omitempty"`
+	Users []*userInfo `json:"users,omitempty"`
+	// TOTP is the user's new TOTP secret
+	TOTP *totpInfo `json:"totp,omitempty"`
+}
+
+// writeUserResponse writes resp with the given status code
+func (s *Server) writeUserResponse(w http.ResponseWriter, code int, resp *userResponse) {
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		s.Logger.Error().Err(fmt.Errorf("could not encode response: %w", err)).Send()
+	}
+}
+
+// ManageUsers is an HTTP handler that lists, adds, or removes users. It requires the admin role
+func (s *Server) ManageUsers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		s.Logger.Warn().Err(fmt.Errorf("invalid method: %s", r.Method)).Send()
+		return
+	}
+
+	req := new(userRequest)
+	body, ok := s.readRequest(w, r, req)
+	if !ok {
+		return
+	}
+
+	acct := s.authorize(w, r, body, credentials{Username: req.Username, Password: req.Password, Code: req.Code}, actionManage)
+	if acct == nil {
+		return
+	}
+
+	// hash before locking, since hashing is slow
+	var hashstr string
+	if req.Action == userActionAdd {
+		var err error
+		if hashstr, err = s.requestHash(req.NewHash, req.NewPassword); errors.Is(err, errBusy) {
+			s.writeBusy(w)
+			return
+		} else if err != nil {
+			s.Logger.Warn().Err(err).Send()
+			s.writeUserResponse(w, http.StatusBadRequest, &userResponse{Error: err.Error()})
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	users := s.Config.Users
+	resp := &userResponse{}
+	switch req.Action {
+	case userActionList:
+		resp.Users = make([]*userInfo, 0, len(users))
+		for _, u := range users {
+			resp.Users = append(resp.Users, &userInfo{Name: u.Name, Role: u.Role, TOTP: u.TOTPSecret != ""})
+		}
+		s.writeUserResponse(w, http.StatusOK, resp)
+		return
+	case userActionAdd:
+		u := &User{Name: req.Name, Role: req.Role, PasswordHash: hashstr}
+		if err := u.Validate(); err != nil {
+			s.writeUserResponse(w, http.StatusBadRequest, &userResponse{Error: err.Error()})
+			return
+		}
+		if findUser(users, u.Name) != nil {
+			s.writeUserResponse(w, http.StatusBadRequest, &userResponse{Error: fmt.Sprintf("%v: %s already exists", errInvalidUser, u.Name)})
+			return
+		}
+		s.Config.Users = append(append([]*User(nil), users...), u)
+		if !s.Config.hasAdmin() {
+			// the shared password is disabled by the first user unless its role is configured
+			s.Config.Users = users
+			s.writeUserResponse(w, http.StatusBadRequest, &userResponse{Error: fmt.Sprintf("%v: %s would disable the shared password, so the first user must be an admin", errInvalidUser, u.Name)})
+			return
+		}
+	case userActionRemove:
+		u := findUser(users, req.Name)
+		if u == nil {
+			s.writeUserResponse(w, http.StatusBadRequest, &userResponse{Error: fmt.Sprintf("%v: %s doesn't exist", errInvalidUser, req.Name)})
+			return
+		}
+		remaining := make([]*User, 0, len(users))
+		for _, other := range users {
+			if other != u {
+				remaining = append(remaining, other)
+			}
+		}
+		s.Config.Users = remaining
+		if !s.Config.hasAdmin() {
+			s.Config.Users = users
+			s.writeUserResponse(w, http.StatusBadRequest, &userResponse{Error: fmt.Sprintf("%v: %s is the last admin", errInvalidUser, u.Name)})
+			return
+		}
+		s.sessions.revokeUser(u.Name)
+	case userActionTOTP, userActionRemoveTOTP:
+		u := findUser(users, req.Name)
+		if u == nil {
+			s.writeUserResponse(w, http.StatusBadRequest, &userResponse{Error: fmt.Sprintf("%v: %s doesn't exist", errInvalidUser, req.Name)})
+			return
+		}
+		changed := *u
+		changed.TOTPSecret = ""
+		if req.Action == userActionTOTP {
+			t, err := hash.NewTOTP()
+			if err != nil {
+				s.Logger.Error().Err(err).Send()
+				s.writeUserResponse(w, http.StatusInternalServerError, &userResponse{Error: "Error (totp): Please try again later"})
+				return
+			}
+			changed.TOTPSecret = t.Secret()
+			resp = &userResponse{TOTP: &totpInfo{Secret: t.Secret(), URI: t.URI(totpIssuer, u.Name)}}
+		}
+		s.Config.Users = replaceUser(users, u, &changed)
+	default:
+		s.writeUserResponse(w, http.StatusBadRequest, &userResponse{Error: fmt.Sprintf("invalid action: %q", req.Action)})
+		return
+	}
+
+	if err := s.Config.Save(configPath); err != nil {
+		s.Config.Users = users
+		s.Logger.Error().Err(err).Send()
+		s.writeUserResponse(w, http.StatusInternalServerError, &userResponse{Error: "Error (config): Please try again later"})
+		return
+	}
+
+	s.audit(&AuditRecord{Event: auditConfig, Action: "user " + req.Action, Outcome: auditSuccess, User: acct.Name, Target: req.Name, Peer: requestPeer(r)})
+	s.Logger.Info().Str("user", acct.Name).Str("name", req.Name).Str("role", string(req.Role)).Msg(fmt.Sprintf("user %s", req.Action))
+	s.writeUserResponse(w, http.StatusOK, resp)
+}
+
+// replaceUser returns a copy of users with old replaced by u
+func replaceUser(users []*User, old, u *User) []*User {
+	replaced := make([]*User, len(users))
+	for i, other := range users {
+		if other == old {
+			other = u
+		}
+		replaced[i] = other
+	}
+	return replaced
+}
+
+// ManageUsers sends a user management request, authenticating with a challenge-response proof of req.Password. The
+// new user's password is hashed locally, so neither password is sent
+func (c *Client) ManageUsers(req *userRequest) (*userResponse, error) {
+	body := *req
+	body.Password, body.Code, body.NewPassword = "", "", ""
+	if req.Action == userActionAdd {
+		var err error
+		if body.NewHash, err = newHash(req.NewPassword); err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := c.post("/users", credentials{Username: req.Username, Password: req.Password, Code: req.Code}, &body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusBadRequest, http.StatusForbidden, http.StatusInternalServerError:
+		r := new(userResponse)
+		if err := json.NewDecoder(resp.Body).Decode(r); err != nil {
+			return nil, fmt.Errorf("could not decode response: %w", err)
+		}
+		if resp.StatusCode == http.StatusForbidden {
+			return nil, fmt.Errorf("%w: %s", errForbidden, r.Error)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, errors.New(r.Error)
+		}
+		return r, nil
+	case http.StatusUnauthorized:
+		return nil, errUnauthorized
+	case http.StatusTooManyRequests:
+		return nil, clientLockoutError(resp)
+	case http.StatusServiceUnavailable:
+		return nil, errBusy
+	default:
+		return nil, fmt.Errorf("unexpected status: %d %s", resp.StatusCode, resp.Status)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+)
+
+// verifier defaults
+const (
+	DefaultVerifyConcurrency = 2
+	DefaultVerifyQueue       = 8
+)
+
+var errBusy = errors.New("service is busy, please try again")
+
+// verifyMetrics are the current state and counters of a verifier
+type verifyMetrics struct {
+	// Concurrency is the maximum number of concurrent hash evaluations
+	Concurrency int `json:"concurrency"`
+	// Queue is the maximum number of hash evaluations waiting to start
+	Queue int `json:"queue"`
+	// Active is the number of running hash evaluations
+	Active int `json:"active"`
+	// Waiting is the number of hash evaluations waiting to start
+	Waiting int `json:"waiting"`
+	// Total is the number of completed hash evaluations
+	Total uint64 `json:"total"`
+	// Rejected is the number of hash evaluations rejected because the queue was full
+	Rejected uint64 `json:"rejected"`
+}
+
+// verifier bounds the number of concurrent Argon2 hash evaluations, since each one uses a lot of memory. Evaluations
+// wait in a bounded queue for a free slot, and are rejected immediately when the queue is full
+type verifier struct {
+	slots chan struct{}
+	queue int
+
+	mu      sync.Mutex
+	metrics verifyMetrics
+}
+
+func newVerifier(concurrency, queue int) *verifier {
+	return &verifier{
+		slots:   make(chan struct{}, concurrency),
+		queue:   queue,
+		metrics: verifyMetrics{Concurrency: concurrency, Queue: queue},
+	}
+}
+
+// do runs f when a slot is free, returning errBusy without running f if the queue is full
+func (v *verifier) do(f func()) error {
+	select {
+	case v.slots <- struct{}{}:
+		v.mu.Lock()
+	default:
+		v.mu.Lock()
+		if v.metrics.Waiting >= v.queue {
+			v.metrics.Rejected++
+			v.mu.Unlock()
+			return errBusy
+		}
+		v.metrics.Waiting++
+		v.mu.Unlock()
+
+		v.slots <- struct{}{}
+
+		v.mu.Lock()
+		v.metrics.Waiting--
+	}
+	v.metrics.Active++
+	v.mu.Unlock()
+
+	defer func() {
+		<-v.slots
+		v.mu.Lock()
+		v.metrics.Active--
+		v.metrics.Total++
+		v.mu.Unlock()
+	}()
+
+	f()
+	return nil
+}
+
+// stats returns a copy of the verifier's metrics
+func (v *verifier) stats() *verifyMetrics {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	m := v.metrics
+	return &m
+}
+
+// writeBusy writes a Service Unavailable response for a hash evaluation that was rejected
+func (s *Server) writeBusy(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "1")
+	s.writeResponse(w, http.StatusServiceUnavailable, &response{Error: errBusy.Error()})
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestVerifier(t *testing.T) {
+	v := newVerifier(1, 1)
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	done := make(chan error, 2)
+	go func() {
+		done <- v.do(func() {
+			close(started)
+			<-release
+		})
+	}()
+	<-started
+
+	// the second evaluation waits in the queue
+	go func() { done <- v.do(func() {}) }()
+	waitFor(t, "evaluation to be queued", func() bool { return v.stats().Waiting == 1 })
+
+	if err := v.do(func() { t.Errorf("evaluation ran with full queue") }); !errors.Is(err, errBusy) {
+		t.Errorf("full queue error: want: %v, have: %v", errBusy, err)
+	}
+
+	if m := v.stats(); m.Active != 1 || m.Waiting != 1 || m.Rejected != 1 {
+		t.Errorf("metrics: want: 1 active, 1 waiting, 1 rejected, have: %+v", m)
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("evaluation error: want: nil, have: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for evaluations")
+		}
+	}
+
+	if m := v.stats(); m.Active != 0 || m.Waiting != 0 || m.Total != 2 || m.Concurrency != 1 || m.Queue != 1 {
+		t.Errorf("metrics: want: 2 total, have: %+v", m)
+	}
+}
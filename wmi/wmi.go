@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"runtime"
+	"time"
 
 	"github.com/go-ole/go-ole"
 	"github.com/go-ole/go-ole/oleutil"
@@ -13,6 +14,12 @@ import (
 // ErrNilObject indicates an nil object was unexpectedly received
 var ErrNilObject = errors.New("returned nil object")
 
+// ErrTimeout indicates no event was received before the timeout
+var ErrTimeout = errors.New("timed out waiting for event")
+
+// wbemErrTimedOut is the WMI error code returned when NextEvent times out
+const wbemErrTimedOut = 0x80043001
+
 // Conn is a WMI connection. A Conn should only be used by a single thread
 type Conn struct {
 	locator *ole.IUnknown
@@ -170,3 +177,45 @@ func (rows *Rows) Next() (*ole.IDispatch, error) {
 func (rows *Rows) Err() error {
 	return rows.err
 }
+
+// Events is the result of a notification query
+type Events struct {
+	source *ole.VARIANT
+}
+
+// Notify executes the notification query and returns an event source
+func (conn *Conn) Notify(query string) (*Events, error) {
+	source, err := conn.service.ToIDispatch().CallMethod("ExecNotificationQuery", query)
+	if err != nil {
+		return nil, fmt.Errorf("could not execute notification query: %w", err)
+	} else if source == nil {
+		return nil, fmt.Errorf("could not execute notification query: %w", ErrNilObject)
+	}
+
+	return &Events{source: source}, nil
+}
+
+// Next waits up to timeout for the next event, which must be released by the caller. ErrTimeout is returned if no
+// event was received
+func (e *Events) Next(timeout time.Duration) (*ole.IDispatch, error) {
+	event, err := e.source.ToIDispatch().CallMethod("NextEvent", int32(timeout/time.Millisecond))
+	if err != nil {
+		var oleErr *ole.OleError
+		if errors.As(err, &oleErr) {
+			if info, ok := oleErr.SubError().(ole.EXCEPINFO); ok && info.SCODE() == wbemErrTimedOut {
+				return nil, ErrTimeout
+			}
+		}
+		return nil, fmt.Errorf("could not get next event: %w", err)
+	}
+
+	return event.ToIDispatch(), nil
+}
+
+// Close closes the event source and should always be called on returned Events
+func (e *Events) Close() error {
+	if err := e.source.Clear(); err != nil {
+		return fmt.Errorf("could not clear event source: %w", err)
+	}
+	return nil
+}